@@ -9,6 +9,7 @@ import (
 	"errors"
 	"math"
 	"net/http"
+	"strings"
 	"time"
 
 	"fortio.org/log"
@@ -16,7 +17,7 @@ import (
 )
 
 type SlackMessenger interface {
-	PostMessage(req SlackPostMessageRequest, url string, token string) error
+	PostMessage(ctx context.Context, req SlackPostMessageRequest, url string, token string) (SlackResponse, error)
 }
 
 type SlackClient struct {
@@ -97,6 +98,18 @@ var slackPermanentErrors = map[string]string{
 	"team_added_to_org": "The workspace associated with your request is currently undergoing migration to an Enterprise" +
 		" Organization. Web API and other platform operations will be intermittently unavailable until the" +
 		" transition is complete.",
+
+	// reactions.add and reactions.remove, see SlackReactor.
+	"bad_timestamp":      "Value passed for timestamp was invalid.",
+	"invalid_name":       "Value passed for name was invalid.",
+	"message_not_found":  "Message specified by channel and timestamp does not exist.",
+	"too_many_emoji":     "The limit for distinct reactions (i.e emoji) on the item has been reached.",
+	"too_many_reactions": "The limit for reactions a person may add to the item has been reached.",
+
+	// Not Slack errors: the messenger in use can't upload files (see SlackFileUploader) or react (see
+	// SlackReactor).
+	"upload_not_supported":    "The messenger doesn't support file uploads.",
+	"reactions_not_supported": "The messenger doesn't support reactions.",
 }
 
 var slackRetryErrors = map[string]string{
@@ -114,6 +127,9 @@ var slackRetryErrors = map[string]string{
 
 var doNotProcessChannels = map[string]time.Time{}
 
+// Slack truncates (or rejects with msg_too_long) longer message texts.
+const slackMaxTextLength = 40000
+
 func CheckError(err string) (retryable bool, pause bool, description string) {
 	// Special case for channel_not_found, we don't want to retry this one right away.
 	// We are making it a 'soft failure' so that we don't keep retrying it for a period of time for any
@@ -136,16 +152,17 @@ func CheckError(err string) (retryable bool, pause bool, description string) {
 	return true, false, "Unknown error"
 }
 
-func (s *SlackClient) PostMessage(request SlackPostMessageRequest, url string, token string) error {
+func (s *SlackClient) PostMessage(ctx context.Context, request SlackPostMessageRequest, url string, token string) (SlackResponse, error) {
+	var slackResp SlackResponse
 	jsonValue, err := json.Marshal(request)
 	if err != nil {
-		return err
+		return slackResp, err
 	}
-	// Detach from the caller/new context. TODO: have some timeout (or use jrpc package functions which
-	// do that already)
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewBuffer(jsonValue))
+	// The context is detached from the caller's cancellation, it only carries the trace. TODO: have some
+	// timeout (or use jrpc package functions which do that already)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonValue))
 	if err != nil {
-		return err
+		return slackResp, err
 	}
 
 	// Charset is required to remove warnings from Slack. Maybe it's nice to have it configurable.
@@ -154,43 +171,107 @@ func (s *SlackClient) PostMessage(request SlackPostMessageRequest, url string, t
 	// Documentation says that you are allowed the POST the token instead, however that does simply not
 	// work. Hence why we are using the Authorization header.
 	req.Header.Set("Authorization", "Bearer "+token)
+	injectTrace(req)
 
 	resp, err := s.client.Do(req)
 	if err != nil {
-		return err
+		return slackResp, err
 	}
 	defer resp.Body.Close()
 
-	var slackResp SlackResponse
 	err = json.NewDecoder(resp.Body).Decode(&slackResp)
 	if err != nil {
-		return err
+		return slackResp, err
 	}
 
 	if !slackResp.Ok {
-		return errors.New(slackResp.Error)
+		return slackResp, errors.New(slackResp.Error)
 	}
 
-	return nil
+	return slackResp, nil
+}
+
+// slackMethodURL returns the url of another Slack api method, next to chat.postMessage (so tests and
+// proxies configured with -slackURL work for all the methods).
+func slackMethodURL(postMessageURL, method string) string {
+	return postMessageURL[:strings.LastIndex(postMessageURL, "/")+1] + method
 }
 
 func NewApp(queueSize int, httpClient *http.Client,
 	metrics *Metrics, channelOverride, slackPostMessageURL, slackToken string,
 ) *App {
 	return &App{
-		slackQueue:          make(chan SlackPostMessageRequest, queueSize),
+		slackQueue:          newMessageQueue(queueSize, false),
 		messenger:           &SlackClient{client: httpClient},
 		SlackPostMessageURL: slackPostMessageURL,
 		SlackToken:          slackToken,
 		metrics:             metrics,
 		channelOverride:     channelOverride,
+		quiet:               newQuietSuppressor(nil),
 	}
 }
 
 func (app *App) Shutdown() {
-	close(app.slackQueue)
+	// Nothing can be pushed once the queue is closed.
+	app.stopReleasing()
+	if app.scheduler != nil {
+		if pending := len(app.scheduler.List("")); pending > 0 {
+			log.S(log.Warning, "Dropping the scheduled messages not due yet", log.Int("count", pending))
+		}
+	}
+	// Post what is still held, and the flood summaries, rather than losing them.
+	app.quiet.release(app, true)
+	app.flood.release(app, true)
+	app.slackQueue.Close()
 	// Very important to wait, so that we process all the messages in the queue before exiting!
 	app.wg.Wait()
+	// What matters most first, the copies to the tee and shadow destinations can take a while.
+	if app.threads != nil {
+		if err := app.threads.Save(); err != nil {
+			log.S(log.Error, "Failed to save the threads", log.Any("err", err))
+		}
+	}
+	if err := app.audit.Close(); err != nil {
+		log.S(log.Error, "Failed to close the audit log", log.Any("err", err))
+	}
+	ctx := context.Background()
+	if app.flushTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, app.flushTimeout)
+		defer cancel()
+	}
+	app.tee.Close(ctx)
+	app.shadow.Close(ctx)
+	app.shutdownTracing()
+}
+
+// startReleases starts the goroutines pushing the scheduled messages, the ones held during quiet hours
+// and the flood summaries to the queue, until stopReleasing is called or the context is canceled.
+func (app *App) startReleases(ctx context.Context) {
+	ctx, app.stopReleases = context.WithCancel(ctx)
+	run := func(release func()) {
+		app.releases.Add(1)
+		go func() {
+			defer app.releases.Done()
+			release()
+		}()
+	}
+	run(func() { app.quiet.ReleaseEvery(ctx, app, 30*time.Second) })
+	if app.flood != nil {
+		run(func() { app.flood.ReleaseEvery(ctx, app) })
+	}
+	if app.scheduler != nil {
+		run(func() { app.scheduler.Run(ctx, app.releaseScheduled) })
+	}
+}
+
+// stopReleasing stops the goroutines started by startReleases and waits for them.
+func (app *App) stopReleasing() {
+	if app.stopReleases == nil {
+		return
+	}
+	app.stopReleases()
+	app.releases.Wait()
 }
 
 //nolint:gocognit // but could probably use a refactor.
@@ -205,99 +286,123 @@ func (app *App) processQueue(ctx context.Context, maxRetries int,
 	r := rate.NewLimiter(rate.Every(slackRequestRate), burst)
 
 	for {
-		select {
-		case msg, ok := <-app.slackQueue:
-			// We do check if the channel is closed, but its important to note is that the channel will be
-			// closed when the queue is empty and the Shutdown() is called.
-			// Simply calling close(app.slackQueue) will not close the channel, it will only prevent any more
-			// messages from being sent to the channel.
-			// Only once the channel is empty, will it be closed.
-			if !ok {
-				return
+		msg, ok := app.slackQueue.Pop(ctx)
+		// Pop only reports the queue as closed once it is empty after Shutdown() is called, or when the
+		// context is canceled.
+		if !ok {
+			return
+		}
+		popped := time.Now()
+		log.S(log.Debug, "Got message from queue", log.Any("message", msg))
+
+		// Rate limiter was initially before fetching a message from the queue, but that caused problems by
+		// indefinitely looping even if there was no message in the queue.
+		// On shutdown, it would cancel the context, even if the queue was stopped (thus no messages would
+		// even come in).
+		err := r.Wait(ctx)
+		if err != nil {
+			log.Fatalf("Error while waiting for rate limiter. This should not happen, provide debug info + error message"+
+				" to an issue if it does: %v", err)
+			return
+		}
+
+		// Update the queue size metric after any change on the queue size
+		app.updateQueueSize()
+		app.observeQueueWait(msg)
+		app.traceQueue(msg, popped)
+
+		// Digests accept more messages until the very last moment.
+		app.sealDigest(msg)
+		app.threadMessage(msg)
+		label := app.channelLabel(msg.Request.Channel)
+		if app.expired(msg, label) {
+			app.recordOutcome(msg, deliveryResult{Outcome: outcomeExpired})
+			app.wg.Done()
+			continue
+		}
+		app.splitMessage(msg)
+		setFallbackText(msg)
+
+		retryCount := 0
+		var result deliveryResult
+		for {
+			// Check if the channel is in the doNotProcessChannels map, if it is, check if it's been more than
+			// 15 minutes since we last tried to send a message to it.
+			if (doNotProcessChannels[msg.Request.Channel] != time.Time{}) {
+				if time.Since(doNotProcessChannels[msg.Request.Channel]) >= 15*time.Minute {
+					// Remove the channel from the map, so that we can process it again. If the channel isn't created
+					// in the meantime, we will just add it again.
+					delete(doNotProcessChannels, msg.Request.Channel)
+				} else {
+					log.S(log.Info, "Channel is on the doNotProcess list, not trying to post this message", log.String("channel", msg.Request.Channel))
+					app.metrics.RequestsNotProcessed.WithLabelValues(label).Inc()
+					result = deliveryResult{Outcome: outcomeNotProcessed, Error: "channel_not_found", Attempts: retryCount}
+					break
+				}
 			}
-			log.S(log.Debug, "Got message from queue", log.Any("message", msg))
 
-			// Rate limiter was initially before fetching a message from the queue, but that caused problems by
-			// indefinitely looping even if there was no message in the queue.
-			// On shutdown, it would cancel the context, even if the queue was stopped (thus no messages would
-			// even come in).
-			err := r.Wait(ctx)
+			start := time.Now()
+			attemptCtx, span := app.traceAttempt(msg, label, retryCount+1)
+			response, err := app.send(attemptCtx, msg)
+			latency := time.Since(start)
+			endAttempt(span, response, err)
+			app.auditAttempt(msg, retryCount+1, err, latency)
+			app.observeAttempt(msg, label, retryCount+1, err, latency)
+			//nolint:nestif // but simplify by not having else at least.
 			if err != nil {
-				log.Fatalf("Error while waiting for rate limiter. This should not happen, provide debug info + error message"+
-					" to an issue if it does: %v", err)
-				return
-			}
+				retryable, pause, description := CheckError(err.Error())
+				result = deliveryResult{Outcome: outcomeFailed, Error: err.Error(), Attempts: retryCount + 1}
+
+				// We keep track of channels that are paused in a map, and we will retry it after a period of time.
+				if pause {
+					doNotProcessChannels[msg.Request.Channel] = time.Now()
+					log.S(log.Warning, "Channel not found, pausing for 15 minutes", log.String("channel", msg.Request.Channel))
+					app.metrics.RequestsNotProcessed.WithLabelValues(label).Inc()
+					result.Outcome = outcomeNotProcessed
+					break
+				}
 
-			// Update the queue size metric after any change on the queue size
-			app.metrics.QueueSize.With(nil).Set(float64(len(app.slackQueue)))
-
-			retryCount := 0
-			for {
-				// Check if the channel is in the doNotProcessChannels map, if it is, check if it's been more than
-				// 15 minutes since we last tried to send a message to it.
-				if (doNotProcessChannels[msg.Channel] != time.Time{}) {
-					if time.Since(doNotProcessChannels[msg.Channel]) >= 15*time.Minute {
-						// Remove the channel from the map, so that we can process it again. If the channel isn't created
-						// in the meantime, we will just add it again.
-						delete(doNotProcessChannels, msg.Channel)
-					} else {
-						log.S(log.Info, "Channel is on the doNotProcess list, not trying to post this message", log.String("channel", msg.Channel))
-						app.metrics.RequestsNotProcessed.WithLabelValues(msg.Channel).Inc()
-						break
-					}
+				if !retryable {
+					app.metrics.RequestsFailedTotal.WithLabelValues(label).Inc()
+					log.S(log.Error, "Permanent error, message will not be retried", log.Any("err", err),
+						log.String("description", description), log.String("channel", msg.Request.Channel), log.Any("message", msg))
+					break
 				}
 
-				err := app.messenger.PostMessage(msg, app.SlackPostMessageURL, app.SlackToken)
-				//nolint:nestif // but simplify by not having else at least.
-				if err != nil {
-					retryable, pause, description := CheckError(err.Error())
-
-					// We keep track of channels that are paused in a map, and we will retry it after a period of time.
-					if pause {
-						doNotProcessChannels[msg.Channel] = time.Now()
-						log.S(log.Warning, "Channel not found, pausing for 15 minutes", log.String("channel", msg.Channel))
-						app.metrics.RequestsNotProcessed.WithLabelValues(msg.Channel).Inc()
-						break
-					}
-
-					if !retryable {
-						app.metrics.RequestsFailedTotal.WithLabelValues(msg.Channel).Inc()
-						log.S(log.Error, "Permanent error, message will not be retried", log.Any("err", err),
-							log.String("description", description), log.String("channel", msg.Channel), log.Any("message", msg))
-						break
-					}
-
-					if description == "Unknown error" {
-						log.S(log.Error, "Unknown error, since we can't infer what type of error it is, we will retry it. However, please"+
-							" create a ticket/issue for this project for this error", log.Any("err", err))
-					}
-					log.S(log.Warning, "Temporary error, message will be retried", log.Any("err", err),
-						log.String("description", description), log.String("channel", msg.Channel), log.Any("message", msg))
-
-					app.metrics.RequestsRetriedTotal.WithLabelValues(msg.Channel).Inc()
-
-					if retryCount < maxRetries {
-						retryCount++
-						backoffDuration := initialBackoff * time.Duration(math.Pow(2, float64(retryCount-1)))
-						time.Sleep(backoffDuration)
-					} else {
-						log.S(log.Error, "Message failed after retries", log.Any("err", err), log.Int("retryCount", retryCount))
-						app.metrics.RequestsFailedTotal.WithLabelValues(msg.Channel).Inc()
-						break
-					}
+				if description == "Unknown error" {
+					log.S(log.Error, "Unknown error, since we can't infer what type of error it is, we will retry it. However, please"+
+						" create a ticket/issue for this project for this error", log.Any("err", err))
+				}
+				log.S(log.Warning, "Temporary error, message will be retried", log.Any("err", err),
+					log.String("description", description), log.String("channel", msg.Request.Channel), log.Any("message", msg))
+
+				app.metrics.RequestsRetriedTotal.WithLabelValues(label).Inc()
+
+				if retryCount < maxRetries {
+					retryCount++
+					backoffDuration := initialBackoff * time.Duration(math.Pow(2, float64(retryCount-1)))
+					app.backoff(msg, backoffDuration)
 				} else {
-					log.Debugf("Message sent successfully")
-					app.metrics.RequestsSucceededTotal.WithLabelValues(msg.Channel).Inc()
+					log.S(log.Error, "Message failed after retries", log.Any("err", err), log.Int("retryCount", retryCount))
+					app.metrics.RequestsFailedTotal.WithLabelValues(label).Inc()
 					break
 				}
+			} else {
+				log.Debugf("Message sent successfully")
+				app.metrics.RequestsSucceededTotal.WithLabelValues(label).Inc()
+				app.recordWarnings(label, response)
+				app.recordThread(msg, response)
+				app.posted.Record(msg, response)
+				app.queueFollowUps(msg, response)
+				result = deliveryResult{Outcome: outcomePosted, TS: response.TS, Attempts: retryCount + 1}
+				break
 			}
-
-			// Need to call this to clean up the wg, which is vital for the shutdown to work (so that we
-			// process all the messages in the queue before exiting cleanly)
-			app.wg.Done()
-
-		case <-ctx.Done():
-			return
 		}
+		app.recordOutcome(msg, result)
+		app.shadow.Compare(app, msg, result)
+
+		// Need to call this to clean up the wg, which is vital for the shutdown to work (so that we
+		// process all the messages in the queue before exiting cleanly)
+		app.wg.Done()
 	}
 }
@@ -5,7 +5,10 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 
@@ -17,11 +20,30 @@ type MockSlackMessenger struct {
 	shouldError bool
 }
 
-func (m *MockSlackMessenger) PostMessage(_ SlackPostMessageRequest, _ string, _ string) error {
+func (m *MockSlackMessenger) PostMessage(_ context.Context, _ SlackPostMessageRequest, _ string, _ string) (SlackResponse, error) {
 	if m.shouldError {
-		return errors.New("mock error")
+		return SlackResponse{}, errors.New("mock error")
 	}
-	return nil
+	return SlackResponse{Ok: true}, nil
+}
+
+// RecordingSlackMessenger records the posted requests and answers with increasing ts.
+type RecordingSlackMessenger struct {
+	mu       sync.Mutex
+	requests []SlackPostMessageRequest
+}
+
+func (m *RecordingSlackMessenger) PostMessage(_ context.Context, req SlackPostMessageRequest, _ string, _ string) (SlackResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests = append(m.requests, req)
+	return SlackResponse{Ok: true, Channel: "C123", TS: fmt.Sprintf("1700000000.%06d", len(m.requests))}, nil
+}
+
+func (m *RecordingSlackMessenger) Requests() []SlackPostMessageRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.requests)
 }
 
 func TestApp_singleBurst_Success(t *testing.T) {
@@ -30,7 +52,7 @@ func TestApp_singleBurst_Success(t *testing.T) {
 
 	messenger := &MockSlackMessenger{}
 	app := &App{
-		slackQueue:          make(chan SlackPostMessageRequest, 2),
+		slackQueue:          newMessageQueue(2, false),
 		messenger:           messenger,
 		metrics:             metrics,
 		SlackPostMessageURL: "http://mock.url",
@@ -47,9 +69,9 @@ func TestApp_singleBurst_Success(t *testing.T) {
 	count := 10
 	for range count {
 		app.wg.Add(1)
-		app.slackQueue <- SlackPostMessageRequest{
+		app.slackQueue.Push(&queuedMessage{Request: SlackPostMessageRequest{
 			Channel: "mockChannel",
-		}
+		}})
 	}
 
 	log.S(log.Debug, "Posting messages done")
@@ -74,7 +96,7 @@ func TestApp_MultiBurst_Success(t *testing.T) {
 
 	messenger := &MockSlackMessenger{}
 	app := &App{
-		slackQueue:          make(chan SlackPostMessageRequest, 2),
+		slackQueue:          newMessageQueue(2, false),
 		messenger:           messenger,
 		metrics:             metrics,
 		SlackPostMessageURL: "http://mock.url",
@@ -91,9 +113,9 @@ func TestApp_MultiBurst_Success(t *testing.T) {
 	count := 20
 	for range count {
 		app.wg.Add(1)
-		app.slackQueue <- SlackPostMessageRequest{
+		app.slackQueue.Push(&queuedMessage{Request: SlackPostMessageRequest{
 			Channel: "mockChannel",
-		}
+		}})
 	}
 
 	log.S(log.Debug, "Posting messages done")
@@ -118,7 +140,7 @@ func TestApp_TestSlackRequestRate(t *testing.T) {
 
 	messenger := &MockSlackMessenger{}
 	app := &App{
-		slackQueue:          make(chan SlackPostMessageRequest, 2),
+		slackQueue:          newMessageQueue(2, false),
 		messenger:           messenger,
 		metrics:             metrics,
 		SlackPostMessageURL: "http://mock.url",
@@ -135,9 +157,9 @@ func TestApp_TestSlackRequestRate(t *testing.T) {
 	count := 20
 	for range count {
 		app.wg.Add(1)
-		app.slackQueue <- SlackPostMessageRequest{
+		app.slackQueue.Push(&queuedMessage{Request: SlackPostMessageRequest{
 			Channel: "mockChannel",
-		}
+		}})
 	}
 
 	log.S(log.Debug, "Posting messages done")
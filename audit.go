@@ -0,0 +1,363 @@
+// audit.go
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/jrpc"
+	"fortio.org/log"
+)
+
+// The audit log records, as json lines, the decisions worth keeping track of outside of the regular
+// logs: the lifecycle of every message (received, rejected or denied, queued, each attempt and the final
+// state) to answer "did my alert get sent?" with GET /audit, and the policy denials. The file is
+// rotated once it reaches its maximum size, keeping a few previous files (file.1 being the newest).
+
+const (
+	auditReceived     = "received"
+	auditRejected     = "rejected" // invalid request or queue full
+	auditDenied       = "denied"   // by the channel policy
+	auditDeduplicated = "deduplicated"
+	auditScheduled    = "scheduled"
+	auditQueued       = "queued"
+	auditDigested     = "digested" // final state of the messages merged into a digest
+	auditAttempt      = "attempt"
+	auditFinal        = "final"
+
+	auditCodeOK       = "ok"
+	auditDefaultLimit = 1000
+)
+
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Client    string    `json:"client,omitempty"`
+	Remote    string    `json:"remote,omitempty"`
+	Channel   string    `json:"channel,omitempty"`
+	MessageID string    `json:"message_id,omitempty"`
+	Method    string    `json:"method,omitempty"` // Slack api method, e.g. chat.postMessage
+	Hash      string    `json:"hash,omitempty"`   // of the content, see contentHash
+	Attempt   int       `json:"attempt,omitempty"`
+	Code      string    `json:"code,omitempty"`  // ok or the error
+	State     string    `json:"state,omitempty"` // final outcome, see deliveryResult
+	TS        string    `json:"ts,omitempty"`
+	LatencyMS float64   `json:"latency_ms,omitempty"` // of the attempt, or since received for the final state
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// auditLog is safe for concurrent use, a nil auditLog records nothing.
+type auditLog struct {
+	mu      sync.Mutex
+	w       io.WriteCloser
+	path    string
+	maxSize int64
+	backups int
+	size    int64
+}
+
+// openAuditLog opens the file for appending, rotating it once it reaches maxSize bytes (if > 0).
+func openAuditLog(path string, maxSize int64, backups int) (*auditLog, error) {
+	a := &auditLog{path: path, maxSize: maxSize, backups: backups}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.w = f
+	a.size = info.Size()
+	return nil
+}
+
+// rotate renames file.N-1 to file.N,... file to file.1, dropping the oldest, and opens a new file.
+func (a *auditLog) rotate() error {
+	if err := a.w.Close(); err != nil {
+		return err
+	}
+	for i := a.backups; i > 0; i-- {
+		from := a.path
+		if i > 1 {
+			from = a.path + "." + strconv.Itoa(i-1)
+		}
+		if err := os.Rename(from, a.path+"."+strconv.Itoa(i)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if a.backups == 0 {
+		if err := os.Remove(a.path); err != nil {
+			return err
+		}
+	}
+	return a.open()
+}
+
+// Record appends the entry, errors are logged as there is nothing else the callers could do.
+func (a *auditLog) Record(entry auditEntry) {
+	if a == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		a.mu.Lock()
+		if a.maxSize > 0 && a.size > 0 && a.size+int64(len(data))+1 > a.maxSize {
+			err = a.rotate()
+		}
+		if err == nil {
+			var n int
+			n, err = a.w.Write(append(data, '\n'))
+			a.size += int64(n)
+		}
+		a.mu.Unlock()
+	}
+	if err != nil {
+		log.S(log.Error, "Failed to write the audit log", log.Any("err", err), log.String("event", entry.Event))
+	}
+}
+
+type auditQuery struct {
+	Channel   string
+	Client    string
+	MessageID string
+	Since     time.Time
+	Limit     int
+}
+
+func (q *auditQuery) matches(entry *auditEntry) bool {
+	return (q.Channel == "" || entry.Channel == q.Channel) &&
+		(q.Client == "" || entry.Client == q.Client) &&
+		(q.MessageID == "" || entry.MessageID == q.MessageID) &&
+		!entry.Time.Before(q.Since)
+}
+
+// Query returns the last (up to the limit) matching entries, oldest first, from the rotated files and
+// the current one. Lines that can't be parsed (e.g. being written) are skipped.
+func (a *auditLog) Query(q auditQuery) ([]auditEntry, error) {
+	entries := []auditEntry{}
+	for i := a.backups; i >= 0; i-- {
+		path := a.path
+		if i > 0 {
+			path += "." + strconv.Itoa(i)
+		}
+		f, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var entry auditEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil || !q.matches(&entry) {
+				continue
+			}
+			entries = append(entries, entry)
+			if len(entries) > 2*q.Limit {
+				entries = slices.Delete(entries, 0, len(entries)-q.Limit)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(entries) > q.Limit {
+		entries = entries[len(entries)-q.Limit:]
+	}
+	return entries, nil
+}
+
+// Close closes the file.
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.w.Close()
+}
+
+// messageMethod returns the Slack api method the message is posted with.
+func messageMethod(msg *queuedMessage) string {
+	switch {
+	case msg.reaction != nil && msg.reaction.Remove:
+		return "reactions.remove"
+	case msg.reaction != nil:
+		return "reactions.add"
+	case msg.upload != nil:
+		return "files.upload"
+	default:
+		return "chat.postMessage"
+	}
+}
+
+// auditMessage records an event of the message's lifecycle, adding the message's details to the entry.
+func (app *App) auditMessage(msg *queuedMessage, entry auditEntry) {
+	if app.audit == nil {
+		return
+	}
+	entry.Client = msg.Client
+	entry.Channel = app.channelLabel(msg.Request.Channel)
+	entry.MessageID = msg.ID
+	entry.Method = messageMethod(msg)
+	entry.Hash = contentHash(&msg.Request)
+	app.audit.Record(entry)
+}
+
+// recordOutcome records how the delivery of the message ended, in the tee and the audit log.
+func (app *App) recordOutcome(msg *queuedMessage, result deliveryResult) {
+	app.releaseUpload(msg)
+	if result.Outcome != outcomePosted {
+		forgetDuplicate(msg)
+	}
+	app.tee.Record(msg, result)
+	if msg.digest != nil {
+		// The merged messages already have their final audit entry (see auditMerged), the sinks get each of
+		// them, with the digest's outcome, e.g. for the proxy sinks to replay all the requests.
+		for _, merged := range msg.digest.merged {
+			if result.Outcome != outcomePosted {
+				forgetDuplicate(merged)
+			}
+			app.tee.Record(merged, result)
+		}
+	}
+	code := result.Error
+	if result.Outcome == outcomePosted {
+		code = auditCodeOK
+	}
+	app.auditMessage(msg, auditEntry{
+		Event:     auditFinal,
+		State:     result.Outcome,
+		Code:      code,
+		Attempt:   result.Attempts,
+		TS:        result.TS,
+		LatencyMS: milliseconds(time.Since(msg.Received)),
+	})
+}
+
+// auditMerged records the final state of a message merged into a digest, which is posted instead.
+func (app *App) auditMerged(msg, digest *queuedMessage) {
+	app.auditMessage(msg, auditEntry{
+		Event:     auditFinal,
+		State:     auditDigested,
+		Reason:    "digested into " + digest.ID,
+		LatencyMS: milliseconds(time.Since(msg.Received)),
+	})
+}
+
+// auditRejected records a request, of any ingress path, rejected before being queued. The message id is
+// empty when the request couldn't even be decoded.
+func (app *App) auditRejected(remote, method, client, channel, id, reason string) {
+	app.audit.Record(auditEntry{
+		Event:     auditRejected,
+		Client:    client,
+		Remote:    remote,
+		Channel:   app.channelLabel(channel),
+		MessageID: id,
+		Method:    method,
+		Reason:    reason,
+	})
+}
+
+// auditAttempt records an attempt to post the message and its result code.
+func (app *App) auditAttempt(msg *queuedMessage, attempt int, err error, latency time.Duration) {
+	code := auditCodeOK
+	if err != nil {
+		code = err.Error()
+	}
+	app.auditMessage(msg, auditEntry{Event: auditAttempt, Attempt: attempt, Code: code, LatencyMS: milliseconds(latency)})
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// parseSince accepts a time (RFC 3339) or a duration before now (e.g. 1h).
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid since %q, expected a time (RFC 3339) or a duration", s)
+	}
+	return t, nil
+}
+
+// handleAudit returns (GET /audit?channel=&client=&message_id=&since=&limit=) the matching audit
+// entries. With a channel policy, the authenticated clients other than the admins only get their own
+// entries.
+func (app *App) handleAudit(w http.ResponseWriter, r *http.Request) {
+	client := app.authenticate(r)
+	query := r.URL.Query()
+	q := auditQuery{
+		Channel:   query.Get("channel"),
+		Client:    query.Get("client"),
+		MessageID: query.Get("message_id"),
+		Limit:     auditDefaultLimit,
+	}
+	if q.Channel != "" {
+		q.Channel = app.channelLabel(q.Channel)
+	}
+	var err error
+	q.Since, err = parseSince(query.Get("since"), time.Now())
+	if err == nil && query.Get("limit") != "" {
+		q.Limit, err = strconv.Atoi(query.Get("limit"))
+		if err == nil && q.Limit <= 0 {
+			err = errors.New("limit must be positive")
+		}
+	}
+	if err != nil {
+		reply(w, http.StatusBadRequest, &SlackResponse{Ok: false, Error: err.Error()})
+		return
+	}
+	client, ok := app.ownClient(w, r, client)
+	if !ok {
+		return
+	}
+	if client != "" {
+		if q.Client != "" && q.Client != client {
+			reply(w, http.StatusForbidden, &SlackResponse{Ok: false, Error: "admin access required for other clients' entries"})
+			return
+		}
+		q.Client = client
+	}
+	entries, err := app.audit.Query(q)
+	if err != nil {
+		log.S(log.Error, "Failed to read the audit log", log.Any("err", err))
+		reply(w, http.StatusInternalServerError, &SlackResponse{Ok: false, Error: "failed to read the audit log"})
+		return
+	}
+	if err = jrpc.Reply(w, http.StatusOK, &entries); err != nil {
+		log.S(log.Error, "Failed to write response", log.Any("err", err))
+	}
+}
@@ -0,0 +1,186 @@
+// audit_test.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// FlakySlackMessenger fails the first attempts with a retryable error, then records the requests.
+type FlakySlackMessenger struct {
+	RecordingSlackMessenger
+	mu       sync.Mutex
+	failures int
+}
+
+func (m *FlakySlackMessenger) PostMessage(ctx context.Context, req SlackPostMessageRequest, url, token string) (SlackResponse, error) {
+	m.mu.Lock()
+	fail := m.failures > 0
+	m.failures--
+	m.mu.Unlock()
+	if fail {
+		return SlackResponse{Ok: false, Error: "ratelimited"}, errors.New("ratelimited")
+	}
+	return m.RecordingSlackMessenger.PostMessage(ctx, req, url, token)
+}
+
+func queryAudit(t *testing.T, app *App, query, token string) (int, []auditEntry) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/audit?"+query, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	app.handleAudit(w, req)
+	var entries []auditEntry
+	if w.Code == http.StatusOK {
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	}
+	return w.Code, entries
+}
+
+func TestAudit_Lifecycle(t *testing.T) {
+	app, _ := newPolicyTestApp(t)
+	app.messenger = &FlakySlackMessenger{failures: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.processQueue(ctx, 2, time.Millisecond, 10, time.Millisecond)
+	post := func(token, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		app.handleRequest(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, post("ci-secret", `{"channel":"#builds","text":"build ok"}`))
+	app.wg.Wait()
+	assert.Equal(t, http.StatusBadRequest, post("ci-secret", `{"channel":"#builds"}`))
+	assert.Equal(t, http.StatusOK, post("ops-secret", `{"channel":"#ops","text":"hi"}`))
+	app.wg.Wait()
+
+	status, entries := queryAudit(t, app, "channel=%23builds", "ci-secret")
+	assert.Equal(t, http.StatusOK, status)
+	var events []string
+	for _, e := range entries {
+		events = append(events, e.Event+" "+e.Code)
+		assert.Equal(t, "ci", e.Client)
+		assert.Equal(t, "chat.postMessage", e.Method)
+	}
+	assert.Equal(t, []string{
+		"received ", "queued ", "attempt ratelimited", "attempt ok", "final ok", "received ", "rejected ",
+	}, events)
+	assert.Equal(t, 2, entries[3].Attempt)
+	final := entries[4]
+	assert.Equal(t, outcomePosted, final.State)
+	assert.Equal(t, 2, final.Attempt)
+	assert.Equal(t, "1700000000.000001", final.TS)
+	assert.True(t, final.LatencyMS > 0, "latency")
+	assert.Equal(t, contentHash(&SlackPostMessageRequest{Channel: "#builds", Text: "build ok"}), final.Hash)
+	assert.Equal(t, "Neither attachments, blocks, nor text is set", entries[6].Reason)
+
+	// Only the admins (none in the test policy) get the other clients' entries.
+	_, entries = queryAudit(t, app, "", "ci-secret")
+	assert.Equal(t, 7, len(entries))
+	status, _ = queryAudit(t, app, "client=ops", "ci-secret")
+	assert.Equal(t, http.StatusForbidden, status)
+	_, entries = queryAudit(t, app, "client=ops&limit=2", "ops-secret")
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, auditFinal, entries[1].Event)
+	_, entries = queryAudit(t, app, "since="+neturl.QueryEscape(time.Now().Add(time.Minute).Format(time.RFC3339)), "ops-secret")
+	assert.Equal(t, 0, len(entries))
+	status, _ = queryAudit(t, app, "since=yesterday", "ops-secret")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestAuditLog_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := openAuditLog(path, 300, 2)
+	assert.NoError(t, err)
+	for i := range 10 {
+		audit.Record(auditEntry{Event: auditQueued, MessageID: strconv.Itoa(i), Reason: "some padding to rotate sooner"})
+	}
+	for _, suffix := range []string{"", ".1", ".2"} {
+		info, err := os.Stat(path + suffix)
+		assert.NoError(t, err)
+		assert.True(t, info.Size() <= 300, "rotated at the max size")
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "only 2 backups kept")
+
+	entries, err := audit.Query(auditQuery{Limit: 100})
+	assert.NoError(t, err)
+	assert.True(t, len(entries) < 10, "the oldest entries are dropped")
+	for i, e := range entries {
+		assert.Equal(t, strconv.Itoa(10-len(entries)+i), e.MessageID, "oldest first")
+	}
+	entries, err = audit.Query(auditQuery{MessageID: "9", Limit: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.NoError(t, audit.Close())
+}
+
+func TestAudit_OtherIngressPaths(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := openAuditLog(path, 0, 0)
+	assert.NoError(t, err)
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		audit:      audit,
+		digests:    newDigester(1),
+	}
+	s := &syslogIngress{config: syslogConfig{DefaultChannel: "#syslog"}}
+	s.handle(app, "192.0.2.1:514", []byte("<34>1 2026-10-18T12:00:00Z host app - - - first"))
+	s.handle(app, "192.0.2.1:514", []byte("not syslog"))
+	for app.slackQueue.Len() < 9 {
+		app.slackQueue.Push(newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Text: "fill"}, ""))
+	}
+	s.handle(app, "192.0.2.1:514", []byte("<34>1 2026-10-18T12:00:00Z host app - - - full"))
+
+	entries, err := audit.Query(auditQuery{Limit: 100})
+	assert.NoError(t, err)
+	var events []string
+	for _, e := range entries {
+		events = append(events, e.Event)
+		assert.Equal(t, syslogClient, e.Client)
+		if e.Event != auditQueued {
+			assert.Equal(t, "192.0.2.1:514", e.Remote)
+		}
+	}
+	// The routed copies are checked against the room left in the queue once received.
+	assert.Equal(t, []string{auditReceived, auditQueued, auditRejected, auditReceived, auditRejected}, events)
+	assert.Equal(t, "syslog message doesn't start with a <priority>", entries[2].Reason)
+	assert.Equal(t, "Queue is almost full", entries[4].Reason)
+	assert.Equal(t, "#syslog", entries[4].Channel)
+	assert.Equal(t, entries[3].MessageID, entries[4].MessageID)
+
+	// The messages merged into a digest end there.
+	for app.slackQueue.Len() > 0 {
+		app.slackQueue.next()
+	}
+	first := newQueuedMessage(SlackPostMessageRequest{Channel: "#storm", Text: "a"}, "")
+	digest := newQueuedMessage(SlackPostMessageRequest{Channel: "#storm", Text: "b"}, "")
+	merged := newQueuedMessage(SlackPostMessageRequest{Channel: "#storm", Text: "c"}, "")
+	for _, msg := range []*queuedMessage{first, digest, merged} {
+		assert.NoError(t, app.enqueue(msg))
+	}
+	entries, err = audit.Query(auditQuery{MessageID: merged.ID, Limit: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, auditFinal, entries[0].Event)
+	assert.Equal(t, auditDigested, entries[0].State)
+	assert.Equal(t, "digested into "+digest.ID, entries[0].Reason)
+}
@@ -0,0 +1,155 @@
+// backends.go
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Besides the Slack workspace of the proxy, messages can go to other backends: another Slack workspace,
+// Mattermost, Discord or Microsoft Teams. A backend is picked by prefixing the channel with its name,
+// e.g. "discord:alerts", either by the caller or by the routing rules and aliases, so the same request
+// can be fanned out to several chat tools.
+
+const (
+	backendSlack      = "slack"
+	backendMattermost = "mattermost"
+	backendDiscord    = "discord"
+	backendTeams      = "teams"
+)
+
+// backendConfig is an entry of the backends json file, keyed by the backend name.
+type backendConfig struct {
+	Type string `json:"type"` // slack, mattermost, discord or teams
+	// URL is the chat.postMessage url for slack, the (default) incoming webhook url otherwise.
+	URL string `json:"url,omitempty"`
+	// Webhooks are per channel incoming webhook urls, for the tools where a webhook posts to a single
+	// channel (discord, teams).
+	Webhooks map[string]string `json:"webhooks,omitempty"`
+	// TokenEnv is the environment variable with the token of a slack backend.
+	TokenEnv string `json:"token_env,omitempty"`
+}
+
+type backend struct {
+	name      string
+	messenger SlackMessenger
+	config    backendConfig
+	token     string
+}
+
+// url returns where to post the messages for the channel, empty if the backend can't post there.
+func (b *backend) url(channel string) string {
+	if webhook := b.config.Webhooks[strings.TrimPrefix(channel, "#")]; webhook != "" {
+		return webhook
+	}
+	return b.config.URL
+}
+
+// backendSet maps the backend names to the backends, nil when there are none.
+type backendSet map[string]*backend
+
+// loadBackends reads the backends json file, the slack backends default to slackURL.
+func loadBackends(configPath string, client *http.Client, slackURL string) (backendSet, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var configs map[string]backendConfig
+	if err = json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	backends := make(backendSet, len(configs))
+	var errs []error
+	for _, name := range names {
+		b, err := newBackend(name, configs[name], client, slackURL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("backend %q: %w", name, err))
+			continue
+		}
+		backends[name] = b
+	}
+	return backends, errors.Join(errs...)
+}
+
+func newBackend(name string, config backendConfig, client *http.Client, slackURL string) (*backend, error) {
+	if name == "" || strings.ContainsAny(name, ":#@ ") {
+		return nil, errors.New("invalid name")
+	}
+	b := &backend{name: name, config: config}
+	switch config.Type {
+	case backendSlack:
+		if b.config.URL == "" {
+			b.config.URL = slackURL
+		}
+		if config.TokenEnv == "" {
+			return nil, errors.New("token_env is not set")
+		}
+		b.token = os.Getenv(config.TokenEnv)
+		if b.token == "" {
+			return nil, fmt.Errorf("%s is not set", config.TokenEnv)
+		}
+		b.messenger = &SlackClient{client: client}
+		return b, nil
+	case backendMattermost:
+		b.messenger = &MattermostClient{client: client}
+	case backendDiscord:
+		b.messenger = &DiscordClient{client: client}
+	case backendTeams:
+		b.messenger = &TeamsClient{client: client}
+	default:
+		return nil, fmt.Errorf("unknown type %q, expected %s, %s, %s or %s", config.Type,
+			backendSlack, backendMattermost, backendDiscord, backendTeams)
+	}
+	if config.URL == "" && len(config.Webhooks) == 0 {
+		return nil, errors.New("neither url nor webhooks is set")
+	}
+	return b, nil
+}
+
+// lookup returns the backend of the channel and the channel within that backend, nil and the channel as
+// is for the proxy's own Slack workspace.
+func (s backendSet) lookup(channel string) (*backend, string) {
+	name, rest, found := strings.Cut(channel, ":")
+	if !found {
+		return nil, channel
+	}
+	b := s[name]
+	if b == nil {
+		return nil, channel
+	}
+	return b, rest
+}
+
+// destination returns the messenger, url and token to send the request with, and the request with the
+// channel within the backend.
+func (app *App) destination(request SlackPostMessageRequest) (SlackMessenger, string, string, SlackPostMessageRequest) {
+	b, channel := app.backends.lookup(request.Channel)
+	if b == nil {
+		return app.messenger, app.SlackPostMessageURL, app.SlackToken, request
+	}
+	request.Channel = channel
+	return b.messenger, b.url(channel), b.token, request
+}
+
+// validateBackend checks a channel of one of the backends can be posted to.
+func (app *App) validateBackend(channel string) (bool, error) {
+	b, rest := app.backends.lookup(channel)
+	if b == nil {
+		return false, nil
+	}
+	if rest == "" || b.url(rest) == "" {
+		return true, fmt.Errorf("no webhook for channel %s of backend %s", rest, b.name)
+	}
+	return true, nil
+}
@@ -0,0 +1,108 @@
+// backends_test.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func writeBackends(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "backends.json")
+	assert.NoError(t, os.WriteFile(path, []byte(config), 0o600))
+	return path
+}
+
+func TestLoadBackends(t *testing.T) {
+	t.Setenv("OTHER_SLACK_TOKEN", "xoxb-other")
+	backends, err := loadBackends(writeBackends(t, `{
+		"other": {"type": "slack", "token_env": "OTHER_SLACK_TOKEN"},
+		"mm": {"type": "mattermost", "url": "https://mm.example.com/hooks/x"},
+		"discord": {"type": "discord", "webhooks": {"alerts": "https://discord.example.com/1"}}
+	}`), http.DefaultClient, "https://slack.com/api/chat.postMessage")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(backends))
+	assert.Equal(t, "xoxb-other", backends["other"].token)
+	assert.Equal(t, "https://slack.com/api/chat.postMessage", backends["other"].url("C123"))
+
+	b, channel := backends.lookup("discord:#alerts")
+	assert.Equal(t, "discord", b.name)
+	assert.Equal(t, "#alerts", channel)
+	assert.Equal(t, "https://discord.example.com/1", b.url(channel))
+	assert.Equal(t, "", b.url("random"))
+	b, channel = backends.lookup("team:payments")
+	assert.True(t, b == nil)
+	assert.Equal(t, "team:payments", channel)
+
+	_, err = loadBackends(writeBackends(t, `{
+		"a": {"type": "irc", "url": "x"},
+		"b": {"type": "teams"},
+		"c": {"type": "slack", "token_env": "NOT_SET_FOR_SURE"},
+		"d:e": {"type": "teams", "url": "x"}
+	}`), http.DefaultClient, "")
+	assert.Error(t, err)
+	assert.Equal(t, `backend "a": unknown type "irc", expected slack, mattermost, discord or teams`+"\n"+
+		`backend "b": neither url nor webhooks is set`+"\n"+
+		`backend "c": NOT_SET_FOR_SURE is not set`+"\n"+
+		`backend "d:e": invalid name`, err.Error())
+}
+
+func TestBackends_Send(t *testing.T) {
+	var discord map[string]any
+	discordServer := captureWebhook(t, http.StatusNoContent, &discord)
+	var slackRequest SlackPostMessageRequest
+	var slackToken string
+	slackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slackToken = r.Header.Get("Authorization")
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&slackRequest))
+		_, _ = w.Write([]byte(`{"ok":true,"channel":"C999","ts":"1700000000.000009"}`))
+	}))
+	defer slackServer.Close()
+
+	messenger := &RecordingSlackMessenger{}
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		messenger:  messenger,
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		posted:     newPostedStore(time.Hour),
+		backends: backendSet{
+			"discord": {name: "discord", messenger: &DiscordClient{client: discordServer.Client()},
+				config: backendConfig{Type: backendDiscord, Webhooks: map[string]string{"alerts": discordServer.URL}}},
+			"other": {name: "other", messenger: &SlackClient{client: slackServer.Client()}, token: "xoxb-other",
+				config: backendConfig{Type: backendSlack, URL: slackServer.URL}},
+		},
+	}
+	assert.NoError(t, app.validateCopies([]*queuedMessage{{Request: SlackPostMessageRequest{Channel: "discord:#alerts", Text: "x"}}}))
+	err := app.validateCopies([]*queuedMessage{{Request: SlackPostMessageRequest{Channel: "discord:#random", Text: "x"}}})
+	assert.Error(t, err)
+	assert.Equal(t, "no webhook for channel #random of backend discord", err.Error())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.processQueue(ctx, 0, time.Millisecond, 10, time.Millisecond)
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "discord:#alerts", Text: "to *discord*"}, "")))
+	other := newQueuedMessage(SlackPostMessageRequest{Channel: "other:#general", Text: "to the other workspace"}, "")
+	assert.NoError(t, app.enqueue(other))
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#local", Text: "to the proxy's workspace"}, "")))
+	app.wg.Wait()
+
+	assert.Equal(t, "to **discord**", discord["content"])
+	assert.Equal(t, "#general", slackRequest.Channel)
+	assert.Equal(t, "Bearer xoxb-other", slackToken)
+	entry, found := app.posted.Message(other.ID)
+	assert.True(t, found)
+	assert.Equal(t, "other:C999", entry.Channel, "the backend is kept for reactions")
+	requests := messenger.Requests()
+	assert.Equal(t, 1, len(requests))
+	assert.Equal(t, "#local", requests[0].Channel)
+}
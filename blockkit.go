@@ -0,0 +1,358 @@
+// blockkit.go
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Structural validation of the blocks and attachments, so a malformed request gets a 400 pointing at the
+// problem right away instead of an invalid_blocks error from Slack, minutes after the caller got ok:true.
+// This checks the block types, their required fields and Slack's documented size limits, not everything
+// Slack would (e.g. the ids of the users or channels mentioned).
+
+const (
+	maxBlocks        = 50
+	maxAttachments   = 100
+	maxBlockText     = 3000
+	maxHeaderText    = 150
+	maxMarkdownText  = 12000
+	maxFieldText     = 2000
+	maxSectionFields = 10
+	maxContextItems  = 10
+	maxActions       = 25
+	maxBlockID       = 255
+	maxButtonText    = 75
+	maxURL           = 3000
+)
+
+// blockError locates the problem with a json path, e.g. blocks[3].text.text.
+type blockError struct {
+	path string
+	msg  string
+}
+
+func (e *blockError) Error() string {
+	return e.path + ": " + e.msg
+}
+
+func blockErrorf(path, format string, args ...any) error {
+	return &blockError{path: path, msg: fmt.Sprintf(format, args...)}
+}
+
+// decodeBlockKit replaces the blocks and attachments sent as a json string (like the form encoded Slack
+// api calls do, e.g. "blocks": "[...]") by the json they hold, leaving the invalid ones as is.
+func decodeBlockKit(request *SlackPostMessageRequest) error {
+	for _, field := range []struct {
+		path  string
+		value *json.RawMessage
+	}{{"blocks", &request.Blocks}, {"attachments", &request.Attachments}} {
+		if len(*field.value) == 0 || (*field.value)[0] != '"' {
+			continue
+		}
+		var encoded string
+		if err := json.Unmarshal(*field.value, &encoded); err != nil {
+			return blockErrorf(field.path, "invalid json: %v", err)
+		}
+		*field.value = json.RawMessage(encoded)
+	}
+	return nil
+}
+
+// validateBlockKit checks the blocks and attachments of the request (when set), decoding them first if
+// they are strings (see decodeBlockKit). More than maxBlocks blocks are accepted if chunked is true (see
+// splitMessage).
+func validateBlockKit(request *SlackPostMessageRequest, chunked bool) error {
+	if err := decodeBlockKit(request); err != nil {
+		return err
+	}
+	if len(request.Blocks) > 0 {
+		var blocks any
+		if err := json.Unmarshal(request.Blocks, &blocks); err != nil {
+			return blockErrorf("blocks", "invalid json: %v", err)
+		}
+		limit := maxBlocks
+		if chunked {
+			limit = 0
+		}
+		if err := checkBlocks("blocks", blocks, limit); err != nil {
+			return err
+		}
+	}
+	if len(request.Attachments) > 0 {
+		var attachments any
+		if err := json.Unmarshal(request.Attachments, &attachments); err != nil {
+			return blockErrorf("attachments", "invalid json: %v", err)
+		}
+		return checkAttachments("attachments", attachments)
+	}
+	return nil
+}
+
+// checkBlocks checks the blocks array, which must have at most limit blocks (0 for no limit).
+func checkBlocks(path string, value any, limit int) error {
+	if value == nil {
+		return nil
+	}
+	blocks, ok := value.([]any)
+	if !ok {
+		return blockErrorf(path, "must be an array")
+	}
+	if limit > 0 && len(blocks) > limit {
+		return blockErrorf(path, "must have at most %d blocks, got %d", limit, len(blocks))
+	}
+	for i, block := range blocks {
+		if err := checkBlock(fmt.Sprintf("%s[%d]", path, i), block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkAttachments(path string, value any) error {
+	if value == nil {
+		return nil
+	}
+	attachments, ok := value.([]any)
+	if !ok {
+		return blockErrorf(path, "must be an array")
+	}
+	if len(attachments) > maxAttachments {
+		return blockErrorf(path, "must have at most %d attachments, got %d", maxAttachments, len(attachments))
+	}
+	for i, value := range attachments {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		attachment, ok := value.(map[string]any)
+		if !ok {
+			return blockErrorf(itemPath, "must be an object")
+		}
+		for _, key := range []string{"color", "fallback", "pretext", "title", "title_link", "text", "footer"} {
+			if err := checkString(itemPath+"."+key, attachment[key], false, 0); err != nil {
+				return err
+			}
+		}
+		if err := checkBlocks(itemPath+".blocks", attachment["blocks"], maxBlocks); err != nil {
+			return err
+		}
+		if fields, found := attachment["fields"]; found {
+			list, ok := fields.([]any)
+			if !ok {
+				return blockErrorf(itemPath+".fields", "must be an array")
+			}
+			for j, field := range list {
+				if _, ok := field.(map[string]any); !ok {
+					return blockErrorf(fmt.Sprintf("%s.fields[%d]", itemPath, j), "must be an object")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkString checks the value, when set or required, is a string of at most maxLen characters (0 for no
+// limit).
+func checkString(path string, value any, required bool, maxLen int) error {
+	if value == nil {
+		if required {
+			return blockErrorf(path, "is required")
+		}
+		return nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return blockErrorf(path, "must be a string")
+	}
+	if required && s == "" {
+		return blockErrorf(path, "must not be empty")
+	}
+	if n := utf8.RuneCountInString(s); maxLen > 0 && n > maxLen {
+		return blockErrorf(path, "must be at most %d characters, got %d", maxLen, n)
+	}
+	return nil
+}
+
+// checkText checks a text object, plain_text only if plainOnly is true.
+func checkText(path string, value any, required, plainOnly bool, maxLen int) error {
+	if value == nil {
+		if required {
+			return blockErrorf(path, "is required")
+		}
+		return nil
+	}
+	text, ok := value.(map[string]any)
+	if !ok {
+		return blockErrorf(path, "must be a text object")
+	}
+	switch text["type"] {
+	case "plain_text":
+	case "mrkdwn":
+		if plainOnly {
+			return blockErrorf(path+".type", "must be plain_text")
+		}
+	default:
+		return blockErrorf(path+".type", "must be plain_text or mrkdwn, got %v", text["type"])
+	}
+	return checkString(path+".text", text["text"], true, maxLen)
+}
+
+// checkArray returns the elements of the array at path, which must have between 1 and maxLen elements.
+func checkArray(path string, value any, maxLen int) ([]any, error) {
+	if value == nil {
+		return nil, blockErrorf(path, "is required")
+	}
+	list, ok := value.([]any)
+	if !ok {
+		return nil, blockErrorf(path, "must be an array")
+	}
+	if len(list) == 0 {
+		return nil, blockErrorf(path, "must not be empty")
+	}
+	if maxLen > 0 && len(list) > maxLen {
+		return nil, blockErrorf(path, "must have at most %d elements, got %d", maxLen, len(list))
+	}
+	return list, nil
+}
+
+func checkBlock(path string, value any) error {
+	block, ok := value.(map[string]any)
+	if !ok {
+		return blockErrorf(path, "must be an object")
+	}
+	if err := checkString(path+".block_id", block["block_id"], false, maxBlockID); err != nil {
+		return err
+	}
+	switch block["type"] {
+	case "section":
+		return checkSection(path, block)
+	case "divider":
+		return nil
+	case "header":
+		return checkText(path+".text", block["text"], true, true, maxHeaderText)
+	case "markdown":
+		return checkString(path+".text", block["text"], true, maxMarkdownText)
+	case "image":
+		return checkImage(path, block, true)
+	case "context":
+		items, err := checkArray(path+".elements", block["elements"], maxContextItems)
+		for i, item := range items {
+			itemPath := fmt.Sprintf("%s.elements[%d]", path, i)
+			if element, ok := item.(map[string]any); ok && element["type"] == "image" {
+				err = checkImage(itemPath, element, false)
+			} else {
+				err = checkText(itemPath, item, true, false, maxBlockText)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return err
+	case "actions":
+		elements, err := checkArray(path+".elements", block["elements"], maxActions)
+		for i, element := range elements {
+			if err = checkElement(fmt.Sprintf("%s.elements[%d]", path, i), element); err != nil {
+				return err
+			}
+		}
+		return err
+	case "input":
+		if err := checkText(path+".label", block["label"], true, true, maxFieldText); err != nil {
+			return err
+		}
+		return checkElement(path+".element", block["element"])
+	case "file":
+		if err := checkString(path+".external_id", block["external_id"], true, 0); err != nil {
+			return err
+		}
+		return checkString(path+".source", block["source"], true, 0)
+	case "rich_text":
+		_, err := checkArray(path+".elements", block["elements"], 0)
+		return err
+	case "video":
+		for _, key := range []string{"title", "video_url", "thumbnail_url", "alt_text"} {
+			var err error
+			if key == "title" {
+				err = checkText(path+".title", block["title"], true, true, 200)
+			} else {
+				err = checkString(path+"."+key, block[key], true, 0)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case nil:
+		return blockErrorf(path+".type", "is required")
+	default:
+		return blockErrorf(path+".type", "unknown block type %v", block["type"])
+	}
+}
+
+func checkSection(path string, block map[string]any) error {
+	if block["text"] == nil && block["fields"] == nil {
+		return blockErrorf(path, "section needs text or fields")
+	}
+	if err := checkText(path+".text", block["text"], false, false, maxBlockText); err != nil {
+		return err
+	}
+	if block["fields"] != nil {
+		fields, err := checkArray(path+".fields", block["fields"], maxSectionFields)
+		if err != nil {
+			return err
+		}
+		for i, field := range fields {
+			if err = checkText(fmt.Sprintf("%s.fields[%d]", path, i), field, true, false, maxFieldText); err != nil {
+				return err
+			}
+		}
+	}
+	if block["accessory"] != nil {
+		return checkElement(path+".accessory", block["accessory"])
+	}
+	return nil
+}
+
+// checkImage checks an image block or, if not isBlock, an image element.
+func checkImage(path string, image map[string]any, isBlock bool) error {
+	if image["image_url"] == nil && image["slack_file"] == nil {
+		return blockErrorf(path, "image needs image_url or slack_file")
+	}
+	if err := checkString(path+".image_url", image["image_url"], false, maxURL); err != nil {
+		return err
+	}
+	if err := checkString(path+".alt_text", image["alt_text"], true, maxFieldText); err != nil {
+		return err
+	}
+	if isBlock {
+		return checkText(path+".title", image["title"], false, true, maxFieldText)
+	}
+	return nil
+}
+
+// checkElement checks an interactive (or image) element, only the type for the ones not listed.
+func checkElement(path string, value any) error {
+	element, ok := value.(map[string]any)
+	if !ok {
+		return blockErrorf(path, "must be an object")
+	}
+	switch element["type"] {
+	case nil:
+		return blockErrorf(path+".type", "is required")
+	case "button":
+		if err := checkText(path+".text", element["text"], true, true, maxButtonText); err != nil {
+			return err
+		}
+		if err := checkString(path+".action_id", element["action_id"], false, maxBlockID); err != nil {
+			return err
+		}
+		return checkString(path+".url", element["url"], false, maxURL)
+	case "image":
+		return checkImage(path, element, false)
+	default:
+		if _, ok := element["type"].(string); !ok {
+			return blockErrorf(path+".type", "must be a string")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,111 @@
+// blockkit_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestValidateBlockKit(t *testing.T) {
+	long := strings.Repeat("a", 3001)
+	many := "[" + strings.Repeat(`{"type":"divider"},`, 50) + `{"type":"divider"}]`
+	manyAttachments := "[" + strings.Repeat(`{"text":"x"},`, 100) + `{"text":"x"}]`
+	tests := []struct {
+		name, blocks, attachments, wantErr string
+	}{
+		{name: "empty"},
+		{name: "valid", blocks: `[
+			{"type":"header","text":{"type":"plain_text","text":"Deploy"}},
+			{"type":"section","text":{"type":"mrkdwn","text":"*api* v2"},
+			 "accessory":{"type":"button","text":{"type":"plain_text","text":"Open"},"url":"https://example.com"}},
+			{"type":"section","fields":[{"type":"mrkdwn","text":"a"},{"type":"plain_text","text":"b"}]},
+			{"type":"divider"},
+			{"type":"context","elements":[{"type":"mrkdwn","text":"by ci"},{"type":"image","image_url":"https://x/i.png","alt_text":"ci"}]},
+			{"type":"image","image_url":"https://x/graph.png","alt_text":"graph"},
+			{"type":"actions","elements":[{"type":"static_select","action_id":"pick"}]}
+		]`},
+		{name: "valid attachments", attachments: `[{"color":"#36a64f","text":"ok","fields":[{"title":"a","value":"b"}],
+			"blocks":[{"type":"section","text":{"type":"mrkdwn","text":"nested"}}]}]`},
+		{name: "not json", blocks: `[{`, wantErr: "blocks: invalid json: unexpected end of JSON input"},
+		{name: "not an array", blocks: `{"type":"divider"}`, wantErr: "blocks: must be an array"},
+		{name: "too many", blocks: many, wantErr: "blocks: must have at most 50 blocks, got 51"},
+		{name: "no type", blocks: `[{"text":"x"}]`, wantErr: "blocks[0].type: is required"},
+		{name: "unknown type", blocks: `[{"type":"divider"},{"type":"banner"}]`, wantErr: "blocks[1].type: unknown block type banner"},
+		{
+			name: "text too long", blocks: `[{"type":"divider"},{"type":"section","text":{"type":"mrkdwn","text":"` + long + `"}}]`,
+			wantErr: "blocks[1].text.text: must be at most 3000 characters, got 3001",
+		},
+		{
+			name: "header mrkdwn", blocks: `[{"type":"header","text":{"type":"mrkdwn","text":"x"}}]`,
+			wantErr: "blocks[0].text.type: must be plain_text",
+		},
+		{name: "section empty", blocks: `[{"type":"section"}]`, wantErr: "blocks[0]: section needs text or fields"},
+		{
+			name: "field text missing", blocks: `[{"type":"section","fields":[{"type":"mrkdwn","text":"a"},{"type":"mrkdwn"}]}]`,
+			wantErr: "blocks[0].fields[1].text: is required",
+		},
+		{name: "image alt", blocks: `[{"type":"image","image_url":"https://x"}]`, wantErr: "blocks[0].alt_text: is required"},
+		{name: "context empty", blocks: `[{"type":"context","elements":[]}]`, wantErr: "blocks[0].elements: must not be empty"},
+		{
+			name: "button text", blocks: `[{"type":"actions","elements":[{"type":"button","text":{"type":"plain_text","text":"` +
+				strings.Repeat("b", 76) + `"}}]}]`,
+			wantErr: "blocks[0].elements[0].text.text: must be at most 75 characters, got 76",
+		},
+		{name: "string encoded", blocks: `"[{\"type\":\"divider\"}]"`},
+		{name: "string encoded invalid", blocks: `"[{\"type\":\"header\"}]"`, wantErr: "blocks[0].text: is required"},
+		{name: "string encoded attachments", attachments: `"[{\"text\":3}]"`, wantErr: "attachments[0].text: must be a string"},
+		{name: "too many attachments", attachments: manyAttachments, wantErr: "attachments: must have at most 100 attachments, got 101"},
+		{name: "attachment text", attachments: `[{"text":3}]`, wantErr: "attachments[0].text: must be a string"},
+		{
+			name: "attachment blocks", attachments: `[{"text":"x"},{"blocks":[{"type":"header"}]}]`,
+			wantErr: "attachments[1].blocks[0].text: is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := SlackPostMessageRequest{Blocks: json.RawMessage(tt.blocks), Attachments: json.RawMessage(tt.attachments)}
+			err := validateBlockKit(&request, false)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Error(t, err)
+			assert.Equal(t, tt.wantErr, err.Error())
+		})
+	}
+}
+
+func TestHandleRequest_InvalidBlocks(t *testing.T) {
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+	}
+	body := `{"channel":"#c","blocks":[{"type":"section","text":{"type":"plain_txt","text":"x"}}]}`
+	rr := httptest.NewRecorder()
+	app.handleRequest(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	var response SlackResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.Equal(t, "Invalid Block Kit: blocks[0].text.type: must be plain_text or mrkdwn, got plain_txt", response.Error)
+	assert.Equal(t, 0, app.slackQueue.Len())
+}
+
+func TestHandleRequest_StringEncodedBlocks(t *testing.T) {
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+	}
+	body := `{"channel":"#c","blocks":"[{\"type\":\"section\",\"text\":{\"type\":\"mrkdwn\",\"text\":\"x\"}}]"}`
+	rr := httptest.NewRecorder()
+	app.handleRequest(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `[{"type":"section","text":{"type":"mrkdwn","text":"x"}}]`, string(app.slackQueue.next().Request.Blocks))
+}
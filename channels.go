@@ -0,0 +1,249 @@
+// channels.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+)
+
+// Callers use "#channel-name" which breaks on renames (channel_not_found) and splits the metrics
+// between names and ids. The channel directory resolves names to ids using conversations.list so
+// requests are normalized to ids and metrics are labeled with the canonical (current) name.
+
+// Channel, group and direct message conversation ids as well as user ids (for DMs).
+var slackIDRegexp = regexp.MustCompile(`^[CGDUW][A-Z0-9]{8,}$`)
+
+const (
+	conversationsListPageSize = 1000
+	conversationsListMaxWait  = time.Minute
+)
+
+type conversationsListResponse struct {
+	SlackResponse
+	Channels []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"channels"`
+	ResponseMetadata struct {
+		NextCursor string `json:"next_cursor"`
+	} `json:"response_metadata"`
+}
+
+// channelDirectoryCache is what is persisted in the cache file.
+type channelDirectoryCache struct {
+	Updated  time.Time         `json:"updated"`
+	Channels map[string]string `json:"channels"` // name to id
+}
+
+// channelDirectory is safe for concurrent use. Until the first successful load, every channel is
+// considered valid.
+type channelDirectory struct {
+	client    *http.Client
+	url       string // conversations.list url
+	token     string
+	cachePath string
+	mu        sync.RWMutex
+	byName    map[string]string
+	byID      map[string]string
+	loaded    bool
+}
+
+func newChannelDirectory(client *http.Client, listURL, token, cachePath string) *channelDirectory {
+	return &channelDirectory{
+		client:    client,
+		url:       listURL,
+		token:     token,
+		cachePath: cachePath,
+	}
+}
+
+func (d *channelDirectory) set(byName map[string]string) {
+	byID := make(map[string]string, len(byName))
+	for name, id := range byName {
+		byID[id] = name
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.byName = byName
+	d.byID = byID
+	d.loaded = true
+}
+
+// Resolve returns the id and canonical "#name" of the channel (given as "#name", "name" or id) and
+// whether it is known.
+func (d *channelDirectory) Resolve(channel string) (string, string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if name, found := d.byID[channel]; found {
+		return channel, "#" + name, true
+	}
+	if id, found := d.byName[strings.TrimPrefix(channel, "#")]; found {
+		return id, "#" + strings.TrimPrefix(channel, "#"), true
+	}
+	return channel, channel, false
+}
+
+// Exists returns false only for channel names we are sure don't exist (or the bot can't see). Ids are
+// always accepted as private conversations and DMs aren't listed.
+func (d *channelDirectory) Exists(channel string) bool {
+	if d == nil || slackIDRegexp.MatchString(channel) || strings.HasPrefix(channel, "@") {
+		return true
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if !d.loaded {
+		return true
+	}
+	_, found := d.byName[strings.TrimPrefix(channel, "#")]
+	return found
+}
+
+// Refresh lists all the (non archived) channels the token can see.
+func (d *channelDirectory) Refresh(ctx context.Context) error {
+	byName := make(map[string]string)
+	cursor := ""
+	for {
+		page, err := d.listPage(ctx, cursor)
+		if err != nil {
+			return err
+		}
+		for _, c := range page.Channels {
+			byName[c.Name] = c.ID
+		}
+		cursor = page.ResponseMetadata.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+	d.set(byName)
+	log.S(log.Info, "Channel directory refreshed", log.Int("channels", len(byName)))
+	return d.save(byName)
+}
+
+// listPage fetches one page, waiting and retrying when rate limited (the method is only Tier 2).
+func (d *channelDirectory) listPage(ctx context.Context, cursor string) (*conversationsListResponse, error) {
+	query := url.Values{}
+	query.Set("types", "public_channel,private_channel")
+	query.Set("exclude_archived", "true")
+	query.Set("limit", strconv.Itoa(conversationsListPageSize))
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+d.token)
+		resp, err := d.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			resp.Body.Close()
+			wait, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			delay := min(time.Duration(max(wait, 1))*time.Second, conversationsListMaxWait)
+			log.S(log.Warning, "conversations.list rate limited, waiting", log.Any("delay", delay))
+			select {
+			case <-time.After(delay):
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		var page conversationsListResponse
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if !page.Ok {
+			return nil, fmt.Errorf("conversations.list: %s", page.Error)
+		}
+		return &page, nil
+	}
+}
+
+// LoadCache reads the cache file, if any, so channels resolve before the first refresh completes.
+func (d *channelDirectory) LoadCache() error {
+	if d.cachePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(d.cachePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var cache channelDirectoryCache
+	if err = json.Unmarshal(data, &cache); err != nil {
+		return err
+	}
+	d.set(cache.Channels)
+	log.S(log.Info, "Channel directory loaded from cache", log.Int("channels", len(cache.Channels)),
+		log.String("updated", cache.Updated.Format(time.RFC3339)))
+	return nil
+}
+
+func (d *channelDirectory) save(byName map[string]string) error {
+	if d.cachePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(channelDirectoryCache{Updated: time.Now(), Channels: byName})
+	if err != nil {
+		return err
+	}
+	tmp := d.cachePath + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.cachePath)
+}
+
+// RefreshEvery refreshes the directory now and then periodically until the context is canceled.
+func (d *channelDirectory) RefreshEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := d.Refresh(ctx); err != nil {
+			log.S(log.Error, "Failed to refresh the channel directory", log.Any("err", err))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// normalizeChannel switches the request to the channel id, so renames don't break queued messages.
+func (app *App) normalizeChannel(msg *queuedMessage) {
+	if app.channels == nil {
+		return
+	}
+	msg.Request.Channel, _, _ = app.channels.Resolve(msg.Request.Channel)
+}
+
+// channelLabel returns the canonical name of the channel (if known) for metrics labels.
+func (app *App) channelLabel(channel string) string {
+	if app.channels == nil {
+		return channel
+	}
+	_, name, _ := app.channels.Resolve(channel)
+	return name
+}
@@ -0,0 +1,99 @@
+// channels_test.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newConversationsListServer serves 2 pages of channels, rate limiting the first call.
+func newConversationsListServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	calls := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		assert.Equal(t, "/api/conversations.list", r.URL.Path)
+		assert.Equal(t, "Bearer xoxb-test", r.Header.Get("Authorization"))
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		page := map[string]any{"ok": true}
+		switch r.URL.Query().Get("cursor") {
+		case "":
+			page["channels"] = []map[string]string{{"id": "C0000000001", "name": "general"}}
+			page["response_metadata"] = map[string]string{"next_cursor": "page2"}
+		case "page2":
+			page["channels"] = []map[string]string{{"id": "C0000000002", "name": "alerts-renamed"}}
+		default:
+			t.Errorf("unexpected cursor %q", r.URL.Query().Get("cursor"))
+		}
+		_ = json.NewEncoder(w).Encode(page)
+	}))
+}
+
+func TestChannelDirectory(t *testing.T) {
+	server := newConversationsListServer(t)
+	defer server.Close()
+	cache := filepath.Join(t.TempDir(), "channels.json")
+	d := newChannelDirectory(server.Client(), slackMethodURL(server.URL+"/api/chat.postMessage", "conversations.list"),
+		"xoxb-test", cache)
+
+	assert.True(t, d.Exists("#anything"), "everything exists until the directory is loaded")
+	if err := d.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	id, name, known := d.Resolve("#general")
+	assert.Equal(t, "C0000000001", id)
+	assert.Equal(t, "#general", name)
+	assert.True(t, known)
+	id, name, known = d.Resolve("C0000000002")
+	assert.Equal(t, "C0000000002", id)
+	assert.Equal(t, "#alerts-renamed", name)
+	assert.True(t, known)
+	_, name, known = d.Resolve("#alerts")
+	assert.Equal(t, "#alerts", name)
+	assert.False(t, known)
+
+	assert.True(t, d.Exists("general"))
+	assert.False(t, d.Exists("#alerts"))
+	assert.True(t, d.Exists("G0123456789"), "ids aren't checked, private channels and DMs aren't all listed")
+	assert.True(t, d.Exists("@someone"))
+
+	// A new instance starts from the cache.
+	d2 := newChannelDirectory(server.Client(), "", "", cache)
+	if err := d2.LoadCache(); err != nil {
+		t.Fatal(err)
+	}
+	id, _, _ = d2.Resolve("#alerts-renamed")
+	assert.Equal(t, "C0000000002", id)
+}
+
+func TestChannelDirectory_Enqueue(t *testing.T) {
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		channels:   newChannelDirectory(nil, "", "", ""),
+	}
+	app.channels.set(map[string]string{"general": "C0000000001"})
+
+	assert.Equal(t, "Channel #nope not found", validate(SlackPostMessageRequest{Channel: "#nope", Text: "hi"}, app.channels, false).Error())
+	assert.NoError(t, validate(SlackPostMessageRequest{Channel: "#general", Text: "hi"}, app.channels, false))
+
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#general", Text: "hi"}, "")))
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "C0000000001", Text: "there"}, "")))
+	assert.Equal(t, "C0000000001", app.slackQueue.next().Request.Channel)
+	assert.Equal(t, "C0000000001", app.slackQueue.next().Request.Channel)
+	assert.Equal(t, 2.0, testutil.ToFloat64(app.metrics.RequestsReceivedTotal.WithLabelValues("#general")))
+}
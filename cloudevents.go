@@ -0,0 +1,406 @@
+// cloudevents.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"fortio.org/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// CloudEvents HTTP protocol binding (https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/bindings/http-protocol-binding.md)
+// Both the structured (whole event as the json body) and binary (attributes as ce- headers, data as
+// the body) content modes are supported.
+const (
+	cloudEventsContentType  = "application/cloudevents+json"
+	cloudEventsHeaderPrefix = "Ce-"
+	cloudEventsSpecVersion  = "1.0"
+	// Used for the templates matching any event type that doesn't have its own.
+	cloudEventsDefaultType = "*"
+	// Maximum size of the request body, in either content mode, larger ones are rejected (413).
+	cloudEventsMaxBody = 1 << 20
+)
+
+// cloudEvent is the decoded event, as passed to the templates.
+type cloudEvent struct {
+	ID              string
+	Source          string
+	SpecVersion     string
+	Type            string
+	Subject         string
+	Time            string
+	DataContentType string
+	Extensions      map[string]string
+	// Data is the decoded json when the content type is json (or absent), the raw string otherwise.
+	Data any
+}
+
+// cloudEventTemplate turns an event into a SlackPostMessageRequest. Each field is a text/template
+// executed with the cloudEvent as data. Blocks, if set, must render to a json array.
+type cloudEventTemplate struct {
+	Channel   string `json:"channel"`
+	Text      string `json:"text"`
+	Username  string `json:"username,omitempty"`
+	IconEmoji string `json:"icon_emoji,omitempty"`
+	IconURL   string `json:"icon_url,omitempty"`
+	Blocks    string `json:"blocks,omitempty"`
+}
+
+type compiledCloudEventTemplate struct {
+	channel, text, username, iconEmoji, iconURL, blocks *template.Template
+}
+
+type cloudEventsIngress struct {
+	templates map[string]*compiledCloudEventTemplate
+	dedup     *dedupCache
+}
+
+var cloudEventTemplateFuncs = template.FuncMap{
+	// json is useful to safely embed event values in blocks.
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// newCloudEventsIngress compiles the templates (keyed by event type, "*" being the fallback) and sets
+// up the event id based idempotency check for the given window.
+func newCloudEventsIngress(templates map[string]cloudEventTemplate, dedupWindow time.Duration) (*cloudEventsIngress, error) {
+	ce := &cloudEventsIngress{
+		templates: make(map[string]*compiledCloudEventTemplate, len(templates)),
+		dedup:     newDedupCache(dedupWindow),
+	}
+	for eventType, t := range templates {
+		if t.Channel == "" {
+			return nil, fmt.Errorf("cloudevent template for %q: channel is not set", eventType)
+		}
+		var compiled compiledCloudEventTemplate
+		var err error
+		for _, f := range []struct {
+			dst  **template.Template
+			name string
+			src  string
+		}{
+			{&compiled.channel, "channel", t.Channel},
+			{&compiled.text, "text", t.Text},
+			{&compiled.username, "username", t.Username},
+			{&compiled.iconEmoji, "icon_emoji", t.IconEmoji},
+			{&compiled.iconURL, "icon_url", t.IconURL},
+			{&compiled.blocks, "blocks", t.Blocks},
+		} {
+			*f.dst, err = template.New(eventType + "." + f.name).Funcs(cloudEventTemplateFuncs).
+				Option("missingkey=zero").Parse(f.src)
+			if err != nil {
+				return nil, fmt.Errorf("cloudevent template for %q: %w", eventType, err)
+			}
+		}
+		ce.templates[eventType] = &compiled
+	}
+	return ce, nil
+}
+
+// loadCloudEventTemplates reads the json file mapping event types to templates.
+func loadCloudEventTemplates(path string) (map[string]cloudEventTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var templates map[string]cloudEventTemplate
+	err = json.Unmarshal(data, &templates)
+	return templates, err
+}
+
+func (app *App) handleCloudEvent(w http.ResponseWriter, r *http.Request) {
+	w, span, end := app.traceRequest(w, r, "handleCloudEvent")
+	defer end()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authenticated := app.authenticate(r)
+
+	// Only the headers can set the priority and ttl of events.
+	prio, err := requestPriority(r, "")
+	var ttl time.Duration
+	if err == nil {
+		ttl, err = requestTTL(r, "")
+	}
+	var event cloudEvent
+	if err == nil {
+		r.Body = http.MaxBytesReader(w, r.Body, cloudEventsMaxBody)
+		event, err = parseCloudEvent(r)
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		log.S(log.Warning, "Cloudevent too large", log.String("remote", r.RemoteAddr))
+		app.auditRejected(r.RemoteAddr, "chat.postMessage", authenticated, "", "", "cloudevent too large")
+		reply(w, http.StatusRequestEntityTooLarge, &SlackResponse{
+			Ok:    false,
+			Error: fmt.Sprintf("cloudevent is larger than %d bytes", cloudEventsMaxBody),
+		})
+		return
+	}
+	var request SlackPostMessageRequest
+	if err == nil {
+		request, err = app.cloudEvents.render(event)
+	}
+	var msg *queuedMessage
+	var copies []*queuedMessage
+	if err == nil {
+		msg = newQueuedMessage(request, event.Source)
+		msg.spanContext = span.SpanContext()
+		span.SetAttributes(attribute.String("slack_proxy.message_id", msg.ID), attribute.String("slack_proxy.client", event.Source),
+			attribute.String("slack_proxy.channel", app.channelLabel(request.Channel)))
+		app.auditMessage(msg, auditEntry{Event: auditReceived, Remote: r.RemoteAddr})
+		msg.Priority = prio
+		app.setExpiry(msg, ttl)
+		copies = app.route(msg, r.Header)
+		err = app.validateCopies(copies)
+	}
+	if err != nil {
+		log.S(log.Error, "Invalid cloudevent", log.Any("err", err), log.String("type", event.Type),
+			log.String("source", event.Source), log.String("id", event.ID))
+		id := ""
+		if msg != nil {
+			id = msg.ID
+		}
+		client := event.Source
+		if client == "" {
+			client = authenticated
+		}
+		app.auditRejected(r.RemoteAddr, "chat.postMessage", client, request.Channel, id, err.Error())
+		reply(w, http.StatusBadRequest, &SlackResponse{
+			Ok:    false,
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if !app.authorize(w, r, authenticated, copies) {
+		return
+	}
+	if app.queueAlmostFull(prio, len(copies)) {
+		app.auditRejected(r.RemoteAddr, "chat.postMessage", event.Source, request.Channel, msg.ID, "Queue is almost full")
+		reply(w, http.StatusServiceUnavailable, &SlackResponse{
+			Ok:    false,
+			Error: "Queue is almost full",
+		})
+		return
+	}
+
+	// Source + id is what uniquely identifies an event per the spec. We only record it once we know the
+	// event is valid, so a fixed redelivery isn't mistaken for a duplicate.
+	if original, duplicate := app.cloudEvents.dedup.record(event.Source+"\x00"+event.ID, msg, copies); duplicate {
+		log.S(log.Info, "Duplicate cloudevent, not posting it again", log.String("source", event.Source),
+			log.String("id", event.ID), log.String("message_id", original))
+		app.metrics.RequestsDeduplicated.WithLabelValues(app.channelLabel(request.Channel)).Inc()
+		app.auditMessage(msg, auditEntry{Event: auditDeduplicated, Reason: "duplicate of " + original})
+		reply(w, http.StatusOK, &SlackResponse{
+			Ok:        true,
+			Warning:   "duplicate",
+			MessageID: original,
+		})
+		return
+	}
+
+	if err = app.enqueueAll(copies); err != nil {
+		reply(w, http.StatusServiceUnavailable, &SlackResponse{
+			Ok:    false,
+			Error: "Queue is full",
+		})
+		return
+	}
+
+	reply(w, http.StatusOK, &SlackResponse{
+		Ok:        true,
+		MessageID: msg.ID,
+	})
+}
+
+// parseCloudEvent decodes either content mode of the http binding.
+func parseCloudEvent(r *http.Request) (cloudEvent, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == cloudEventsContentType {
+		return parseStructuredCloudEvent(r.Body)
+	}
+	return parseBinaryCloudEvent(r.Header, r.Body, r.Header.Get("Content-Type"))
+}
+
+func parseStructuredCloudEvent(body io.Reader) (cloudEvent, error) {
+	var event cloudEvent
+	var attributes map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&attributes); err != nil {
+		return event, err
+	}
+	event.Extensions = make(map[string]string)
+	var data []byte
+	var dataBase64 string
+	for name, raw := range attributes {
+		var err error
+		switch name {
+		case "data":
+			data = raw
+		case "data_base64":
+			err = json.Unmarshal(raw, &dataBase64)
+		default:
+			var value string
+			if json.Unmarshal(raw, &value) != nil {
+				// Extension attributes can also be numbers or booleans.
+				value = string(raw)
+			}
+			event.setAttribute(name, value)
+		}
+		if err != nil {
+			return event, fmt.Errorf("invalid cloudevent attribute %s: %w", name, err)
+		}
+	}
+	if dataBase64 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(dataBase64)
+		if err != nil {
+			return event, fmt.Errorf("invalid cloudevent data_base64: %w", err)
+		}
+		return event, event.setData(decoded, false)
+	}
+	// In structured mode, json data is embedded as is, anything else is a json string.
+	return event, event.setData(data, true)
+}
+
+func parseBinaryCloudEvent(header http.Header, body io.Reader, contentType string) (cloudEvent, error) {
+	event := cloudEvent{
+		DataContentType: contentType,
+		Extensions:      make(map[string]string),
+	}
+	for name, values := range header {
+		if !strings.HasPrefix(name, cloudEventsHeaderPrefix) || len(values) == 0 {
+			continue
+		}
+		value, err := url.PathUnescape(values[0])
+		if err != nil {
+			return event, fmt.Errorf("invalid cloudevent header %s: %w", name, err)
+		}
+		event.setAttribute(strings.ToLower(strings.TrimPrefix(name, cloudEventsHeaderPrefix)), value)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return event, err
+	}
+	return event, event.setData(data, false)
+}
+
+func (e *cloudEvent) setAttribute(name, value string) {
+	switch name {
+	case "id":
+		e.ID = value
+	case "source":
+		e.Source = value
+	case "specversion":
+		e.SpecVersion = value
+	case "type":
+		e.Type = value
+	case "subject":
+		e.Subject = value
+	case "time":
+		e.Time = value
+	case "datacontenttype":
+		e.DataContentType = value
+	default:
+		e.Extensions[name] = value
+	}
+}
+
+// setData decodes the data according to the content type. embedded is true for the structured mode
+// where non json data is itself json encoded (as a string).
+func (e *cloudEvent) setData(data []byte, embedded bool) error {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	if embedded || isJSONContentType(e.DataContentType) {
+		return json.Unmarshal(data, &e.Data)
+	}
+	e.Data = string(data)
+	return nil
+}
+
+func isJSONContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func (e *cloudEvent) check() error {
+	var missing []string
+	if e.ID == "" {
+		missing = append(missing, "id")
+	}
+	if e.Source == "" {
+		missing = append(missing, "source")
+	}
+	if e.Type == "" {
+		missing = append(missing, "type")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("cloudevent is missing required attributes: %s", strings.Join(missing, ", "))
+	}
+	if e.SpecVersion != cloudEventsSpecVersion {
+		return fmt.Errorf("unsupported cloudevent specversion %q", e.SpecVersion)
+	}
+	return nil
+}
+
+// render applies the template for the event type.
+func (ce *cloudEventsIngress) render(event cloudEvent) (SlackPostMessageRequest, error) {
+	var request SlackPostMessageRequest
+	if err := event.check(); err != nil {
+		return request, err
+	}
+	t, found := ce.templates[event.Type]
+	if !found {
+		t, found = ce.templates[cloudEventsDefaultType]
+	}
+	if !found {
+		return request, fmt.Errorf("no template for cloudevent type %q", event.Type)
+	}
+	var blocks string
+	var errs []error
+	for _, f := range []struct {
+		dst *string
+		t   *template.Template
+	}{
+		{&request.Channel, t.channel},
+		{&request.Text, t.text},
+		{&request.Username, t.username},
+		{&request.IconEmoji, t.iconEmoji},
+		{&request.IconURL, t.iconURL},
+		{&blocks, t.blocks},
+	} {
+		var buf strings.Builder
+		errs = append(errs, f.t.Execute(&buf, event))
+		*f.dst = strings.TrimSpace(buf.String())
+	}
+	if err := errors.Join(errs...); err != nil {
+		return request, err
+	}
+	if blocks != "" {
+		if !json.Valid([]byte(blocks)) {
+			return request, fmt.Errorf("template for cloudevent type %q rendered invalid json blocks", event.Type)
+		}
+		request.Blocks = json.RawMessage(blocks)
+	}
+	return request, nil
+}
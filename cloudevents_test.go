@@ -0,0 +1,191 @@
+// cloudevents_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newCloudEventsTestApp(t *testing.T) *App {
+	t.Helper()
+	ce, err := newCloudEventsIngress(map[string]cloudEventTemplate{
+		"com.example.deploy": {
+			Channel: "#deploys",
+			Text:    "{{.Data.service}} deployed by {{.Data.user}} ({{.Subject}})",
+			Blocks:  `[{"type":"section","text":{"type":"mrkdwn","text":{{json .Data.service}}}}]`,
+		},
+		"*": {
+			Channel: "#events",
+			Text:    "{{.Type}} from {{.Source}}: {{.Data}}",
+		},
+	}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &App{
+		slackQueue:  newMessageQueue(10, false),
+		metrics:     NewMetrics(prometheus.NewRegistry()),
+		cloudEvents: ce,
+	}
+}
+
+func TestHandleCloudEvent(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      map[string]string
+		body        string
+		wantStatus  int
+		wantError   string
+		wantRequest *SlackPostMessageRequest
+	}{
+		{
+			name:       "structured",
+			header:     map[string]string{"Content-Type": "application/cloudevents+json; charset=utf-8"},
+			body:       `{"specversion":"1.0","id":"1","source":"/ci","type":"com.example.deploy","subject":"prod","data":{"service":"api","user":"bob"}}`,
+			wantStatus: http.StatusOK,
+			wantRequest: &SlackPostMessageRequest{
+				Channel: "#deploys",
+				Text:    "api deployed by bob (prod)",
+				Blocks:  json.RawMessage(`[{"type":"section","text":{"type":"mrkdwn","text":"api"}}]`),
+			},
+		},
+		{
+			name: "binary",
+			header: map[string]string{
+				"Content-Type":   "application/json",
+				"ce-specversion": "1.0",
+				"ce-id":          "2",
+				"ce-source":      "/ci",
+				"ce-type":        "com.example.deploy",
+				"ce-subject":     "staging%20eu",
+			},
+			body:       `{"service":"web","user":"alice"}`,
+			wantStatus: http.StatusOK,
+			wantRequest: &SlackPostMessageRequest{
+				Channel: "#deploys",
+				Text:    "web deployed by alice (staging eu)",
+				Blocks:  json.RawMessage(`[{"type":"section","text":{"type":"mrkdwn","text":"web"}}]`),
+			},
+		},
+		{
+			name: "binary text data with default template",
+			header: map[string]string{
+				"Content-Type":   "text/plain",
+				"ce-specversion": "1.0",
+				"ce-id":          "3",
+				"ce-source":      "/cron",
+				"ce-type":        "com.example.other",
+			},
+			body:       `backup done`,
+			wantStatus: http.StatusOK,
+			wantRequest: &SlackPostMessageRequest{
+				Channel: "#events",
+				Text:    "com.example.other from /cron: backup done",
+			},
+		},
+		{
+			name:       "structured base64 data",
+			header:     map[string]string{"Content-Type": "application/cloudevents+json"},
+			body:       `{"specversion":"1.0","id":"4","source":"/cron","type":"x","datacontenttype":"text/plain","data_base64":"aGk="}`,
+			wantStatus: http.StatusOK,
+			wantRequest: &SlackPostMessageRequest{
+				Channel: "#events",
+				Text:    "x from /cron: hi",
+			},
+		},
+		{
+			name:       "missing attributes",
+			header:     map[string]string{"Content-Type": "application/cloudevents+json"},
+			body:       `{"specversion":"1.0","type":"x"}`,
+			wantStatus: http.StatusBadRequest,
+			wantError:  "cloudevent is missing required attributes: id, source",
+		},
+		{
+			name:       "bad spec version",
+			header:     map[string]string{"Content-Type": "application/cloudevents+json"},
+			body:       `{"specversion":"0.3","id":"5","source":"/ci","type":"x"}`,
+			wantStatus: http.StatusBadRequest,
+			wantError:  `unsupported cloudevent specversion "0.3"`,
+		},
+		{
+			name: "binary too large",
+			header: map[string]string{
+				"Content-Type":   "text/plain",
+				"ce-specversion": "1.0",
+				"ce-id":          "6",
+				"ce-source":      "/cron",
+				"ce-type":        "x",
+			},
+			body:       strings.Repeat("x", cloudEventsMaxBody+1),
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantError:  "cloudevent is larger than 1048576 bytes",
+		},
+		{
+			name:       "structured too large",
+			header:     map[string]string{"Content-Type": "application/cloudevents+json"},
+			body:       `{"specversion":"1.0","id":"7","source":"/ci","type":"x","data":"` + strings.Repeat("x", cloudEventsMaxBody) + `"}`,
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantError:  "cloudevent is larger than 1048576 bytes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newCloudEventsTestApp(t)
+			req := httptest.NewRequest(http.MethodPost, "/cloudevents", bytes.NewBufferString(tt.body))
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			app.handleCloudEvent(rr, req)
+
+			assert.Equal(t, tt.wantStatus, rr.Code)
+			var response SlackResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantError, response.Error)
+			if tt.wantRequest == nil {
+				assert.Equal(t, 0, app.slackQueue.Len())
+				return
+			}
+			assert.Equal(t, 1, app.slackQueue.Len())
+			msg := app.slackQueue.next()
+			assert.Equal(t, *tt.wantRequest, msg.Request)
+			assert.Equal(t, msg.ID, response.MessageID)
+		})
+	}
+}
+
+func TestHandleCloudEvent_Redelivery(t *testing.T) {
+	app := newCloudEventsTestApp(t)
+	body := `{"specversion":"1.0","id":"42","source":"/alerts","type":"x","data":"boom"}`
+	var receipts []string
+	for range 3 {
+		req := httptest.NewRequest(http.MethodPost, "/cloudevents", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", cloudEventsContentType)
+		rr := httptest.NewRecorder()
+		app.handleCloudEvent(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var response SlackResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		receipts = append(receipts, response.MessageID)
+	}
+	assert.Equal(t, 1, app.slackQueue.Len())
+	assert.Equal(t, []string{receipts[0], receipts[0], receipts[0]}, receipts)
+	assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.RequestsReceivedTotal.WithLabelValues("#events")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.RequestsReceivedByClient.WithLabelValues(otherClient)), "event sources are unbounded")
+	assert.Equal(t, 2.0, testutil.ToFloat64(app.metrics.RequestsDeduplicated.WithLabelValues("#events")))
+}
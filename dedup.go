@@ -0,0 +1,135 @@
+// dedup.go
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Header callers can set so their retries (e.g. Alertmanager re-sending on timeout) aren't posted twice.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+type dedupEntry struct {
+	at      time.Time
+	receipt string
+}
+
+// dedupCache remembers keys, and the receipt (message id) of the first request that used them, for a
+// given window so retried or redelivered requests can be dropped. It is safe for concurrent use.
+type dedupCache struct {
+	mu        sync.Mutex
+	window    time.Duration
+	seen      map[string]dedupEntry
+	lastPrune time.Time
+	now       func() time.Time // for tests
+}
+
+func newDedupCache(window time.Duration) *dedupCache {
+	return &dedupCache{
+		window: window,
+		seen:   make(map[string]dedupEntry),
+		now:    time.Now,
+	}
+}
+
+// Seen records the key with its receipt and returns false, unless the key was already recorded within
+// the window in which case it returns the original receipt and true.
+func (d *dedupCache) Seen(key, receipt string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	d.prune(now)
+	if entry, found := d.seen[key]; found && now.Sub(entry.at) < d.window {
+		return entry.receipt, true
+	}
+	d.seen[key] = dedupEntry{at: now, receipt: receipt}
+	return "", false
+}
+
+// Forget drops the key if it is still recorded with the receipt, e.g. when the message wasn't posted
+// in the end so its retries must not be dropped.
+func (d *dedupCache) Forget(key, receipt string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if entry, found := d.seen[key]; found && entry.receipt == receipt {
+		delete(d.seen, key)
+	}
+}
+
+// dedupRecord is where and how a message was recorded, see forgetDuplicate.
+type dedupRecord struct {
+	cache   *dedupCache
+	key     string
+	receipt string
+}
+
+// record is Seen for a message, remembering on it and its routed copies how it was recorded.
+func (d *dedupCache) record(key string, msg *queuedMessage, copies []*queuedMessage) (string, bool) {
+	original, duplicate := d.Seen(key, msg.ID)
+	if !duplicate {
+		record := &dedupRecord{cache: d, key: key, receipt: msg.ID}
+		msg.dedup = record
+		for _, c := range copies {
+			c.dedup = record
+		}
+	}
+	return original, duplicate
+}
+
+// prune drops the expired entries, at most once per window so we don't walk the map on every call.
+// Must be called with the lock held.
+func (d *dedupCache) prune(now time.Time) {
+	if now.Sub(d.lastPrune) < d.window {
+		return
+	}
+	for key, entry := range d.seen {
+		if now.Sub(entry.at) >= d.window {
+			delete(d.seen, key)
+		}
+	}
+	d.lastPrune = now
+}
+
+// contentHash identifies identical messages: same destination (thread included) and same content.
+func contentHash(request *SlackPostMessageRequest) string {
+	h := sha256.New()
+	for _, part := range [][]byte{
+		[]byte(request.Channel), []byte(request.ThreadTS), []byte(request.Text), request.Blocks, request.Attachments,
+	} {
+		h.Write(part)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// duplicateOf returns the id of the message the request duplicates, if any, and records it otherwise.
+// The idempotency key (e.g. the Idempotency-Key header) is used when set, scoped to the client, and if
+// enabled the content hash for the others. The copies are the ones routed from the message, which are
+// queued instead, see forgetDuplicate.
+func (app *App) duplicateOf(idempotencyKey string, msg *queuedMessage, copies []*queuedMessage) (string, bool) {
+	if app.dedup == nil {
+		return "", false
+	}
+	var key string
+	switch {
+	case idempotencyKey != "":
+		key = "key\x00" + msg.Client + "\x00" + idempotencyKey
+	case app.dedupContent:
+		key = "hash\x00" + contentHash(&msg.Request)
+	default:
+		return "", false
+	}
+	return app.dedup.record(key, msg, copies)
+}
+
+// forgetDuplicate forgets the message's key when it ends without being posted (failed, dropped,
+// rejected...), so it isn't reported as the original of the retries which would never be posted.
+func forgetDuplicate(msg *queuedMessage) {
+	if msg.dedup != nil {
+		msg.dedup.cache.Forget(msg.dedup.key, msg.dedup.receipt)
+	}
+}
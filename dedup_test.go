@@ -0,0 +1,127 @@
+// dedup_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDedupCache(t *testing.T) {
+	now := time.Now()
+	d := newDedupCache(time.Minute)
+	d.now = func() time.Time { return now }
+	_, seen := d.Seen("a", "id1")
+	assert.False(t, seen, "first time")
+	receipt, seen := d.Seen("a", "id2")
+	assert.True(t, seen, "second time")
+	assert.Equal(t, "id1", receipt, "should return the original receipt")
+	_, seen = d.Seen("b", "id3")
+	assert.False(t, seen, "other key")
+	now = now.Add(2 * time.Minute)
+	_, seen = d.Seen("a", "id4")
+	assert.False(t, seen, "after the window")
+	assert.Equal(t, 1, len(d.seen), "expired entries should be pruned")
+}
+
+func TestContentHash(t *testing.T) {
+	base := SlackPostMessageRequest{Channel: "#a", Text: "hello", Blocks: json.RawMessage(`[]`)}
+	same := base
+	same.Username = "other bot" // presentation only
+	otherThread := base
+	otherThread.ThreadTS = "123.456"
+	// The separators make sure fields can't bleed into each other.
+	shifted := SlackPostMessageRequest{Channel: "#ah", Text: "ello", Blocks: json.RawMessage(`[]`)}
+	assert.Equal(t, contentHash(&base), contentHash(&same))
+	assert.NotEqual(t, contentHash(&base), contentHash(&otherThread))
+	assert.NotEqual(t, contentHash(&base), contentHash(&shifted))
+}
+
+func TestHandleRequest_Deduplication(t *testing.T) {
+	tests := []struct {
+		name         string
+		dedupContent bool
+		keys         []string
+		wantQueued   int
+	}{
+		{name: "same idempotency key", keys: []string{"k1", "k1", "k1"}, wantQueued: 1},
+		{name: "different idempotency keys", keys: []string{"k1", "k2"}, wantQueued: 2},
+		{name: "no key, content hash disabled", keys: []string{"", ""}, wantQueued: 2},
+		{name: "no key, content hash enabled", dedupContent: true, keys: []string{"", ""}, wantQueued: 1},
+		{name: "key takes precedence over content", dedupContent: true, keys: []string{"k1", "k2"}, wantQueued: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &App{
+				slackQueue:   newMessageQueue(10, false),
+				metrics:      NewMetrics(prometheus.NewRegistry()),
+				dedup:        newDedupCache(time.Minute),
+				dedupContent: tt.dedupContent,
+			}
+			var first string
+			for i, key := range tt.keys {
+				req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"channel": "#c", "text": "Hello"}`))
+				if key != "" {
+					req.Header.Set(idempotencyKeyHeader, key)
+				}
+				rr := httptest.NewRecorder()
+				app.handleRequest(rr, req)
+				assert.Equal(t, http.StatusOK, rr.Code)
+				var response SlackResponse
+				assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+				assert.True(t, response.Ok)
+				assert.NotEqual(t, "", response.MessageID)
+				if i == 0 {
+					first = response.MessageID
+				} else if response.Warning == "duplicate" {
+					assert.Equal(t, first, response.MessageID, "duplicates get the original receipt")
+				}
+			}
+			assert.Equal(t, tt.wantQueued, app.slackQueue.Len())
+			assert.Equal(t, float64(len(tt.keys)-tt.wantQueued),
+				testutil.ToFloat64(app.metrics.RequestsDeduplicated.WithLabelValues("#c")))
+		})
+	}
+}
+
+func TestDedupCache_Forget(t *testing.T) {
+	d := newDedupCache(time.Minute)
+	d.Seen("a", "id1")
+	d.Forget("a", "id2")
+	_, seen := d.Seen("a", "id3")
+	assert.True(t, seen, "only forgotten for the receipt it was recorded with")
+	d.Forget("a", "id1")
+	_, seen = d.Seen("a", "id4")
+	assert.False(t, seen, "forgotten")
+}
+
+func TestHandleRequest_DeduplicationNotPosted(t *testing.T) {
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		dedup:      newDedupCache(time.Minute),
+	}
+	post := func() string {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"channel": "#c", "text": "Hello"}`))
+		req.Header.Set(idempotencyKeyHeader, "k1")
+		rr := httptest.NewRecorder()
+		app.handleRequest(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var response SlackResponse
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+		return response.Warning
+	}
+	assert.Equal(t, "", post())
+	app.recordOutcome(app.slackQueue.next(), deliveryResult{Outcome: outcomeFailed, Error: "channel_not_found"})
+	assert.Equal(t, "", post(), "the retry of a failed message is posted")
+	app.recordOutcome(app.slackQueue.next(), deliveryResult{Outcome: outcomePosted, TS: "1.2"})
+	assert.Equal(t, "duplicate", post(), "the retry of a posted message is dropped")
+}
@@ -0,0 +1,140 @@
+// digest.go
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+)
+
+// When an incident fires hundreds of alerts to one channel, the rate limit means the last ones land
+// minutes late. Past a threshold of pending messages for a channel, text messages are merged into a
+// single digest post instead, which stays open (accepting more) until processQueue picks it up.
+
+const digestSeparator = "\n\n"
+
+// digestBatch is the texts merged into a digest queuedMessage.
+type digestBatch struct {
+	texts  []string
+	length int
+	newest time.Time // when the last merged message was received, for the "delayed by" annotation
+	// The messages merged after the first one (the digest itself), their outcome is the digest's.
+	merged []*queuedMessage
+}
+
+type digester struct {
+	threshold int
+	maxLength int
+	mu        sync.Mutex
+	pending   map[string]int            // queued messages per channel and priority, a digest counting as one
+	open      map[string]*queuedMessage // digest still accepting messages, per channel, priority and sender
+}
+
+func newDigester(threshold int) *digester {
+	return &digester{
+		threshold: threshold,
+		maxLength: slackMaxTextLength - 128, // room for the header
+		pending:   make(map[string]int),
+		open:      make(map[string]*queuedMessage),
+	}
+}
+
+// digestible is true for the plain text messages, the ones we can merge without losing anything into
+// those posted the same way (see digestSender).
+func digestible(msg *queuedMessage) bool {
+	request := &msg.Request
+	return msg.upload == nil && msg.reaction == nil && request.Text != "" && len(request.Blocks) == 0 &&
+		len(request.Attachments) == 0 && request.ThreadTS == "" && msg.ThreadKey == ""
+}
+
+// digestKey is the channel and priority, as a low priority digest must not delay high priority messages.
+func digestKey(msg *queuedMessage) string {
+	return msg.Request.Channel + "\x00" + msg.Priority.String()
+}
+
+// digestSender is the client and how the message is posted (as who, how its text is formatted): only
+// the messages sharing it are merged, the digest being posted like its first message.
+func digestSender(msg *queuedMessage) string {
+	request := &msg.Request
+	return strings.Join([]string{msg.Client, request.Username, request.IconEmoji, request.IconURL, request.Parse,
+		strconv.FormatBool(request.LinkNames), strconv.FormatBool(request.AsUser)}, "\x00")
+}
+
+// admit is called for each message about to be queued. It returns the open digest the message got
+// merged into, in which case it must not be queued, nil otherwise. When the channel is backlogged, the
+// message then becomes a new digest.
+func (d *digester) admit(msg *queuedMessage) *queuedMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := digestKey(msg)
+	if digestible(msg) && d.pending[key] >= d.threshold {
+		open := key + "\x00" + digestSender(msg)
+		if digest := d.open[open]; digest != nil &&
+			digest.digest.length+len(digestSeparator)+len(msg.Request.Text) <= d.maxLength {
+			digest.digest.texts = append(digest.digest.texts, msg.Request.Text)
+			digest.digest.length += len(digestSeparator) + len(msg.Request.Text)
+			digest.digest.newest = msg.Received
+			digest.digest.merged = append(digest.digest.merged, msg)
+			mergeExpiry(digest, msg)
+			return digest
+		}
+		// Either the first one or the previous digest is full.
+		msg.digest = &digestBatch{texts: []string{msg.Request.Text}, length: len(msg.Request.Text), newest: msg.Received}
+		d.open[open] = msg
+	}
+	d.pending[key]++
+	return nil
+}
+
+// mergeExpiry extends the expiry of the digest to the one of the message merged into it, so the later
+// messages aren't dropped (see expired) along with the first one.
+func mergeExpiry(digest, msg *queuedMessage) {
+	if !digest.Expires.IsZero() && (msg.Expires.IsZero() || msg.Expires.After(digest.Expires)) {
+		digest.Expires = msg.Expires
+	}
+}
+
+// done is called when processQueue takes the message out of the queue. Digests stop accepting messages
+// and get their final text. Returns how many messages the digest merged (0 for regular messages).
+func (d *digester) done(msg *queuedMessage) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := digestKey(msg)
+	d.pending[key]--
+	if d.pending[key] <= 0 {
+		delete(d.pending, key)
+	}
+	if msg.digest == nil {
+		return 0
+	}
+	if open := key + "\x00" + digestSender(msg); d.open[open] == msg {
+		delete(d.open, open)
+	}
+	count := len(msg.digest.texts)
+	if count > 1 {
+		msg.Request.Text = fmt.Sprintf(":package: *Digest of %d messages* (the channel is backlogged)%s%s",
+			count, digestSeparator, strings.Join(msg.digest.texts, digestSeparator))
+	}
+	return count
+}
+
+// sealDigest finalizes the message if it is a digest, recording how many originals went into it.
+func (app *App) sealDigest(msg *queuedMessage) {
+	if app.digests == nil {
+		return
+	}
+	count := app.digests.done(msg)
+	if count == 0 {
+		return
+	}
+	log.S(log.Info, "Posting digest", log.String("channel", msg.Request.Channel), log.Int("messages", count),
+		log.String("message_id", msg.ID))
+	app.metrics.DigestMessages.WithLabelValues(app.channelLabel(msg.Request.Channel)).Observe(float64(count))
+}
@@ -0,0 +1,155 @@
+// digest_test.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDigester(t *testing.T) {
+	app := &App{
+		slackQueue: newMessageQueue(20, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		digests:    newDigester(2),
+	}
+	for i := range 10 {
+		assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#storm", Text: fmt.Sprintf("alert %d", i)}, "")))
+	}
+	// Not text only, so never merged.
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#storm", Blocks: json.RawMessage(`[]`)}, "")))
+	// Other channels aren't affected.
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#calm", Text: "hi"}, "")))
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#calm", Text: "there"}, "")))
+
+	assert.Equal(t, 6, app.slackQueue.Len())
+	var texts []string
+	for range 6 {
+		msg := app.slackQueue.next()
+		app.sealDigest(msg)
+		texts = append(texts, msg.Request.Channel+" "+msg.Request.Text)
+	}
+	assert.Equal(t, []string{
+		"#storm alert 0",
+		"#storm alert 1",
+		"#storm :package: *Digest of 8 messages* (the channel is backlogged)\n\n" +
+			"alert 2\n\nalert 3\n\nalert 4\n\nalert 5\n\nalert 6\n\nalert 7\n\nalert 8\n\nalert 9",
+		"#storm ",
+		"#calm hi",
+		"#calm there",
+	}, texts)
+	assert.Equal(t, 0, len(app.digests.pending), "all messages should be accounted for")
+	assert.Equal(t, 0, len(app.digests.open))
+	assert.Equal(t, 1, testutil.CollectAndCount(app.metrics.DigestMessages))
+
+	// Once the digest is picked up, new messages go to a new one.
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#storm", Text: "a"}, "")))
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#storm", Text: "b"}, "")))
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#storm", Text: "c"}, "")))
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#storm", Text: "d"}, "")))
+	assert.Equal(t, 3, app.slackQueue.Len())
+}
+
+func TestDigester_MaxLength(t *testing.T) {
+	d := newDigester(0)
+	d.maxLength = 25
+	var queued []*queuedMessage
+	for i := range 5 {
+		msg := newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Text: strings.Repeat(fmt.Sprint(i), 10)}, "")
+		if d.admit(msg) == nil {
+			queued = append(queued, msg)
+		}
+	}
+	// 10 chars + 2 separator + 10 chars fits in 25, a third doesn't.
+	assert.Equal(t, 3, len(queued))
+	counts := []int{}
+	for _, msg := range queued {
+		counts = append(counts, d.done(msg))
+	}
+	assert.Equal(t, []int{2, 2, 1}, counts)
+	assert.Equal(t, "4444444444", queued[2].Request.Text, "single message digests are left as is")
+}
+
+func TestDigester_Sender(t *testing.T) {
+	d := newDigester(0)
+	requests := []struct {
+		client string
+		SlackPostMessageRequest
+	}{
+		{"ci", SlackPostMessageRequest{Channel: "#c", Text: "a"}},
+		{"ci", SlackPostMessageRequest{Channel: "#c", Text: "b"}},
+		{"ci", SlackPostMessageRequest{Channel: "#c", Text: "c", Username: "deploy-bot"}},
+		{"ci", SlackPostMessageRequest{Channel: "#c", Text: "d", IconEmoji: ":rocket:"}},
+		{"ci", SlackPostMessageRequest{Channel: "#c", Text: "e", LinkNames: true}},
+		{"ops", SlackPostMessageRequest{Channel: "#c", Text: "f"}},
+		{"ci", SlackPostMessageRequest{Channel: "#c", Text: "g", Username: "deploy-bot"}},
+	}
+	var queued []string
+	for _, r := range requests {
+		msg := newQueuedMessage(r.SlackPostMessageRequest, r.client)
+		if d.admit(msg) == nil {
+			queued = append(queued, msg.Request.Text)
+		}
+	}
+	assert.Equal(t, []string{"a", "c", "d", "e", "f"}, queued, "only merged with the messages posted the same way")
+}
+
+func TestProcessQueue_Digest(t *testing.T) {
+	messenger := &MockSlackMessenger{}
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		messenger:  messenger,
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		digests:    newDigester(1),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := range 5 {
+		assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#storm", Text: fmt.Sprint(i)}, "")))
+	}
+	go app.processQueue(ctx, 0, time.Millisecond, 10, time.Millisecond)
+	app.wg.Wait()
+	assert.Equal(t, 2.0, testutil.ToFloat64(app.metrics.RequestsSucceededTotal.WithLabelValues("#storm")))
+	assert.Equal(t, 5.0, testutil.ToFloat64(app.metrics.RequestsReceivedTotal.WithLabelValues("#storm")))
+}
+
+func TestDigester_Expiry(t *testing.T) {
+	app := &App{
+		slackQueue:    newMessageQueue(10, false),
+		metrics:       NewMetrics(prometheus.NewRegistry()),
+		digests:       newDigester(1),
+		expiredAction: expiredDrop,
+	}
+	now := time.Now()
+	message := func(text string, age, ttl time.Duration) *queuedMessage {
+		msg := newQueuedMessage(SlackPostMessageRequest{Channel: "#storm", Text: text}, "")
+		msg.Received = now.Add(-age)
+		msg.Expires = msg.Received.Add(ttl)
+		return msg
+	}
+	assert.NoError(t, app.enqueue(message("first", 10*time.Minute, 5*time.Minute)))
+	digest := message("stale", 10*time.Minute, 5*time.Minute)
+	assert.NoError(t, app.enqueue(digest))
+	fresh := message("fresh", 30*time.Second, time.Hour)
+	assert.NoError(t, app.enqueue(fresh))
+	assert.Equal(t, 2, app.slackQueue.Len())
+	assert.Equal(t, fresh.Expires, digest.Expires, "the digest expires with its last message")
+
+	app.slackQueue.next()
+	assert.True(t, app.slackQueue.next() == digest)
+	app.sealDigest(digest)
+	assert.False(t, app.expired(digest, "#storm"), "fresh messages aren't dropped with the stale ones")
+
+	digest.Expires = now.Add(-time.Second)
+	app.expiredAction = expiredAnnotate
+	assert.False(t, app.expired(digest, "#storm"))
+	assert.True(t, strings.HasPrefix(digest.Request.Text, ":hourglass: _Delayed by 30s_\n"), digest.Request.Text)
+}
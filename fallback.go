@@ -0,0 +1,130 @@
+// fallback.go
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"fortio.org/log"
+)
+
+// Messages with blocks (or attachments) but no text have no notification text and nothing for screen
+// readers, and Slack warns about it. Such messages get a fallback text derived from their content.
+
+// Length of the derived text, it is only a summary of the blocks.
+const maxFallbackText = 3000
+
+// blockTexts appends the texts of the headers, sections, context and markdown blocks.
+func blockTexts(texts []string, blocks json.RawMessage) []string {
+	var list []struct {
+		Type   string          `json:"type"`
+		Text   json.RawMessage `json:"text"`
+		Fields []struct {
+			Text string `json:"text"`
+		} `json:"fields"`
+		Elements []struct {
+			Type string          `json:"type"`
+			Text json.RawMessage `json:"text"` // an object for the interactive elements
+		} `json:"elements"`
+	}
+	if len(blocks) == 0 || json.Unmarshal(blocks, &list) != nil {
+		return texts
+	}
+	for _, block := range list {
+		switch block.Type {
+		case "header", "section":
+			var text struct {
+				Text string `json:"text"`
+			}
+			if json.Unmarshal(block.Text, &text) == nil && text.Text != "" {
+				texts = append(texts, text.Text)
+			}
+			for _, field := range block.Fields {
+				texts = append(texts, field.Text)
+			}
+		case "markdown":
+			var text string
+			if json.Unmarshal(block.Text, &text) == nil && text != "" {
+				texts = append(texts, text)
+			}
+		case "context":
+			for _, element := range block.Elements {
+				var text string
+				if (element.Type == "mrkdwn" || element.Type == "plain_text") && json.Unmarshal(element.Text, &text) == nil {
+					texts = append(texts, text)
+				}
+			}
+		}
+	}
+	return texts
+}
+
+// attachmentTexts appends the fallback (or title) of the attachments.
+func attachmentTexts(texts []string, attachments json.RawMessage) []string {
+	var list []struct {
+		Fallback string          `json:"fallback"`
+		Title    string          `json:"title"`
+		Pretext  string          `json:"pretext"`
+		Blocks   json.RawMessage `json:"blocks"`
+	}
+	if len(attachments) == 0 || json.Unmarshal(attachments, &list) != nil {
+		return texts
+	}
+	for _, attachment := range list {
+		switch {
+		case attachment.Fallback != "":
+			texts = append(texts, attachment.Fallback)
+		case attachment.Title != "":
+			texts = append(texts, attachment.Title)
+		case attachment.Pretext != "":
+			texts = append(texts, attachment.Pretext)
+		default:
+			texts = blockTexts(texts, attachment.Blocks)
+		}
+	}
+	return texts
+}
+
+// fallbackText returns the text derived from the blocks and attachments, empty if there is none.
+func fallbackText(request *SlackPostMessageRequest) string {
+	texts := attachmentTexts(blockTexts(nil, request.Blocks), request.Attachments)
+	text := strings.TrimSpace(strings.Join(texts, "\n"))
+	if runes := []rune(text); len(runes) > maxFallbackText {
+		text = string(runes[:maxFallbackText-1]) + "…"
+	}
+	return text
+}
+
+// setFallbackText sets the text of messages which only have blocks or attachments.
+func setFallbackText(msg *queuedMessage) {
+	if msg.Request.Text != "" || msg.upload != nil {
+		return
+	}
+	msg.Request.Text = fallbackText(&msg.Request)
+	if msg.Request.Text != "" {
+		log.S(log.Debug, "Derived the fallback text", log.String("message_id", msg.ID), log.String("text", msg.Request.Text))
+	}
+}
+
+// recordWarnings counts the warnings Slack returned for a posted message (e.g. missing_text_in_blocks),
+// which don't prevent the post but are worth fixing.
+func (app *App) recordWarnings(label string, response SlackResponse) {
+	var warnings []string
+	if response.ResponseMetadata != nil {
+		warnings = response.ResponseMetadata.Warnings
+	}
+	if response.Warning != "" {
+		warnings = append(strings.Split(response.Warning, ","), warnings...)
+	}
+	seen := make(map[string]bool)
+	for _, warning := range warnings {
+		warning = strings.TrimSpace(warning)
+		if warning == "" || seen[warning] {
+			continue
+		}
+		seen[warning] = true
+		log.S(log.Info, "Slack returned a warning", log.String("channel", label), log.String("warning", warning))
+		app.metrics.SlackWarnings.WithLabelValues(label, warning).Inc()
+	}
+}
@@ -0,0 +1,92 @@
+// fallback_test.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFallbackText(t *testing.T) {
+	tests := []struct {
+		name, blocks, attachments, want string
+	}{
+		{name: "nothing"},
+		{
+			name: "blocks", blocks: `[
+				{"type":"header","text":{"type":"plain_text","text":"Deploy"}},
+				{"type":"divider"},
+				{"type":"section","text":{"type":"mrkdwn","text":"*api* v2"},"fields":[{"type":"mrkdwn","text":"env: prod"}]},
+				{"type":"image","image_url":"https://x/graph.png","alt_text":"graph"},
+				{"type":"actions","elements":[{"type":"button","text":{"type":"plain_text","text":"Retry"}}]},
+				{"type":"context","elements":[{"type":"image","image_url":"https://x/i.png","alt_text":"ci"},{"type":"mrkdwn","text":"by ci"}]},
+				{"type":"markdown","text":"**done**"}
+			]`,
+			want: "Deploy\n*api* v2\nenv: prod\nby ci\n**done**",
+		},
+		{
+			name: "attachments", attachments: `[
+				{"fallback":"Build failed","title":"Build #42","text":"details"},
+				{"title":"Logs"},
+				{"color":"#ff0000","blocks":[{"type":"section","text":{"type":"mrkdwn","text":"nested"}}]}
+			]`,
+			want: "Build failed\nLogs\nnested",
+		},
+		{name: "only images", blocks: `[{"type":"image","image_url":"https://x/graph.png","alt_text":"graph"}]`},
+		{name: "invalid", blocks: `[{`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := SlackPostMessageRequest{Blocks: json.RawMessage(tt.blocks), Attachments: json.RawMessage(tt.attachments)}
+			assert.Equal(t, tt.want, fallbackText(&request))
+		})
+	}
+
+	long := `[{"type":"section","text":{"type":"mrkdwn","text":"` + strings.Repeat("a", 2000) + `"}},` +
+		`{"type":"section","text":{"type":"mrkdwn","text":"` + strings.Repeat("b", 2000) + `"}}]`
+	text := fallbackText(&SlackPostMessageRequest{Blocks: json.RawMessage(long)})
+	assert.Equal(t, maxFallbackText, len([]rune(text)))
+	assert.True(t, strings.HasSuffix(text, "b…"), "truncated")
+}
+
+// WarningSlackMessenger records the messages and answers with Slack warnings.
+type WarningSlackMessenger struct {
+	RecordingSlackMessenger
+}
+
+func (m *WarningSlackMessenger) PostMessage(ctx context.Context, req SlackPostMessageRequest, url, token string) (SlackResponse, error) {
+	response, err := m.RecordingSlackMessenger.PostMessage(ctx, req, url, token)
+	response.Warning = "missing_text_in_blocks,superfluous_charset"
+	response.ResponseMetadata = &slackResponseMetadata{Warnings: []string{"missing_text_in_blocks", "superfluous_charset"}}
+	return response, err
+}
+
+func TestProcessQueue_FallbackAndWarnings(t *testing.T) {
+	messenger := &WarningSlackMessenger{}
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		messenger:  messenger,
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+	}
+	blocks := json.RawMessage(`[{"type":"section","text":{"type":"mrkdwn","text":"Disk *full* on db1"}}]`)
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#alerts", Blocks: blocks}, "")))
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#alerts", Text: "mine", Blocks: blocks}, "")))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.processQueue(ctx, 0, time.Millisecond, 10, time.Millisecond)
+	app.wg.Wait()
+
+	requests := messenger.Requests()
+	assert.Equal(t, 2, len(requests))
+	assert.Equal(t, "Disk *full* on db1", requests[0].Text)
+	assert.Equal(t, "mine", requests[1].Text, "existing text is kept")
+	assert.Equal(t, 2.0, testutil.ToFloat64(app.metrics.SlackWarnings.WithLabelValues("#alerts", "missing_text_in_blocks")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(app.metrics.SlackWarnings.WithLabelValues("#alerts", "superfluous_charset")))
+}
@@ -0,0 +1,359 @@
+// files.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// File uploads use Slack's external upload flow: files.getUploadURLExternal returns where to send the
+// content, then files.completeUploadExternal shares the file in the channel (or thread).
+
+// slackFile is a file to upload, queued like messages (see queuedMessage.upload) so it goes through
+// the same rate limiting and retries.
+type slackFile struct {
+	Filename       string
+	Title          string
+	SnippetType    string // e.g. "text" or "go", makes the file a snippet
+	InitialComment string
+	Content        []byte
+	budgeted       bool // counted in the uploadBudget, until its final outcome
+}
+
+// uploadBudget bounds the bytes of the uploads kept in memory (queued or held) until they are posted,
+// as maxUploadSize only bounds each upload. It is safe for concurrent use, a nil budget is unlimited.
+type uploadBudget struct {
+	max  int64
+	used atomic.Int64
+}
+
+func newUploadBudget(maxBytes int64) *uploadBudget {
+	return &uploadBudget{max: maxBytes}
+}
+
+// reserve returns false, reserving nothing, when the bytes don't fit in the budget.
+func (b *uploadBudget) reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+	if b.used.Add(n) > b.max {
+		b.used.Add(-n)
+		return false
+	}
+	return true
+}
+
+// release is called with the final outcome of the upload messages (see recordOutcome).
+func (app *App) releaseUpload(msg *queuedMessage) {
+	if msg.upload == nil || !msg.upload.budgeted {
+		return
+	}
+	msg.upload.budgeted = false
+	if app.uploads != nil {
+		app.uploads.used.Add(-int64(len(msg.upload.Content)))
+	}
+}
+
+// SlackFileUploader is implemented by the messengers able to upload files.
+type SlackFileUploader interface {
+	UploadFile(ctx context.Context, file *slackFile, channel, threadTS, url, token string) (SlackResponse, error)
+}
+
+// errUploadNotSupported is returned, as a permanent error, when the messenger can't upload files.
+var errUploadNotSupported = errors.New("upload_not_supported")
+
+// call sends the request with the token and decodes the response into result, returning the Slack error
+// if the response isn't ok.
+func (s *SlackClient) call(req *http.Request, token string, result any, response *SlackResponse) error {
+	req.Header.Set("Authorization", "Bearer "+token)
+	injectTrace(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return err
+	}
+	if !response.Ok {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+func (s *SlackClient) UploadFile(ctx context.Context, file *slackFile, channel, threadTS, postMessageURL, token string) (SlackResponse, error) {
+	form := url.Values{}
+	form.Set("filename", file.Filename)
+	form.Set("length", strconv.Itoa(len(file.Content)))
+	if file.SnippetType != "" {
+		form.Set("snippet_type", file.SnippetType)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, slackMethodURL(postMessageURL, "files.getUploadURLExternal"),
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return SlackResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var upload struct {
+		SlackResponse
+		UploadURL string `json:"upload_url"`
+		FileID    string `json:"file_id"`
+	}
+	if err = s.call(req, token, &upload, &upload.SlackResponse); err != nil {
+		return upload.SlackResponse, err
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, upload.UploadURL, bytes.NewReader(file.Content))
+	if err != nil {
+		return SlackResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return SlackResponse{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return SlackResponse{}, fmt.Errorf("upload of %s failed with status %d", file.Filename, resp.StatusCode)
+	}
+
+	title := file.Title
+	if title == "" {
+		title = file.Filename
+	}
+	complete := map[string]any{
+		"files":      []map[string]string{{"id": upload.FileID, "title": title}},
+		"channel_id": channel,
+	}
+	if threadTS != "" {
+		complete["thread_ts"] = threadTS
+	}
+	if file.InitialComment != "" {
+		complete["initial_comment"] = file.InitialComment
+	}
+	body, err := json.Marshal(complete)
+	if err != nil {
+		return SlackResponse{}, err
+	}
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, slackMethodURL(postMessageURL, "files.completeUploadExternal"),
+		bytes.NewReader(body))
+	if err != nil {
+		return SlackResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	var response SlackResponse
+	err = s.call(req, token, &response, &response)
+	return response, err
+}
+
+// send posts the message, or uploads its file, or adds its reaction, with the messenger of its backend.
+func (app *App) send(ctx context.Context, msg *queuedMessage) (SlackResponse, error) {
+	messenger, url, token, request := app.destination(msg.Request)
+	var response SlackResponse
+	var err error
+	switch {
+	case msg.reaction != nil:
+		reactor, ok := messenger.(SlackReactor)
+		if !ok {
+			return SlackResponse{}, errReactionsNotSupported
+		}
+		response, err = reactor.React(ctx, msg.reaction, request.Channel, url, token)
+	case msg.upload != nil:
+		uploader, ok := messenger.(SlackFileUploader)
+		if !ok {
+			return SlackResponse{}, errUploadNotSupported
+		}
+		response, err = uploader.UploadFile(ctx, msg.upload, request.Channel, request.ThreadTS, url, token)
+		if err == nil {
+			app.metrics.UploadBytes.WithLabelValues(app.channelLabel(msg.Request.Channel)).Add(float64(len(msg.upload.Content)))
+		}
+	default:
+		response, err = messenger.PostMessage(ctx, request, url, token)
+	}
+	// Keep the backend in the channel id, for the follow ups and reactions.
+	if request.Channel != msg.Request.Channel && response.Channel != "" {
+		response.Channel = strings.TrimSuffix(msg.Request.Channel, request.Channel) + response.Channel
+	}
+	return response, err
+}
+
+// Room for the other form fields and the multipart headers, on top of the files.
+const uploadFormOverhead = 64 << 10
+
+// handleUpload accepts multipart/form-data uploads: one or more "file" parts and the channel, thread_ts
+// or thread_key, title, initial_comment, snippet_type, priority and ttl fields. Each file is queued like
+// a message, its id being the returned message_id followed by -2, -3,... for the next files.
+func (app *App) handleUpload(w http.ResponseWriter, r *http.Request) {
+	w, span, end := app.traceRequest(w, r, "handleUpload")
+	defer end()
+	authenticated := app.authenticate(r)
+	client := clientName(r)
+	if authenticated != "" {
+		client = authenticated
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, app.maxUploadSize+uploadFormOverhead)
+	files, err := app.uploadedFiles(r)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || errors.Is(err, errUploadTooLarge) {
+		// Only known if the form could be parsed, FormValue would parse the (too large) body again.
+		channel := ""
+		if r.MultipartForm != nil && len(r.MultipartForm.Value["channel"]) > 0 {
+			channel = r.MultipartForm.Value["channel"][0]
+		}
+		log.S(log.Warning, "Upload too large", log.Any("err", err), log.String("client", client))
+		app.auditRejected(r.RemoteAddr, "files.upload", client, channel, "", "upload too large")
+		reply(w, http.StatusRequestEntityTooLarge, &SlackResponse{
+			Ok:    false,
+			Error: fmt.Sprintf("upload is larger than %d bytes", app.maxUploadSize),
+		})
+		return
+	}
+
+	prio := priorityNormal
+	if err == nil {
+		prio, err = requestPriority(r, r.FormValue("priority"))
+	}
+	var ttl time.Duration
+	if err == nil {
+		ttl, err = requestTTL(r, r.FormValue("ttl"))
+	}
+	request := SlackPostMessageRequest{Channel: r.FormValue("channel"), ThreadTS: r.FormValue("thread_ts")}
+	if err == nil {
+		err = app.validateUpload(request.Channel)
+	}
+	if err != nil {
+		log.S(log.Error, "Invalid upload", log.Any("err", err))
+		app.auditRejected(r.RemoteAddr, "files.upload", client, request.Channel, "", err.Error())
+		reply(w, http.StatusBadRequest, &SlackResponse{Ok: false, Error: err.Error()})
+		return
+	}
+	if app.queueAlmostFull(prio, len(files)) {
+		app.auditRejected(r.RemoteAddr, "files.upload", client, request.Channel, "", "Queue is almost full")
+		reply(w, http.StatusServiceUnavailable, &SlackResponse{Ok: false, Error: "Queue is almost full"})
+		return
+	}
+
+	threadKey := r.FormValue("thread_key")
+	if key := r.Header.Get(threadKeyHeader); key != "" {
+		threadKey = key
+	}
+	msgs := make([]*queuedMessage, 0, len(files))
+	for i, file := range files {
+		msg := newQueuedMessage(request, client)
+		if i > 0 {
+			msg.ID = fmt.Sprintf("%s-%d", msgs[0].ID, i+1)
+		}
+		msg.Priority = prio
+		app.setExpiry(msg, ttl)
+		msg.ThreadKey = threadKey
+		msg.upload = file
+		msg.spanContext = span.SpanContext()
+		app.auditMessage(msg, auditEntry{Event: auditReceived, Remote: r.RemoteAddr})
+		msgs = append(msgs, msg)
+	}
+	span.SetAttributes(attribute.String("slack_proxy.message_id", msgs[0].ID), attribute.String("slack_proxy.client", client),
+		attribute.String("slack_proxy.channel", app.channelLabel(request.Channel)))
+	if !app.authorize(w, r, authenticated, msgs) {
+		return
+	}
+	var total int64
+	for _, file := range files {
+		total += int64(len(file.Content))
+	}
+	if !app.uploads.reserve(total) {
+		log.S(log.Warning, "Too many uploads queued, rejecting upload", log.String("client", client),
+			log.String("channel", request.Channel), log.Int64("bytes", total))
+		app.auditRejected(r.RemoteAddr, "files.upload", client, request.Channel, msgs[0].ID, "Too many uploads queued")
+		reply(w, http.StatusServiceUnavailable, &SlackResponse{Ok: false, Error: "Too many uploads queued"})
+		return
+	}
+	for _, msg := range msgs {
+		msg.upload.budgeted = true
+		log.S(log.Info, "Queuing upload", log.String("channel", request.Channel), log.String("client", client),
+			log.String("message_id", msg.ID), log.String("filename", msg.upload.Filename), log.Int("bytes", len(msg.upload.Content)))
+	}
+	if err = app.enqueueAll(msgs); err != nil {
+		reply(w, http.StatusServiceUnavailable, &SlackResponse{Ok: false, Error: "Queue is full"})
+		return
+	}
+	reply(w, http.StatusOK, &SlackResponse{
+		Ok:        true,
+		MessageID: msgs[0].ID,
+	})
+}
+
+// errUploadTooLarge is returned when the files of an upload exceed maxUploadSize.
+var errUploadTooLarge = errors.New("upload too large")
+
+// uploadedFiles parses the multipart form and reads its files, checking their total size.
+func (app *App) uploadedFiles(r *http.Request) ([]*slackFile, error) {
+	// Parts over this size are spooled to temporary files while parsing.
+	if err := r.ParseMultipartForm(8 << 20); err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.MultipartForm.RemoveAll() }()
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		return nil, errors.New("no file is set")
+	}
+	var total int64
+	files := make([]*slackFile, 0, len(headers))
+	for i, header := range headers {
+		total += header.Size
+		if total > app.maxUploadSize {
+			return nil, errUploadTooLarge
+		}
+		f, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(content) == 0 {
+			return nil, fmt.Errorf("file %s is empty", header.Filename)
+		}
+		file := &slackFile{
+			Filename:    header.Filename,
+			Title:       r.FormValue("title"),
+			SnippetType: r.FormValue("snippet_type"),
+			Content:     content,
+		}
+		if i == 0 {
+			file.InitialComment = r.FormValue("initial_comment")
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// validateUpload checks the channel of an upload. Slack only accepts channel ids for uploads, names can
+// only be used when the channel directory resolves them.
+func (app *App) validateUpload(channel string) error {
+	switch {
+	case channel == "":
+		return errors.New("channel is not set")
+	case !app.channels.Exists(channel):
+		return fmt.Errorf("channel %s not found", channel)
+	case app.channels == nil && !slackIDRegexp.MatchString(channel):
+		return fmt.Errorf("channel %s must be an id (e.g. C0123456789) for uploads, unless the channel directory is enabled", channel)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+// files_test.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSlackClient_UploadFile(t *testing.T) {
+	var uploaded string
+	var complete map[string]any
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	mux.HandleFunc("/api/files.getUploadURLExternal", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer xoxb-test", r.Header.Get("Authorization"))
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "log.txt", r.Form.Get("filename"))
+		assert.Equal(t, "5", r.Form.Get("length"))
+		assert.Equal(t, "text", r.Form.Get("snippet_type"))
+		_, _ = w.Write([]byte(`{"ok":true,"upload_url":"` + server.URL + `/upload/F1","file_id":"F1"}`))
+	})
+	mux.HandleFunc("/upload/F1", func(_ http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		uploaded = string(body)
+	})
+	mux.HandleFunc("/api/files.completeUploadExternal", func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&complete))
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	})
+	server = httptest.NewServer(mux)
+	defer server.Close()
+
+	client := &SlackClient{client: server.Client()}
+	file := &slackFile{Filename: "log.txt", SnippetType: "text", Content: []byte("hello")}
+	_, err := client.UploadFile(context.Background(), file, "C123", "1700000000.000001", server.URL+"/api/chat.postMessage", "xoxb-test")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", uploaded)
+	assert.Equal(t, "C123", complete["channel_id"])
+	assert.Equal(t, "1700000000.000001", complete["thread_ts"])
+	assert.Equal(t, "log.txt", complete["files"].([]any)[0].(map[string]any)["title"])
+
+	_, err = client.UploadFile(context.Background(), file, "C123", "", server.URL+"/nope/chat.postMessage", "xoxb-test")
+	assert.Error(t, err)
+}
+
+// uploadRequest builds a multipart upload of the files (name to content) with the form fields.
+func uploadRequest(t *testing.T, fields map[string]string, files ...[2]string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, value := range fields {
+		assert.NoError(t, writer.WriteField(name, value))
+	}
+	for _, file := range files {
+		part, err := writer.CreateFormFile("file", file[0])
+		assert.NoError(t, err)
+		_, _ = part.Write([]byte(file[1]))
+	}
+	assert.NoError(t, writer.Close())
+	r := httptest.NewRequest(http.MethodPost, "/files", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	return r
+}
+
+func TestHandleUpload(t *testing.T) {
+	messenger := &UploadingSlackMessenger{}
+	app := &App{
+		slackQueue:    newMessageQueue(10, false),
+		messenger:     messenger,
+		metrics:       NewMetrics(prometheus.NewRegistry()),
+		maxUploadSize: 100,
+	}
+	fields := map[string]string{"channel": "C0123456789", "thread_ts": "1700000000.000001", "initial_comment": "CI logs"}
+	rr := httptest.NewRecorder()
+	app.handleUpload(rr, uploadRequest(t, fields, [2]string{"build.log", "hello"}, [2]string{"test.log", "world!"}))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response SlackResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.True(t, response.Ok)
+	assert.Equal(t, 2, app.slackQueue.Len())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.processQueue(ctx, 0, time.Millisecond, 10, time.Millisecond)
+	app.wg.Wait()
+	assert.Equal(t, 2, len(messenger.uploads))
+	first, second := messenger.uploads[0], messenger.uploads[1]
+	assert.Equal(t, "build.log", first.file.Filename)
+	assert.Equal(t, "hello", string(first.file.Content))
+	assert.Equal(t, "CI logs", first.file.InitialComment)
+	assert.Equal(t, "C0123456789", first.channel)
+	assert.Equal(t, "1700000000.000001", first.threadTS)
+	assert.Equal(t, "test.log", second.file.Filename)
+	assert.Equal(t, "", second.file.InitialComment, "comment only on the first file")
+	assert.Equal(t, 0, len(messenger.Requests()))
+	assert.Equal(t, 11.0, testutil.ToFloat64(app.metrics.UploadBytes.WithLabelValues("C0123456789")))
+}
+
+func TestHandleUpload_Invalid(t *testing.T) {
+	audit, err := openAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"), 0, 0)
+	assert.NoError(t, err)
+	defer audit.Close()
+	app := &App{
+		slackQueue:    newMessageQueue(10, false),
+		metrics:       NewMetrics(prometheus.NewRegistry()),
+		maxUploadSize: 100,
+		audit:         audit,
+	}
+	tests := []struct {
+		name    string
+		fields  map[string]string
+		files   [][2]string
+		status  int
+		wantErr string
+	}{
+		{
+			name: "no channel", files: [][2]string{{"a.txt", "a"}},
+			status: http.StatusBadRequest, wantErr: "channel is not set",
+		},
+		{
+			name: "channel name", fields: map[string]string{"channel": "#ci"}, files: [][2]string{{"a.txt", "a"}},
+			status: http.StatusBadRequest, wantErr: "channel #ci must be an id",
+		},
+		{
+			name: "no file", fields: map[string]string{"channel": "C0123456789"},
+			status: http.StatusBadRequest, wantErr: "no file is set",
+		},
+		{
+			name: "empty file", fields: map[string]string{"channel": "C0123456789"}, files: [][2]string{{"a.txt", "a"}, {"b.txt", ""}},
+			status: http.StatusBadRequest, wantErr: "file b.txt is empty",
+		},
+		{
+			name: "too large", fields: map[string]string{"channel": "C0123456789"},
+			files:  [][2]string{{"a.txt", strings.Repeat("a", 60)}, {"b.txt", strings.Repeat("b", 60)}},
+			status: http.StatusRequestEntityTooLarge, wantErr: "upload is larger than 100 bytes",
+		},
+		{
+			name: "way too large", fields: map[string]string{"channel": "C0123456789"},
+			files:  [][2]string{{"a.txt", strings.Repeat("a", 100<<10)}},
+			status: http.StatusRequestEntityTooLarge, wantErr: "upload is larger than 100 bytes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			app.handleUpload(rr, uploadRequest(t, tt.fields, tt.files...))
+			assert.Equal(t, tt.status, rr.Code)
+			var response SlackResponse
+			assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+			assert.True(t, strings.HasPrefix(response.Error, tt.wantErr), response.Error)
+		})
+	}
+	assert.Equal(t, 0, app.slackQueue.Len())
+	entries, err := audit.Query(auditQuery{Limit: 100})
+	assert.NoError(t, err)
+	var channels []string
+	for _, entry := range entries {
+		if entry.Reason == "upload too large" {
+			channels = append(channels, entry.Channel)
+		}
+	}
+	// The channel isn't known when the body couldn't be parsed.
+	assert.Equal(t, []string{"C0123456789", ""}, channels)
+}
+
+func TestHandleUpload_Budget(t *testing.T) {
+	messenger := &UploadingSlackMessenger{}
+	app := &App{
+		slackQueue:    newMessageQueue(10, false),
+		messenger:     messenger,
+		metrics:       NewMetrics(prometheus.NewRegistry()),
+		maxUploadSize: 100,
+		uploads:       newUploadBudget(15),
+	}
+	upload := func(content string) int {
+		rr := httptest.NewRecorder()
+		app.handleUpload(rr, uploadRequest(t, map[string]string{"channel": "C0123456789"}, [2]string{"a.log", content}))
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusOK, upload("0123456789"))
+	assert.Equal(t, http.StatusServiceUnavailable, upload("0123456789"), "over the budget while the first one is queued")
+	assert.Equal(t, http.StatusOK, upload("01234"))
+	assert.Equal(t, 2, app.slackQueue.Len())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.processQueue(ctx, 0, time.Millisecond, 10, time.Millisecond)
+	app.wg.Wait()
+	assert.Equal(t, int64(0), app.uploads.used.Load(), "released once posted")
+	assert.Equal(t, http.StatusOK, upload("0123456789"))
+	app.wg.Wait()
+}
@@ -0,0 +1,269 @@
+// flood.go
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+)
+
+// A runaway job posting the same message in a loop would otherwise be forwarded at the rate limit for
+// as long as it runs, burying everything else. Each channel has a circuit breaker tripping when its
+// incoming rate, or the repetition of the same text, crosses a threshold within a window. While tripped,
+// the messages are dropped (or sampled) and, once the flood stopped for the cooldown, a single summary
+// is posted instead.
+
+const (
+	floodDrop   = "drop"
+	floodSample = "sample"
+	// Beyond that many distinct texts in a window, only the already seen ones are counted as repetitions.
+	floodMaxTexts     = 1000
+	floodTopTexts     = 5
+	floodTextPreview  = 100
+	floodCheckMaxWait = 5 * time.Second
+)
+
+type floodConfig struct {
+	Rate     int           // messages per window tripping the breaker, 0 for no limit
+	Repeat   int           // identical texts per window tripping the breaker, 0 for no limit
+	Window   time.Duration // fixed window the rate and repetitions are counted over
+	Cooldown time.Duration // how long the flood must have stopped for the breaker to close
+	Sample   int           // while tripped, let 1 in Sample messages through, 0 drops them all
+}
+
+type floodState struct {
+	windowStart time.Time
+	count       int
+	texts       map[string]int // in the current window
+	// Only set while tripped.
+	tripped    bool
+	trippedAt  time.Time
+	lastHot    time.Time // last time a threshold was crossed
+	seen       int
+	suppressed int
+	clients    map[string]int
+	topTexts   map[string]int // the first floodTopTexts texts suppressed, all the summary shows
+	otherTexts int            // suppressed messages with other texts
+}
+
+// floodBreaker is safe for concurrent use, a nil floodBreaker lets everything through.
+type floodBreaker struct {
+	config   floodConfig
+	mu       sync.Mutex
+	channels map[string]*floodState
+	now      func() time.Time // for tests
+}
+
+func newFloodBreaker(config floodConfig) *floodBreaker {
+	return &floodBreaker{
+		config:   config,
+		channels: make(map[string]*floodState),
+		now:      time.Now,
+	}
+}
+
+// hot counts the message in the current window and returns true if a threshold is crossed.
+func (b *floodBreaker) hot(state *floodState, text string, now time.Time) bool {
+	if now.Sub(state.windowStart) >= b.config.Window {
+		state.windowStart = now
+		state.count = 0
+		clear(state.texts)
+	}
+	state.count++
+	repeats := 0
+	if _, found := state.texts[text]; text != "" && (found || len(state.texts) < floodMaxTexts) {
+		state.texts[text]++
+		repeats = state.texts[text]
+	}
+	return (b.config.Rate > 0 && state.count > b.config.Rate) || (b.config.Repeat > 0 && repeats > b.config.Repeat)
+}
+
+// admit returns false if the message must be suppressed, and whether this message tripped the breaker.
+func (b *floodBreaker) admit(msg *queuedMessage) (bool, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	state := b.channels[msg.Request.Channel]
+	if state == nil {
+		state = &floodState{windowStart: now, texts: make(map[string]int)}
+		b.channels[msg.Request.Channel] = state
+	}
+	hot := b.hot(state, msg.Request.Text, now)
+	tripping := false
+	if hot {
+		state.lastHot = now
+		if !state.tripped {
+			tripping = true
+			state.tripped = true
+			state.trippedAt = now
+			state.seen, state.suppressed, state.otherTexts = 0, 0, 0
+			state.clients = make(map[string]int)
+			state.topTexts = make(map[string]int)
+		}
+	}
+	if !state.tripped {
+		return true, false
+	}
+	state.seen++
+	if b.config.Sample > 0 && (state.seen-1)%b.config.Sample == 0 {
+		return true, tripping
+	}
+	state.suppressed++
+	state.clients[msg.Client]++
+	text := floodPreview(msg.Request.Text)
+	if _, found := state.topTexts[text]; found || len(state.topTexts) < floodTopTexts {
+		state.topTexts[text]++
+	} else {
+		state.otherTexts++
+	}
+	return false, tripping
+}
+
+// floodPreview shortens the text to its first line, for the summary.
+func floodPreview(text string) string {
+	if text == "" {
+		return "(no text)"
+	}
+	text, _, _ = strings.Cut(text, "\n")
+	if runes := []rune(text); len(runes) > floodTextPreview {
+		text = string(runes[:floodTextPreview]) + "…"
+	}
+	return text
+}
+
+// check applies the channel's breaker to the message. It returns true if the message was suppressed, in
+// which case it must not be queued.
+func (b *floodBreaker) check(app *App, msg *queuedMessage) bool {
+	if b == nil {
+		return false
+	}
+	admitted, tripping := b.admit(msg)
+	label := app.channelLabel(msg.Request.Channel)
+	if tripping {
+		log.S(log.Warning, "Flood detected, tripping the channel breaker", log.String("channel", label),
+			log.String("client", msg.Client))
+		app.metrics.FloodBreakerOpen.WithLabelValues(label).Set(1)
+	}
+	if admitted {
+		return false
+	}
+	app.metrics.RequestsFloodSuppressed.WithLabelValues(label, app.clientLabel(msg.Client)).Inc()
+	return true
+}
+
+// closable removes the breakers the flood stopped for (all the tripped ones if all is true), returning
+// their state. It also forgets the channels quiet for a while.
+func (b *floodBreaker) closable(all bool) map[string]*floodState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	closed := make(map[string]*floodState)
+	for channel, state := range b.channels {
+		switch {
+		case state.tripped && (all || now.Sub(state.lastHot) >= b.config.Cooldown):
+			closed[channel] = state
+			delete(b.channels, channel)
+		case !state.tripped && now.Sub(state.windowStart) >= 2*b.config.Window:
+			delete(b.channels, channel)
+		}
+	}
+	return closed
+}
+
+// release closes the breakers the flood stopped for (all of them on shutdown) and queues their summary.
+func (b *floodBreaker) release(app *App, all bool) {
+	if b == nil {
+		return
+	}
+	now := b.now()
+	for channel, state := range b.closable(all) {
+		label := app.channelLabel(channel)
+		log.S(log.Info, "Flood stopped, closing the channel breaker", log.String("channel", label),
+			log.Int("suppressed", state.suppressed))
+		app.metrics.FloodBreakerOpen.WithLabelValues(label).Set(0)
+		if state.suppressed == 0 {
+			continue
+		}
+		app.push(newQueuedMessage(SlackPostMessageRequest{
+			Channel: channel,
+			Text:    state.summary(now),
+		}, ""))
+	}
+}
+
+// ReleaseEvery closes the breakers once the flood stopped, until the context is canceled.
+func (b *floodBreaker) ReleaseEvery(ctx context.Context, app *App) {
+	ticker := time.NewTicker(min(b.config.Cooldown, floodCheckMaxWait))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.release(app, false)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type floodCount struct {
+	name  string
+	count int
+}
+
+// topCounts returns the n largest counts, largest first.
+func topCounts(counts map[string]int, n int) []floodCount {
+	list := make([]floodCount, 0, len(counts))
+	for name, count := range counts {
+		list = append(list, floodCount{name, count})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].count != list[j].count {
+			return list[i].count > list[j].count
+		}
+		return list[i].name < list[j].name
+	})
+	return list[:min(n, len(list))]
+}
+
+// formatCount formats the count with thousands separators (1,234).
+func formatCount(count int) string {
+	s := strconv.Itoa(count)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// summary is the message posted when the breaker closes.
+func (s *floodState) summary(now time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, ":no_entry: *Flood protection: suppressed %s messages in %s*", formatCount(s.suppressed),
+		now.Sub(s.trippedAt).Round(time.Second))
+	clients := make([]string, 0, len(s.clients))
+	for _, c := range topCounts(s.clients, floodTopTexts) {
+		name := c.name
+		if name == "" {
+			name = "unknown"
+		}
+		clients = append(clients, fmt.Sprintf("%s (%s)", name, formatCount(c.count)))
+	}
+	if len(s.clients) > floodTopTexts {
+		clients = append(clients, "…")
+	}
+	fmt.Fprintf(&b, "\nFrom: %s", strings.Join(clients, ", "))
+	b.WriteString("\nTop texts:")
+	for _, t := range topCounts(s.topTexts, floodTopTexts) {
+		fmt.Fprintf(&b, "\n> %s (x%s)", t.name, formatCount(t.count))
+	}
+	if s.otherTexts > 0 {
+		fmt.Fprintf(&b, "\n> (other texts) (x%s)", formatCount(s.otherTexts))
+	}
+	return b.String()
+}
@@ -0,0 +1,87 @@
+// flood_test.go
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFormatCount(t *testing.T) {
+	for count, want := range map[int]string{0: "0", 999: "999", 1234: "1,234", 1000000: "1,000,000"} {
+		assert.Equal(t, want, formatCount(count))
+	}
+}
+
+func TestFloodBreaker(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	app := &App{
+		slackQueue: newMessageQueue(100, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		flood:      newFloodBreaker(floodConfig{Rate: 20, Repeat: 3, Window: time.Minute, Cooldown: 5 * time.Minute}),
+	}
+	app.flood.now = func() time.Time { return now }
+	send := func(channel, client, text string) {
+		assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: channel, Text: text}, client)))
+	}
+	for range 3 {
+		send("#builds", "ci", "build failed")
+	}
+	send("#other", "ci", "build failed")
+	assert.Equal(t, 4, app.slackQueue.Len(), "under the thresholds")
+	for range 1000 {
+		send("#builds", "ci", "build failed")
+	}
+	send("#builds", "", "unrelated")
+	send("#other", "ci", "still fine")
+	assert.Equal(t, 5, app.slackQueue.Len())
+	assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.FloodBreakerOpen.WithLabelValues("#builds")))
+	assert.Equal(t, 1001.0, testutil.ToFloat64(app.metrics.RequestsFloodSuppressed.WithLabelValues("#builds", otherClient)),
+		"without a policy, all the callers are other")
+
+	now = now.Add(4 * time.Minute)
+	app.flood.release(app, false)
+	assert.Equal(t, 5, app.slackQueue.Len(), "still in the cooldown")
+	now = now.Add(time.Minute)
+	app.flood.release(app, false)
+	assert.Equal(t, 6, app.slackQueue.Len())
+	assert.Equal(t, 0.0, testutil.ToFloat64(app.metrics.FloodBreakerOpen.WithLabelValues("#builds")))
+	for range 5 {
+		app.slackQueue.next()
+	}
+	summary := app.slackQueue.next()
+	assert.Equal(t, "#builds", summary.Request.Channel)
+	assert.Equal(t, ":no_entry: *Flood protection: suppressed 1,001 messages in 5m0s*\n"+
+		"From: ci (1,000), unknown (1)\nTop texts:\n> build failed (x1,000)\n> unrelated (x1)", summary.Request.Text)
+
+	send("#builds", "ci", "build failed")
+	assert.Equal(t, 1, app.slackQueue.Len(), "closed again")
+}
+
+func TestFloodBreaker_Sample(t *testing.T) {
+	app := &App{
+		slackQueue: newMessageQueue(100, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		flood:      newFloodBreaker(floodConfig{Rate: 10, Window: time.Minute, Cooldown: time.Minute, Sample: 10}),
+	}
+	for i := range 110 {
+		assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Text: fmt.Sprint("event ", i)}, "job")))
+	}
+	assert.Equal(t, 20, app.slackQueue.Len(), "the first 10, then 1 in 10")
+	assert.Equal(t, 90.0, testutil.ToFloat64(app.metrics.RequestsFloodSuppressed.WithLabelValues("#c", otherClient)))
+
+	app.flood.release(app, true)
+	assert.Equal(t, 21, app.slackQueue.Len(), "summary posted on shutdown")
+	for range 20 {
+		app.slackQueue.next()
+	}
+	// Only the texts shown are kept, the others are counted.
+	summary := app.slackQueue.next().Request.Text
+	assert.True(t, strings.HasSuffix(summary, "\n> event 15 (x1)\n> (other texts) (x85)"), summary)
+}
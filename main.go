@@ -17,45 +17,146 @@ import (
 	"fortio.org/log"
 	"fortio.org/scli"
 	"github.com/prometheus/client_golang/prometheus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Metrics struct {
-	RequestsReceivedTotal  *prometheus.CounterVec
-	RequestsFailedTotal    *prometheus.CounterVec
-	RequestsRetriedTotal   *prometheus.CounterVec
-	RequestsSucceededTotal *prometheus.CounterVec
-	RequestsNotProcessed   *prometheus.CounterVec
-	QueueSize              *prometheus.GaugeVec
+	RequestsReceivedTotal    *prometheus.CounterVec
+	RequestsReceivedByClient *prometheus.CounterVec
+	RequestsFailedTotal      *prometheus.CounterVec
+	RequestsRetriedTotal     *prometheus.CounterVec
+	RequestsSucceededTotal   *prometheus.CounterVec
+	RequestsNotProcessed     *prometheus.CounterVec
+	RequestsDeduplicated     *prometheus.CounterVec
+	RequestsDenied           *prometheus.CounterVec
+	RequestsExpired          *prometheus.CounterVec
+	RequestsSuppressed       *prometheus.CounterVec
+	RequestsFloodSuppressed  *prometheus.CounterVec
+	FloodBreakerOpen         *prometheus.GaugeVec
+	SlackWarnings            *prometheus.CounterVec
+	UploadBytes              *prometheus.CounterVec
+	TeeRecords               *prometheus.CounterVec
+	ShadowResults            *prometheus.CounterVec
+	ShadowDivergences        *prometheus.CounterVec
+	DigestMessages           *prometheus.HistogramVec
+	QueueWait                *prometheus.HistogramVec
+	SlackAPIDuration         *prometheus.HistogramVec
+	DeliveryDuration         *prometheus.HistogramVec
+	SlackErrors              *prometheus.CounterVec
+	Attempts                 *prometheus.CounterVec
+	QueueSize                *prometheus.GaugeVec
+	QueueOverflow            *prometheus.CounterVec
 }
 
 type SlackResponse struct {
-	Ok    bool   `json:"ok"`
-	Error string `json:"error,omitempty"`
+	Ok      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+	Warning string `json:"warning,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	TS      string `json:"ts,omitempty"`
+	// ResponseMetadata lists Slack's warnings (also joined in Warning).
+	ResponseMetadata *slackResponseMetadata `json:"response_metadata,omitempty"`
+	// MessageID is the proxy's receipt for the accepted message (not part of Slack's responses).
+	MessageID string `json:"message_id,omitempty"`
+}
+
+type slackResponseMetadata struct {
+	Warnings []string `json:"warnings,omitempty"`
 }
 
 type SlackPostMessageRequest struct {
-	Token       string          `json:"token"`
-	Channel     string          `json:"channel"`
-	Text        string          `json:"text"`
-	AsUser      bool            `json:"as_user,omitempty"`
-	Username    string          `json:"username,omitempty"`
-	IconURL     string          `json:"icon_url,omitempty"`
-	IconEmoji   string          `json:"icon_emoji,omitempty"`
-	ThreadTS    string          `json:"thread_ts,omitempty"`
-	Parse       string          `json:"parse,omitempty"`
-	LinkNames   bool            `json:"link_names,omitempty"`
-	Blocks      json.RawMessage `json:"blocks,omitempty"`      // JSON serialized array of blocks
-	Attachments json.RawMessage `json:"attachments,omitempty"` // JSON serialized array of attachments
+	Token          string          `json:"token"`
+	Channel        string          `json:"channel"`
+	Text           string          `json:"text"`
+	AsUser         bool            `json:"as_user,omitempty"`
+	Username       string          `json:"username,omitempty"`
+	IconURL        string          `json:"icon_url,omitempty"`
+	IconEmoji      string          `json:"icon_emoji,omitempty"`
+	ThreadTS       string          `json:"thread_ts,omitempty"`
+	ReplyBroadcast bool            `json:"reply_broadcast,omitempty"`
+	Parse          string          `json:"parse,omitempty"`
+	LinkNames      bool            `json:"link_names,omitempty"`
+	Blocks         json.RawMessage `json:"blocks,omitempty"`      // JSON serialized array of blocks
+	Attachments    json.RawMessage `json:"attachments,omitempty"` // JSON serialized array of attachments
+}
+
+// proxyRequest is what callers POST: a chat.postMessage request plus the proxy's own fields, which are
+// not forwarded to Slack.
+type proxyRequest struct {
+	SlackPostMessageRequest
+	ThreadKey string `json:"thread_key,omitempty"`
+	Priority  string `json:"priority,omitempty"`
+	TTL       string `json:"ttl,omitempty"`
+	DeliverAt string `json:"deliver_at,omitempty"`
+	Delay     string `json:"delay,omitempty"`
+}
+
+// queuedMessage is what goes through the slackQueue: the request to forward to Slack along with the
+// proxy's own metadata about it.
+type queuedMessage struct {
+	ID      string // receipt returned to the caller
+	Client  string
+	Request SlackPostMessageRequest
+	// Correlation key, see threadStore.
+	ThreadKey string
+	Priority  priority
+	Received  time.Time
+	queued    time.Time        // when pushed to the queue, see push
+	Expires   time.Time        // zero when the message never expires
+	digest    *digestBatch     // set for digests, see digester
+	upload    *slackFile       // set for file uploads, posted with SlackFileUploader instead
+	reaction  *slackReaction   // set for reactions, sent with SlackReactor instead
+	followUps []*queuedMessage // other parts of a split message, see splitMessage
+	dedup     *dedupRecord     // nil when not recorded for deduplication
+	// Of the request the message came from, to propagate its trace.
+	spanContext trace.SpanContext
+	// The request as enqueued, before being processed, see tee. Nil for the parts of split messages.
+	accepted *SlackPostMessageRequest
 }
 
+// Header callers can set to identify themselves (used as the client label in metrics).
+const clientHeader = "X-Slack-Proxy-Client"
+
 type App struct {
-	slackQueue          chan SlackPostMessageRequest
+	slackQueue          *messageQueue
 	wg                  sync.WaitGroup
 	messenger           SlackMessenger
+	backends            backendSet // other workspaces and chat tools, nil when there are none
 	SlackPostMessageURL string
 	SlackToken          string
 	metrics             *Metrics
 	channelOverride     string
+	cloudEvents         *cloudEventsIngress
+	syslog              *syslogIngress
+	smtp                *smtpIngress
+	dedup               *dedupCache // nil when deduplication is disabled
+	dedupContent        bool
+	digests             *digester // nil when digests are disabled
+	threads             *threadStore
+	posted              *postedStore // nil when reactions by message id are disabled
+	threadBroadcast     bool
+	channels            *channelDirectory // nil when channel resolution is disabled
+	routing             *routingRules     // nil when there are no routing rules
+	policy              *channelPolicy    // nil when any caller can post anywhere
+	audit               *auditLog
+	tee                 *tee          // nil when messages aren't copied anywhere
+	shadow              *shadow       // nil when shadow mode is disabled
+	flushTimeout        time.Duration // on shutdown, for the tee and shadow copies; 0 for none
+	messageTTL          time.Duration // default ttl, 0 for none
+	expiredAction       string
+	scheduler           *scheduler // nil when scheduled delivery is disabled
+	quiet               *quietSuppressor
+	flood               *floodBreaker // nil when flood protection is disabled
+	splitMode           string        // empty when oversized messages aren't split
+	splitLength         int
+	maxUploadSize       int64 // 0 when the /files endpoint is disabled
+	uploads             *uploadBudget
+	// Exports the spans, nil when they aren't (see tracer).
+	tracing *sdktrace.TracerProvider
+	// Stops (and waits for) the goroutines releasing messages to the queue, see startReleases.
+	stopReleases context.CancelFunc
+	releases     sync.WaitGroup
 }
 
 // podIndex retrieves the index of the current pod based on the HOSTNAME environment variable.
@@ -100,6 +201,39 @@ func main() {
 		metricsPort         = ":9090"
 		applicationPort     = ":8080"
 		channelOverride     string
+		cloudEventTemplates string
+		syslogUDP           string
+		syslogTCP           string
+		syslogRoutes        string
+		smtpAddr            string
+		smtpDomain          string
+		smtpRecipients      string
+		smtpMaxSize         = int64(1 << 20)
+		dedupContent        bool
+		digestThreshold     int
+		threadStateFile     string
+		threadBroadcast     bool
+		channelCacheFile    string
+		routingRulesFile    string
+		backendsFile        string
+		policyFile          string
+		quietHoursFile      string
+		quietMaxHeld        = defaultMaxHeld
+		auditFile           string
+		auditMaxSize        int64 = 100 << 20
+		auditBackups              = 5
+		teeSinks            string
+		shadowConfig        = shadowConfig{Rate: time.Second}
+		priorityMode        = "strict"
+		expiredAction       = expiredDrop
+		maxScheduleDelay    = 7 * 24 * time.Hour
+		maxScheduled        = defaultMaxScheduled
+		floodAction         = floodDrop
+		splitMode           string
+		splitLength         = slackMaxTextLength
+		maxUploadSize       = int64(20 << 20)
+		maxQueuedUploads    = int64(100 << 20)
+		flood               = floodConfig{Window: time.Minute, Cooldown: 5 * time.Minute, Sample: 10}
 	)
 
 	initialBackoff := flag.Duration("initialBackoff", 1000*time.Millisecond, "Initial backoff in milliseconds for retries")
@@ -109,10 +243,92 @@ func main() {
 	flag.IntVar(&maxRetries, "maxRetries", maxRetries, "Maximum number of retries for posting a message")
 	flag.StringVar(&slackPostMessageURL, "slackURL", slackPostMessageURL, "Slack Post Message API URL")
 	flag.IntVar(&maxQueueSize, "queueSize", maxQueueSize, "Maximum number of messages in the queue")
+	flag.StringVar(&priorityMode, "priorityMode", priorityMode,
+		"How the priority lanes are served: strict (always the highest first) or weighted (4:2:1 round robin)")
 	flag.IntVar(&burst, "burst", burst, "Maximum number of burst to allow")
 	flag.StringVar(&metricsPort, "metricsPort", metricsPort, "Port for the metrics server")
 	flag.StringVar(&applicationPort, "applicationPort", applicationPort, "Port for the application server")
 	flag.StringVar(&channelOverride, "channelOverride", "", "Override the channel for all messages - Be careful with this one!")
+	flag.StringVar(&cloudEventTemplates, "cloudEventTemplates", "",
+		"Path to the json file of per event type templates, enables the /cloudevents endpoint when set")
+	cloudEventDedupWindow := flag.Duration("cloudEventDedupWindow", 1*time.Hour,
+		"How long cloudevent ids are remembered to drop redeliveries")
+	dedupWindow := flag.Duration("dedupWindow", 10*time.Minute,
+		"How long Idempotency-Key (and content hashes) are remembered to drop duplicate requests, 0 to disable")
+	flag.BoolVar(&dedupContent, "dedupContent", false,
+		"Also drop requests without Idempotency-Key identical (channel, text, blocks, attachments) to one seen within the dedupWindow")
+	flag.IntVar(&digestThreshold, "digestThreshold", 0,
+		"Number of pending messages for a channel past which text messages are merged into digests, 0 to disable")
+	threadTTL := flag.Duration("threadTTL", 24*time.Hour,
+		"How long an unused thread key is remembered, later messages with that key start a new thread")
+	reactionTTL := flag.Duration("reactionTTL", 24*time.Hour,
+		"How long posted messages can be reacted to by message id, 0 to only react by thread key")
+	flag.StringVar(&threadStateFile, "threadStateFile", "", "Optional file to persist the thread keys across restarts")
+	flag.BoolVar(&threadBroadcast, "threadBroadcast", false,
+		"Also send the replies grouped by thread key to the channel (reply_broadcast)")
+	flag.StringVar(&routingRulesFile, "routingRules", "",
+		"Path to the json file of channel aliases and routing rules (rewrites, fan-out), reloaded when changed")
+	flag.StringVar(&backendsFile, "backends", "",
+		"Optional json file of the other backends (slack workspaces, mattermost, discord, teams) channels can be prefixed with")
+	routingReload := flag.Duration("routingReload", 10*time.Second, "How often the routing rules file is checked for changes")
+	messageTTL := flag.Duration("messageTTL", 0,
+		"Default ttl of the messages (overridden by the X-Message-TTL header or ttl field), 0 for none")
+	flag.StringVar(&expiredAction, "expiredAction", expiredAction,
+		"What to do with expired messages: drop them, or annotate them with the delay and post them anyway")
+	flag.DurationVar(&maxScheduleDelay, "maxScheduleDelay", maxScheduleDelay,
+		"How far in the future messages can be scheduled with deliver_at or delay, 0 to disable scheduled delivery")
+	flag.IntVar(&maxScheduled, "maxScheduled", maxScheduled,
+		"Maximum number of pending scheduled messages, the next scheduled requests are rejected")
+	flag.IntVar(&flood.Rate, "floodRate", 0,
+		"Number of messages to a channel within the floodWindow tripping its circuit breaker, 0 for no limit")
+	flag.IntVar(&flood.Repeat, "floodRepeat", 0,
+		"Number of identical messages to a channel within the floodWindow tripping its circuit breaker, 0 for no limit")
+	flag.DurationVar(&flood.Window, "floodWindow", flood.Window, "Window over which floodRate and floodRepeat are counted")
+	flag.DurationVar(&flood.Cooldown, "floodCooldown", flood.Cooldown,
+		"How long a flood must have stopped for the breaker to close and post its summary")
+	flag.StringVar(&floodAction, "floodAction", floodAction,
+		"What to do with the messages while a breaker is tripped: drop them all, or sample them (1 in floodSample)")
+	flag.IntVar(&flood.Sample, "floodSample", flood.Sample, "With floodAction sample, 1 in that many messages are still posted")
+	flag.StringVar(&splitMode, "splitMode", "",
+		"Split the messages too long for Slack instead of failing: thread (the parts after the first posted in its thread)"+
+			" or snippet (the overflowing text uploaded as a snippet in its thread), empty to disable")
+	flag.IntVar(&splitLength, "splitLength", splitLength, "Maximum text length of each part of a split message")
+	flag.Int64Var(&maxUploadSize, "maxUploadSize", maxUploadSize,
+		"Maximum size in bytes of the files of an upload to the /files endpoint, 0 to disable the endpoint")
+	flag.Int64Var(&maxQueuedUploads, "maxQueuedUploads", maxQueuedUploads,
+		"Maximum size in bytes of all the uploads waiting to be posted, the next uploads are rejected")
+	flag.StringVar(&quietHoursFile, "quietHours", "",
+		"Path to the json file of quiet hours and maintenance windows holding, downgrading or dropping messages")
+	flag.IntVar(&quietMaxHeld, "quietMaxHeld", quietMaxHeld,
+		"Maximum number of messages held per channel during quiet hours and maintenance windows, the next ones are rejected")
+	flag.StringVar(&policyFile, "policy", "",
+		"Path to the json file of the channels each client (token from "+clientTokensEnv+") or network may post to")
+	flag.StringVar(&teeSinks, "tee", "",
+		"Optional comma separated sinks to copy the messages and their outcome to: jsonl=<file>, http=<url> or proxy=<url>")
+	flag.Float64Var(&shadowConfig.Sample, "shadowSample", 0,
+		"Fraction (0 to 1) of the messages also posted to the shadow destination, with the "+shadowTokenEnv+" token; 0 disables shadow mode")
+	flag.StringVar(&shadowConfig.URL, "shadowURL", "", "Slack Post Message API URL of the shadow destination, defaults to slackURL")
+	flag.StringVar(&shadowConfig.Channel, "shadowChannel", "",
+		"Channel of the shadow copies, "+shadowChannelPlaceholder+" being replaced by the primary channel name, e.g. #shadow-"+
+			shadowChannelPlaceholder+"; required for shadow mode")
+	flag.DurationVar(&shadowConfig.Rate, "shadowRate", shadowConfig.Rate, "Rate limit for the shadow copies")
+	shutdownFlushTimeout := flag.Duration("shutdownFlushTimeout", 10*time.Second,
+		"How long, on shutdown, the tee records and shadow copies still buffered are flushed for before being dropped, 0 for no limit")
+	flag.StringVar(&auditFile, "auditLog", "",
+		"Optional file to append the audit events (messages lifecycle, policy denials) to, as json lines, also enabling GET /audit when the policy has admins")
+	flag.Int64Var(&auditMaxSize, "auditLogMaxSize", auditMaxSize, "Size, in bytes, at which the audit log is rotated, 0 to never rotate it")
+	flag.IntVar(&auditBackups, "auditLogBackups", auditBackups, "Number of rotated audit log files kept")
+	channelRefresh := flag.Duration("channelRefresh", 0,
+		"Interval to refresh the channel name to id directory (needs the channels:read and groups:read scopes), 0 to disable")
+	flag.StringVar(&channelCacheFile, "channelCacheFile", "", "Optional file to cache the channel directory across restarts")
+	flag.StringVar(&syslogUDP, "syslogUDP", "", "Address for the optional syslog UDP listener, e.g. :5514")
+	flag.StringVar(&syslogTCP, "syslogTCP", "", "Address for the optional syslog TCP listener, e.g. :5514")
+	flag.StringVar(&syslogRoutes, "syslogRoutes", "", "Path to the json file routing syslog messages to channels")
+	flag.StringVar(&smtpAddr, "smtpAddr", "", "Address for the optional SMTP listener, e.g. :2525")
+	flag.StringVar(&smtpDomain, "smtpDomain", "",
+		"Email domain for which any local part maps to the channel of the same name, e.g. proxy.local")
+	flag.StringVar(&smtpRecipients, "smtpRecipients", "", "Path to the json file mapping email addresses to channels")
+	flag.Int64Var(&smtpMaxSize, "smtpMaxSize", smtpMaxSize, "Maximum size in bytes of emails accepted by the SMTP listener")
 
 	scli.ServerMain()
 
@@ -149,6 +365,193 @@ func main() {
 		Timeout: 10 * time.Second,
 	}, metrics, channelOverride, slackPostMessageURL, token)
 
+	if expiredAction != expiredDrop && expiredAction != expiredAnnotate {
+		log.Fatalf("Invalid expiredAction %q, expected %s or %s", expiredAction, expiredDrop, expiredAnnotate)
+	}
+	if maxScheduleDelay > 0 {
+		if maxScheduled < 1 {
+			log.Fatalf("Invalid maxScheduled %d, must be at least 1", maxScheduled)
+		}
+		app.scheduler = newScheduler(maxScheduleDelay)
+		app.scheduler.maxPending = maxScheduled
+	}
+	app.messageTTL = *messageTTL
+	app.expiredAction = expiredAction
+
+	if flood.Rate > 0 || flood.Repeat > 0 {
+		switch floodAction {
+		case floodDrop:
+			flood.Sample = 0
+		case floodSample:
+			if flood.Sample < 1 {
+				log.Fatalf("Invalid floodSample %d, must be at least 1", flood.Sample)
+			}
+		default:
+			log.Fatalf("Invalid floodAction %q, expected %s or %s", floodAction, floodDrop, floodSample)
+		}
+		app.flood = newFloodBreaker(flood)
+	}
+
+	switch splitMode {
+	case "", splitThread, splitSnippet:
+	default:
+		log.Fatalf("Invalid splitMode %q, expected %s or %s", splitMode, splitThread, splitSnippet)
+	}
+	if splitLength < 1000 || splitLength > slackMaxTextLength {
+		log.Fatalf("Invalid splitLength %d, must be between 1000 and %d", splitLength, slackMaxTextLength)
+	}
+	app.splitMode = splitMode
+	app.splitLength = splitLength
+	if maxUploadSize < 0 {
+		log.Fatalf("Invalid maxUploadSize %d, must be positive (or 0 to disable uploads)", maxUploadSize)
+	}
+	app.maxUploadSize = maxUploadSize
+	if maxUploadSize > 0 {
+		if maxQueuedUploads < maxUploadSize {
+			log.Fatalf("Invalid maxQueuedUploads %d, must be at least maxUploadSize (%d)", maxQueuedUploads, maxUploadSize)
+		}
+		app.uploads = newUploadBudget(maxQueuedUploads)
+	}
+
+	switch priorityMode {
+	case "strict":
+	case "weighted":
+		app.slackQueue.weighted = true
+	default:
+		log.Fatalf("Invalid priorityMode %q, expected strict or weighted", priorityMode)
+	}
+
+	if *channelRefresh > 0 {
+		app.channels = newChannelDirectory(&http.Client{Timeout: 30 * time.Second},
+			slackMethodURL(slackPostMessageURL, "conversations.list"), token, channelCacheFile)
+		if err = app.channels.LoadCache(); err != nil {
+			log.Errf("Failed to load the channel directory cache, ignoring it: %v", err)
+		}
+	}
+	// The override also applies to the uploads, which need a channel id (see validateUpload).
+	if maxUploadSize > 0 && channelOverride != "" && app.channels == nil && !slackIDRegexp.MatchString(channelOverride) {
+		log.Fatalf("Invalid channelOverride %q, must be a channel id (e.g. C0123456789) when uploads are enabled, "+
+			"unless the channel directory is enabled", channelOverride)
+	}
+	if backendsFile != "" {
+		app.backends, err = loadBackends(backendsFile, &http.Client{Timeout: 10 * time.Second}, slackPostMessageURL)
+		if err != nil {
+			log.Fatalf("Failed to load the backends: %v", err)
+		}
+	}
+	if routingRulesFile != "" {
+		app.routing, err = newRoutingRules(routingRulesFile)
+		if err != nil {
+			log.Fatalf("Failed to load the routing rules: %v", err)
+		}
+	}
+	if teeSinks != "" {
+		app.tee, err = newTee(teeSinks, &http.Client{Timeout: 10 * time.Second}, metrics)
+		if err != nil {
+			log.Fatalf("Failed to set up the tee: %v", err)
+		}
+	}
+	if shadowConfig.Sample > 0 {
+		if shadowConfig.Sample > 1 {
+			log.Fatalf("Invalid shadowSample %g, must be between 0 and 1", shadowConfig.Sample)
+		}
+		shadowConfig.Token = os.Getenv(shadowTokenEnv)
+		if shadowConfig.Token == "" {
+			log.Fatalf("%s must be set for shadow mode", shadowTokenEnv)
+		}
+		// The primary channel may be an id of the primary workspace, meaningless in the shadow one.
+		if shadowConfig.Channel == "" {
+			log.Fatalf("shadowChannel must be set for shadow mode")
+		}
+		if shadowConfig.URL == "" {
+			shadowConfig.URL = slackPostMessageURL
+		}
+		app.shadow = newShadow(shadowConfig, &SlackClient{client: &http.Client{Timeout: 10 * time.Second}}, metrics)
+	}
+	app.flushTimeout = *shutdownFlushTimeout
+	app.tracing, err = newTracerProvider(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	if auditFile != "" {
+		app.audit, err = openAuditLog(auditFile, auditMaxSize, auditBackups)
+		if err != nil {
+			log.Fatalf("Failed to open the audit log: %v", err)
+		}
+	}
+	if policyFile != "" {
+		clientTokens, err := parseClientTokens(os.Getenv(clientTokensEnv))
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", clientTokensEnv, err)
+		}
+		app.policy, err = loadPolicy(policyFile, clientTokens)
+		if err != nil {
+			log.Fatalf("Failed to load the policy: %v", err)
+		}
+	}
+	if app.audit != nil && !app.policy.hasAdmins() {
+		log.Infof("The policy has no admins, GET /audit is disabled (the audit log is still written)")
+	}
+	var quietConfig *quietConfig
+	if quietHoursFile != "" {
+		quietConfig, err = loadQuietConfig(quietHoursFile)
+		if err != nil {
+			log.Fatalf("Failed to load the quiet hours: %v", err)
+		}
+	}
+	if quietMaxHeld < 1 {
+		log.Fatalf("Invalid quietMaxHeld %d, must be at least 1", quietMaxHeld)
+	}
+	app.quiet = newQuietSuppressor(quietConfig)
+	app.quiet.maxHeld = quietMaxHeld
+	app.threads = newThreadStore(*threadTTL, threadStateFile)
+	if *reactionTTL > 0 {
+		app.posted = newPostedStore(*reactionTTL)
+	}
+	app.threadBroadcast = threadBroadcast
+	if err = app.threads.Load(); err != nil {
+		log.Fatalf("Failed to load the thread keys: %v", err)
+	}
+	if digestThreshold > 0 {
+		app.digests = newDigester(digestThreshold)
+	}
+	if *dedupWindow > 0 {
+		app.dedup = newDedupCache(*dedupWindow)
+		app.dedupContent = dedupContent
+	}
+
+	if cloudEventTemplates != "" {
+		templates, err := loadCloudEventTemplates(cloudEventTemplates)
+		if err != nil {
+			log.Fatalf("Failed to load cloudevent templates: %v", err)
+		}
+		app.cloudEvents, err = newCloudEventsIngress(templates, *cloudEventDedupWindow)
+		if err != nil {
+			log.Fatalf("Invalid cloudevent templates: %v", err)
+		}
+	}
+
+	if syslogUDP != "" || syslogTCP != "" {
+		if syslogRoutes == "" {
+			log.Fatalf("syslogRoutes is required to enable the syslog listeners")
+		}
+		config, err := loadSyslogConfig(syslogRoutes)
+		if err != nil {
+			log.Fatalf("Failed to load syslog routes: %v", err)
+		}
+		app.syslog = &syslogIngress{UDPAddr: syslogUDP, TCPAddr: syslogTCP, config: config}
+	}
+
+	if smtpAddr != "" {
+		app.smtp = &smtpIngress{Addr: smtpAddr, Domain: smtpDomain, MaxSize: smtpMaxSize}
+		if smtpRecipients != "" {
+			app.smtp.Recipients, err = loadSMTPRecipients(smtpRecipients)
+			if err != nil {
+				log.Fatalf("Failed to load smtp recipients: %v", err)
+			}
+		}
+	}
+
 	log.Infof("Starting metrics server.")
 	StartMetricServer(r, metricsPort)
 
@@ -162,6 +565,14 @@ func main() {
 
 	log.Infof("Starting main app logic")
 	go app.processQueue(ctx, maxRetries, *initialBackoff, burst, *slackRequestRate)
+	go app.threads.PersistEvery(ctx, time.Minute)
+	app.startReleases(ctx)
+	if app.routing != nil {
+		go app.routing.ReloadEvery(ctx, *routingReload)
+	}
+	if app.channels != nil {
+		go app.channels.RefreshEvery(ctx, *channelRefresh)
+	}
 	log.Infof("Starting receiver server")
 	// Check error return of app.StartServer in go routine anon function:
 	go func() {
@@ -12,7 +12,7 @@ import (
 func TestValidateErrorsAndLogger(t *testing.T) {
 	req := SlackPostMessageRequest{}
 
-	err := validate(req)
+	err := validate(req, nil, false)
 	if err == nil {
 		t.Errorf("Expected error on empty request validation, got nil")
 	}
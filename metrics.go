@@ -1,6 +1,9 @@
 package main
 
 import (
+	"strconv"
+	"time"
+
 	"fortio.org/fortio/fhttp"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -16,6 +19,14 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 			},
 			[]string{"channel"},
 		),
+		RequestsReceivedByClient: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "slackproxy",
+				Name:      "requests_received_by_client_total",
+				Help:      "The total number of requests received, per authenticated client",
+			},
+			[]string{"client"},
+		),
 		RequestsFailedTotal: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Namespace: "slackproxy",
@@ -48,26 +59,236 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 			},
 			[]string{"channel"},
 		),
+		RequestsDeduplicated: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "slackproxy",
+				Name:      "requests_deduplicated_total",
+				Help:      "The total number of duplicate requests dropped",
+			},
+			[]string{"channel"},
+		),
+		RequestsDenied: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "slackproxy",
+				Name:      "requests_denied_total",
+				Help:      "The total number of requests denied by the channel policy",
+			},
+			[]string{"channel", "client"},
+		),
+		RequestsExpired: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "slackproxy",
+				Name:      "requests_expired_total",
+				Help:      "The total number of requests which expired before they could be posted",
+			},
+			[]string{"channel", "action"},
+		),
+		RequestsSuppressed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "slackproxy",
+				Name:      "requests_suppressed_total",
+				Help:      "The total number of requests held, downgraded or dropped by quiet hours and maintenance windows",
+			},
+			[]string{"channel", "action"},
+		),
+		RequestsFloodSuppressed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "slackproxy",
+				Name:      "requests_flood_suppressed_total",
+				Help:      "The total number of requests suppressed by a tripped flood breaker",
+			},
+			[]string{"channel", "client"},
+		),
+		FloodBreakerOpen: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "slackproxy",
+				Name:      "flood_breaker_open",
+				Help:      "Whether the flood breaker of the channel is tripped (1) or not (0)",
+			},
+			[]string{"channel"},
+		),
+		SlackWarnings: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "slackproxy",
+				Name:      "slack_warnings_total",
+				Help:      "The total number of warnings (e.g. missing_text_in_blocks) returned by Slack for posted messages",
+			},
+			[]string{"channel", "warning"},
+		),
+		UploadBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "slackproxy",
+				Name:      "upload_bytes_total",
+				Help:      "The total number of bytes of the files uploaded to Slack",
+			},
+			[]string{"channel"},
+		),
+		TeeRecords: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "slackproxy",
+				Name:      "tee_records_total",
+				Help:      "The total number of messages copied to each tee sink, by status (sent, failed or dropped)",
+			},
+			[]string{"sink", "status"},
+		),
+		ShadowResults: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "slackproxy",
+				Name:      "shadow_results_total",
+				Help:      "The total number of shadow copies, by primary and shadow result (ok or the error code)",
+			},
+			[]string{"primary", "shadow"},
+		),
+		ShadowDivergences: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "slackproxy",
+				Name:      "shadow_divergences_total",
+				Help:      "The total number of shadow copies whose result differs from the primary one",
+			},
+			[]string{"channel"},
+		),
+		DigestMessages: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "slackproxy",
+				Name:      "digest_messages",
+				Help:      "The number of original messages merged into each digest",
+				Buckets:   []float64{2, 5, 10, 20, 50, 100, 200, 500},
+			},
+			[]string{"channel"},
+		),
+		QueueWait: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "slackproxy",
+				Name:      "queue_wait_seconds",
+				Help:      "The time the messages waited in the queue (including the rate limiter) before being sent",
+				Buckets:   prometheus.ExponentialBuckets(0.01, 2, 15),
+			},
+			[]string{"priority"},
+		),
+		SlackAPIDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "slackproxy",
+				Name:      "slack_api_duration_seconds",
+				Help:      "The latency of the Slack API calls, per method",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"method"},
+		),
+		DeliveryDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "slackproxy",
+				Name:      "delivery_duration_seconds",
+				Help:      "The end-to-end time from receiving the messages to posting them",
+				Buckets:   prometheus.ExponentialBuckets(0.05, 2, 15),
+			},
+			[]string{"channel"},
+		),
+		SlackErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "slackproxy",
+				Name:      "slack_errors_total",
+				Help:      "The total number of errors returned by the Slack API calls, by code and classification",
+			},
+			[]string{"channel", "code", "classification"},
+		),
+		Attempts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "slackproxy",
+				Name:      "attempts_total",
+				Help:      "The total number of attempts to send the messages, by attempt number and outcome",
+			},
+			[]string{"attempt", "outcome"},
+		),
 		QueueSize: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace: "slackproxy",
 				Name:      "queue_size",
-				Help:      "The current size of the queue",
+				Help:      "The current size of the queue, per priority lane",
 			},
-			nil,
+			[]string{"priority"},
+		),
+		QueueOverflow: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "slackproxy",
+				Name:      "queue_overflow_total",
+				Help:      "The total number of messages dropped because the queue was full",
+			},
+			[]string{"channel"},
 		),
 	}
 
 	reg.MustRegister(m.RequestsReceivedTotal)
+	reg.MustRegister(m.RequestsReceivedByClient)
 	reg.MustRegister(m.RequestsFailedTotal)
 	reg.MustRegister(m.RequestsRetriedTotal)
 	reg.MustRegister(m.RequestsSucceededTotal)
 	reg.MustRegister(m.RequestsNotProcessed)
+	reg.MustRegister(m.RequestsDeduplicated)
+	reg.MustRegister(m.RequestsDenied)
+	reg.MustRegister(m.RequestsExpired)
+	reg.MustRegister(m.RequestsSuppressed)
+	reg.MustRegister(m.RequestsFloodSuppressed)
+	reg.MustRegister(m.FloodBreakerOpen)
+	reg.MustRegister(m.SlackWarnings)
+	reg.MustRegister(m.UploadBytes)
+	reg.MustRegister(m.TeeRecords)
+	reg.MustRegister(m.ShadowResults)
+	reg.MustRegister(m.ShadowDivergences)
+	reg.MustRegister(m.DigestMessages)
+	reg.MustRegister(m.QueueWait)
+	reg.MustRegister(m.SlackAPIDuration)
+	reg.MustRegister(m.DeliveryDuration)
+	reg.MustRegister(m.SlackErrors)
+	reg.MustRegister(m.Attempts)
 	reg.MustRegister(m.QueueSize)
+	reg.MustRegister(m.QueueOverflow)
 
 	return m
 }
 
+// Classification of the Slack errors, see CheckError.
+const (
+	errorRetryable = "retryable"
+	errorPermanent = "permanent"
+	errorPause     = "pause"
+	attemptOK      = "ok"
+)
+
+func errorClassification(err string) string {
+	retryable, pause, _ := CheckError(err)
+	switch {
+	case pause:
+		return errorPause
+	case retryable:
+		return errorRetryable
+	default:
+		return errorPermanent
+	}
+}
+
+// observeQueueWait records how long the message waited since it was pushed, once it is about to be sent.
+func (app *App) observeQueueWait(msg *queuedMessage) {
+	if msg.queued.IsZero() {
+		return
+	}
+	app.metrics.QueueWait.WithLabelValues(msg.Priority.String()).Observe(time.Since(msg.queued).Seconds())
+}
+
+// observeAttempt records the latency and outcome of an attempt to send the message and, once posted, the
+// end-to-end time since it was received.
+func (app *App) observeAttempt(msg *queuedMessage, label string, attempt int, err error, latency time.Duration) {
+	app.metrics.SlackAPIDuration.WithLabelValues(messageMethod(msg)).Observe(latency.Seconds())
+	outcome := attemptOK
+	if err != nil {
+		outcome = errorClassification(err.Error())
+		app.metrics.SlackErrors.WithLabelValues(label, resultCode(err.Error()), outcome).Inc()
+	}
+	app.metrics.Attempts.WithLabelValues(strconv.Itoa(attempt), outcome).Inc()
+	if err == nil && !msg.Received.IsZero() {
+		app.metrics.DeliveryDuration.WithLabelValues(label).Observe(time.Since(msg.Received).Seconds())
+	}
+}
+
 func StartMetricServer(reg *prometheus.Registry, addr string) {
 	mux, _ := fhttp.HTTPServer("metrics", addr)
 	mux.Handle("/metrics", promhttp.HandlerFor(
@@ -0,0 +1,59 @@
+// metrics_test.go
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// sampleCount returns the number of observations of the histogram, across its labels.
+func sampleCount(t *testing.T, reg *prometheus.Registry, name string) uint64 {
+	t.Helper()
+	families, err := reg.Gather()
+	assert.NoError(t, err)
+	var count uint64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			count += m.GetHistogram().GetSampleCount()
+		}
+	}
+	return count
+}
+
+func TestErrorClassification(t *testing.T) {
+	assert.Equal(t, errorRetryable, errorClassification("ratelimited"))
+	assert.Equal(t, errorPermanent, errorClassification("missing_scope"))
+	assert.Equal(t, errorPause, errorClassification("channel_not_found"))
+	assert.Equal(t, errorRetryable, errorClassification("connection reset by peer"), "unknown errors are retried")
+}
+
+func TestMetrics_Attempts(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		messenger:  &FlakySlackMessenger{failures: 1},
+		metrics:    metrics,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.processQueue(ctx, 2, time.Millisecond, 10, time.Millisecond)
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#alerts", Text: "a"}, "")))
+	app.wg.Wait()
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.Attempts.WithLabelValues("1", errorRetryable)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.Attempts.WithLabelValues("2", attemptOK)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.SlackErrors.WithLabelValues("#alerts", "ratelimited", errorRetryable)))
+	assert.Equal(t, uint64(1), sampleCount(t, reg, "slackproxy_queue_wait_seconds"))
+	assert.Equal(t, uint64(2), sampleCount(t, reg, "slackproxy_slack_api_duration_seconds"))
+	assert.Equal(t, uint64(1), sampleCount(t, reg, "slackproxy_delivery_duration_seconds"))
+}
@@ -0,0 +1,293 @@
+// policy.go
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"fortio.org/log"
+)
+
+// The channel policy limits which channels each caller may post to, so a leaked url or a misconfigured
+// job can't post to executive or customer shared channels. Callers are identified by their bearer token
+// (see clientTokensEnv) or, for the others, by their source address.
+
+// Environment variable with the comma separated name=token list of the clients.
+const clientTokensEnv = "SLACK_PROXY_CLIENT_TOKENS"
+
+// Client label of the metrics for the callers which aren't clients of the policy, see clientLabel.
+const otherClient = "other"
+
+// channelRule lists glob patterns (e.g. "#team-*") matched against both the requested channel and its
+// canonical name. Deny wins over allow, and channels not allowed are denied.
+type channelRule struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+type networkRule struct {
+	CIDR string `json:"cidr"`
+	channelRule
+	prefix netip.Prefix
+}
+
+// policyConfig is the json policy file. Authenticated clients use their own rule, the others the rule
+// of the first network containing their address, and the default rule otherwise. Without any
+// applicable rule, the request is denied.
+type policyConfig struct {
+	Default  *channelRule            `json:"default,omitempty"`
+	Clients  map[string]*channelRule `json:"clients,omitempty"`
+	Networks []*networkRule          `json:"networks,omitempty"`
+	Admins   []string                `json:"admins,omitempty"` // clients allowed to use the admin api
+}
+
+type channelPolicy struct {
+	config policyConfig
+	tokens map[string]string // client name to token
+}
+
+func loadPolicy(configPath string, tokens map[string]string) (*channelPolicy, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	policy := &channelPolicy{tokens: tokens}
+	if err = json.Unmarshal(data, &policy.config); err != nil {
+		return nil, err
+	}
+	return policy, policy.check()
+}
+
+func (p *channelPolicy) check() error {
+	var errs []error
+	checkPatterns := func(what string, rule *channelRule) {
+		for _, pattern := range append(rule.Allow, rule.Deny...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("policy %s: invalid pattern %q: %w", what, pattern, err))
+			}
+		}
+	}
+	if p.config.Default != nil {
+		checkPatterns("default", p.config.Default)
+	}
+	for name, rule := range p.config.Clients {
+		checkPatterns("client "+name, rule)
+	}
+	for i, network := range p.config.Networks {
+		prefix, err := netip.ParsePrefix(network.CIDR)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("policy network %d: %w", i, err))
+		}
+		network.prefix = prefix.Masked()
+		checkPatterns(fmt.Sprintf("network %d", i), &network.channelRule)
+	}
+	for name := range p.tokens {
+		if _, found := p.config.Clients[name]; !found && p.config.Default == nil {
+			log.S(log.Warning, "Client has a token but no policy, all its requests will be denied", log.String("client", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parseClientTokens parses the name=token,... list.
+func parseClientTokens(list string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for entry := range strings.SplitSeq(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, token, found := strings.Cut(entry, "=")
+		if !found || name == "" || token == "" {
+			return nil, fmt.Errorf("invalid client token entry %q, expected name=token", entry)
+		}
+		tokens[name] = token
+	}
+	return tokens, nil
+}
+
+// authenticate returns the name of the client presenting a bearer token, empty for anonymous callers.
+// Unknown tokens (e.g. the Slack token of callers predating the policy) are anonymous too, false being
+// returned for them.
+func (p *channelPolicy) authenticate(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return "", true
+	}
+	token, found := strings.CutPrefix(auth, "Bearer ")
+	if !found {
+		return "", false
+	}
+	// Compare with all of them, in constant time, to not leak anything about the valid tokens.
+	client := ""
+	for name, candidate := range p.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+			client = name
+		}
+	}
+	return client, client != ""
+}
+
+// rule returns the rule applicable to the caller, nil if there is none.
+func (p *channelPolicy) rule(client, remoteAddr string) *channelRule {
+	if client != "" {
+		if rule, found := p.config.Clients[client]; found {
+			return rule
+		}
+		return p.config.Default
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		for _, network := range p.config.Networks {
+			if network.prefix.Contains(addr.Unmap()) {
+				return &network.channelRule
+			}
+		}
+	}
+	return p.config.Default
+}
+
+// allows returns why the channel (known by any of the names) is denied, empty if it is allowed.
+func (r *channelRule) allows(names ...string) string {
+	if r == nil {
+		return "no policy for this caller"
+	}
+	for _, pattern := range r.Deny {
+		for _, name := range names {
+			if matched, _ := path.Match(pattern, name); matched {
+				return fmt.Sprintf("denied by %q", pattern)
+			}
+		}
+	}
+	for _, pattern := range r.Allow {
+		for _, name := range names {
+			if matched, _ := path.Match(pattern, name); matched {
+				return ""
+			}
+		}
+	}
+	return "not in the allowlist"
+}
+
+// authenticate identifies the caller when the policy is enabled, empty for anonymous callers. Callers
+// with an unknown token are anonymous: the network rules (or the default one) apply to them.
+func (app *App) authenticate(r *http.Request) string {
+	if app.policy == nil {
+		return ""
+	}
+	client, known := app.policy.authenticate(r)
+	if !known {
+		log.S(log.Info, "Unknown authorization, treating the caller as anonymous", log.String("remote", r.RemoteAddr))
+	}
+	return client
+}
+
+// clientLabel returns the client label of the metrics: the name of the clients of the policy, other for
+// the rest (self declared names, CloudEvent sources,...) as they are unbounded.
+func (app *App) clientLabel(client string) string {
+	if app.policy != nil {
+		if _, found := app.policy.tokens[client]; found {
+			return client
+		}
+	}
+	return otherClient
+}
+
+// authorize checks every destination of the request against the policy. The whole request is denied
+// (403) if any of them is, rather than posting a partial fan-out.
+func (app *App) authorize(w http.ResponseWriter, r *http.Request, client string, copies []*queuedMessage) bool {
+	if err := app.checkPolicy(client, r.RemoteAddr, copies); err != nil {
+		reply(w, http.StatusForbidden, &SlackResponse{
+			Ok:    false,
+			Error: err.Error(),
+		})
+		return false
+	}
+	return true
+}
+
+// checkPolicy returns why the caller, identified by its client name or else its remote address, isn't
+// allowed to post to the first denied destination (logged, counted and audited), nil when all of them
+// are allowed. This is authorize for the ingress paths other than http.
+func (app *App) checkPolicy(client, remote string, copies []*queuedMessage) error {
+	if app.policy == nil {
+		return nil
+	}
+	rule := app.policy.rule(client, remote)
+	for _, c := range copies {
+		label := app.channelLabel(c.Request.Channel)
+		reason := rule.allows(c.Request.Channel, label)
+		if reason == "" {
+			continue
+		}
+		caller := client
+		if caller == "" {
+			caller = "anonymous"
+		}
+		log.S(log.Warning, "Request denied by the channel policy", log.String("client", caller),
+			log.String("remote", remote), log.String("channel", label), log.String("reason", reason))
+		app.metrics.RequestsDenied.WithLabelValues(label, client).Inc()
+		app.audit.Record(auditEntry{
+			Event:     auditDenied,
+			Client:    client,
+			Remote:    remote,
+			Channel:   label,
+			MessageID: c.ID,
+			Reason:    reason,
+		})
+		return fmt.Errorf("client %s is not allowed to post to %s: %s", caller, label, reason)
+	}
+	return nil
+}
+
+// hasAdmins returns true when the policy lists admin clients, which enables the admin api.
+func (p *channelPolicy) hasAdmins() bool {
+	return p != nil && len(p.config.Admins) > 0
+}
+
+// requireAdmin only lets the admin clients through, replying (403) and returning false for the others.
+// Without a policy listing admins, nobody is: muting channels is too dangerous to be open like posting.
+func (app *App) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	client := app.authenticate(r)
+	if app.policy.hasAdmins() && client != "" && slices.Contains(app.policy.config.Admins, client) {
+		return true
+	}
+	log.S(log.Warning, "Admin request denied", log.String("client", client), log.String("remote", r.RemoteAddr),
+		log.String("path", r.URL.Path))
+	reply(w, http.StatusForbidden, &SlackResponse{
+		Ok:    false,
+		Error: "admin access required",
+	})
+	return false
+}
+
+// ownClient returns the client whose messages (scheduled, audited) the caller may access, empty for all
+// of them. With the policy enabled, clients other than the admins only access their own messages. The
+// anonymous callers, which have none, are denied (403) and false is returned.
+func (app *App) ownClient(w http.ResponseWriter, r *http.Request, client string) (string, bool) {
+	if app.policy == nil || (client != "" && slices.Contains(app.policy.config.Admins, client)) {
+		return "", true
+	}
+	if client == "" {
+		log.S(log.Warning, "Anonymous request denied", log.String("remote", r.RemoteAddr), log.String("path", r.URL.Path))
+		reply(w, http.StatusForbidden, &SlackResponse{
+			Ok:    false,
+			Error: "authentication required",
+		})
+		return "", false
+	}
+	return client, true
+}
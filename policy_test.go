@@ -0,0 +1,162 @@
+// policy_test.go
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testPolicy = `{
+  "default": {"allow": ["#public-*"]},
+  "clients": {
+    "ci": {"allow": ["#builds*", "#deploys"]},
+    "ops": {"allow": ["*"], "deny": ["#exec-*", "#ext-*"]}
+  },
+  "networks": [{"cidr": "10.1.0.0/16", "allow": ["#infra"]}]
+}`
+
+func newPolicyTestApp(t *testing.T) (*App, string) {
+	t.Helper()
+	dir := t.TempDir()
+	policyPath := filepath.Join(dir, "policy.json")
+	if err := os.WriteFile(policyPath, []byte(testPolicy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := parseClientTokens("ci=ci-secret, ops=ops-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := loadPolicy(policyPath, tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditPath := filepath.Join(dir, "audit.jsonl")
+	audit, err := openAuditLog(auditPath, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		policy:     policy,
+		audit:      audit,
+	}, auditPath
+}
+
+func TestHandleRequest_Policy(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		remote     string
+		channel    string
+		wantStatus int
+		wantError  string
+	}{
+		{"client allowed", "ci-secret", "192.0.2.1:1234", "#builds-main", http.StatusOK, ""},
+		{
+			"client not allowed", "ci-secret", "192.0.2.1:1234", "#random", http.StatusForbidden,
+			"client ci is not allowed to post to #random: not in the allowlist",
+		},
+		{"allow all but", "ops-secret", "192.0.2.1:1234", "#random", http.StatusOK, ""},
+		{
+			"deny wins", "ops-secret", "192.0.2.1:1234", "#exec-staff", http.StatusForbidden,
+			`client ops is not allowed to post to #exec-staff: denied by "#exec-*"`,
+		},
+		// Unknown tokens (e.g. Slack tokens) are anonymous.
+		{"unknown token", "nope", "192.0.2.1:1234", "#public-news", http.StatusOK, ""},
+		{
+			"unknown token not allowed", "nope", "192.0.2.1:1234", "#random", http.StatusForbidden,
+			"client anonymous is not allowed to post to #random: not in the allowlist",
+		},
+		{"unknown token network", "nope", "10.1.2.3:1234", "#infra", http.StatusOK, ""},
+		{"network", "", "10.1.2.3:1234", "#infra", http.StatusOK, ""},
+		{
+			"network not allowed", "", "10.1.2.3:1234", "#public-news", http.StatusForbidden,
+			"client anonymous is not allowed to post to #public-news: not in the allowlist",
+		},
+		{"default", "", "192.0.2.1:1234", "#public-news", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, _ := newPolicyTestApp(t)
+			body, _ := json.Marshal(SlackPostMessageRequest{Channel: tt.channel, Text: "hi"})
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+			req.RemoteAddr = tt.remote
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rr := httptest.NewRecorder()
+			app.handleRequest(rr, req)
+			assert.Equal(t, tt.wantStatus, rr.Code)
+			var response SlackResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantError, response.Error)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, 1, app.slackQueue.Len())
+				client := map[string]string{"ci-secret": "ci", "ops-secret": "ops"}[tt.token]
+				if client == "" {
+					client = otherClient
+				}
+				assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.RequestsReceivedByClient.WithLabelValues(client)))
+			} else {
+				assert.Equal(t, 0, app.slackQueue.Len())
+			}
+		})
+	}
+}
+
+func TestHandleRequest_PolicyAudit(t *testing.T) {
+	app, auditPath := newPolicyTestApp(t)
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"channel":"#ext-acme","text":"hi"}`))
+	req.Header.Set("Authorization", "Bearer ops-secret")
+	app.handleRequest(httptest.NewRecorder(), req)
+	assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.RequestsDenied.WithLabelValues("#ext-acme", "ops")))
+
+	f, err := os.Open(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var entries []auditEntry
+	for scanner.Scan() {
+		var entry auditEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, auditReceived, entries[0].Event)
+	assert.Equal(t, auditDenied, entries[1].Event)
+	assert.Equal(t, "ops", entries[1].Client)
+	assert.Equal(t, "#ext-acme", entries[1].Channel)
+	assert.Equal(t, entries[0].MessageID, entries[1].MessageID)
+	assert.Equal(t, `denied by "#ext-*"`, entries[1].Reason)
+}
+
+func TestPolicy_Invalid(t *testing.T) {
+	_, err := parseClientTokens("ci")
+	assert.Error(t, err)
+	p := &channelPolicy{config: policyConfig{
+		Default:  &channelRule{Allow: []string{"[#"}},
+		Networks: []*networkRule{{CIDR: "10.0.0.0/33"}},
+	}}
+	err = p.check()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `policy default: invalid pattern "[#"`)
+	assert.Contains(t, err.Error(), "policy network 0:")
+}
@@ -0,0 +1,232 @@
+// queue.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// During incidents, low value chatter (build notifications,...) competes with pages for the same queue
+// and rate budget. Messages are queued in priority lanes, served either strictly by priority or in a
+// weighted round robin (so the lower lanes still progress under sustained high priority traffic).
+
+type priority int
+
+const (
+	priorityHigh priority = iota
+	priorityNormal
+	priorityLow
+	numPriorities
+)
+
+// Header setting the priority, it can also be set with the priority body field.
+const priorityHeader = "X-Priority"
+
+var priorityNames = [numPriorities]string{"high", "normal", "low"}
+
+// Share of the turns each lane gets in weighted mode, when it has messages.
+var priorityWeights = [numPriorities]int{4, 2, 1}
+
+func (p priority) String() string {
+	return priorityNames[p]
+}
+
+// parsePriority parses the priority name, empty meaning normal.
+func parsePriority(name string) (priority, error) {
+	if name == "" {
+		return priorityNormal, nil
+	}
+	for p, n := range priorityNames {
+		if strings.EqualFold(name, n) {
+			return priority(p), nil
+		}
+	}
+	return priorityNormal, fmt.Errorf("invalid priority %q, expected one of %s", name, strings.Join(priorityNames[:], ", "))
+}
+
+var (
+	errQueueFull   = errors.New("queue is full")
+	errQueueClosed = errors.New("queue is closed")
+)
+
+// messageQueue is the bounded queue of messages to post. The ingress paths reject requests a bit before
+// it is full (see queueAlmostFull) and use TryPush, so a request never waits for room. Push waits for
+// room like a send on a buffered channel, for the goroutines releasing messages (held messages, flood
+// summaries), and ForcePush never fails, for the consumer's follow ups. It is safe for concurrent use,
+// with a single consumer.
+type messageQueue struct {
+	capacity int
+	weighted bool
+	mu       sync.Mutex
+	lanes    [numPriorities][]*queuedMessage
+	schedule []priority // weighted round robin order
+	turn     int
+	closed   bool
+	notify   chan struct{}
+	space    *sync.Cond // signaled when a message is taken out, or the queue closed
+}
+
+func newMessageQueue(capacity int, weighted bool) *messageQueue {
+	q := &messageQueue{
+		capacity: capacity,
+		weighted: weighted,
+		notify:   make(chan struct{}, 1),
+	}
+	q.space = sync.NewCond(&q.mu)
+	for p, weight := range priorityWeights {
+		for range weight {
+			q.schedule = append(q.schedule, priority(p))
+		}
+	}
+	return q
+}
+
+func (q *messageQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Push adds the message to the lane of its priority, waiting while the queue is full. It fails once the
+// queue is closed.
+func (q *messageQueue) Push(msg *queuedMessage) error {
+	return q.push(msg, true)
+}
+
+// TryPush is Push without the wait, errQueueFull is returned when the queue is full. The consumer must
+// use it, as nothing would make room while it waits.
+func (q *messageQueue) TryPush(msg *queuedMessage) error {
+	return q.push(msg, false)
+}
+
+// ForcePush adds the message even when the queue is full or closed. It is only for the consumer's follow
+// ups (the other parts of the split message it just posted), which must not be lost: the queue only goes
+// over its capacity by the parts of that one message.
+func (q *messageQueue) ForcePush(msg *queuedMessage) error {
+	q.mu.Lock()
+	q.lanes[msg.Priority] = append(q.lanes[msg.Priority], msg)
+	q.mu.Unlock()
+	q.signal()
+	return nil
+}
+
+func (q *messageQueue) push(msg *queuedMessage, wait bool) error {
+	q.mu.Lock()
+	for !q.closed && q.size() >= q.capacity {
+		if !wait {
+			q.mu.Unlock()
+			return errQueueFull
+		}
+		q.space.Wait()
+	}
+	if q.closed {
+		q.mu.Unlock()
+		return errQueueClosed
+	}
+	q.lanes[msg.Priority] = append(q.lanes[msg.Priority], msg)
+	q.mu.Unlock()
+	q.signal()
+	return nil
+}
+
+// next returns the next message to post, nil if the queue is empty.
+func (q *messageQueue) next() *queuedMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	lane := priority(-1)
+	if q.weighted {
+		for i := range q.schedule {
+			p := q.schedule[(q.turn+i)%len(q.schedule)]
+			if len(q.lanes[p]) > 0 {
+				lane = p
+				q.turn = (q.turn + i + 1) % len(q.schedule)
+				break
+			}
+		}
+	} else {
+		for p := range numPriorities {
+			if len(q.lanes[p]) > 0 {
+				lane = p
+				break
+			}
+		}
+	}
+	if lane < 0 {
+		return nil
+	}
+	msg := q.lanes[lane][0]
+	q.lanes[lane][0] = nil
+	q.lanes[lane] = q.lanes[lane][1:]
+	q.space.Signal()
+	return msg
+}
+
+// Pop waits for the next message. It returns false once the queue is closed and empty, or when the
+// context is canceled.
+func (q *messageQueue) Pop(ctx context.Context) (*queuedMessage, bool) {
+	for {
+		if msg := q.next(); msg != nil {
+			return msg, true
+		}
+		q.mu.Lock()
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			return nil, false
+		}
+		select {
+		case <-q.notify:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// Close makes Pop return false once the remaining messages are consumed.
+func (q *messageQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.space.Broadcast()
+	q.mu.Unlock()
+	q.signal()
+}
+
+// Len returns the number of queued messages, all lanes included.
+func (q *messageQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size()
+}
+
+// size is Len, with the lock held.
+func (q *messageQueue) size() int {
+	n := 0
+	for _, lane := range q.lanes {
+		n += len(lane)
+	}
+	return n
+}
+
+// LaneLen returns the number of queued messages of the given priority.
+func (q *messageQueue) LaneLen(p priority) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.lanes[p])
+}
+
+// Cap returns the capacity of the queue.
+func (q *messageQueue) Cap() int {
+	return q.capacity
+}
+
+// updateQueueSize sets the per lane queue size gauges.
+func (app *App) updateQueueSize() {
+	for p := range numPriorities {
+		app.metrics.QueueSize.WithLabelValues(p.String()).Set(float64(app.slackQueue.LaneLen(p)))
+	}
+}
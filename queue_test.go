@@ -0,0 +1,132 @@
+// queue_test.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func pushPriorities(q *messageQueue, priorities string) {
+	for i, c := range priorities {
+		p := map[rune]priority{'h': priorityHigh, 'n': priorityNormal, 'l': priorityLow}[c]
+		q.Push(&queuedMessage{ID: fmt.Sprintf("%c%d", c, i), Priority: p})
+	}
+}
+
+func popAll(q *messageQueue) string {
+	order := ""
+	for msg := q.next(); msg != nil; msg = q.next() {
+		order += msg.ID[:1]
+	}
+	return order
+}
+
+func TestMessageQueue_Strict(t *testing.T) {
+	q := newMessageQueue(20, false)
+	pushPriorities(q, "lnhlnhh")
+	assert.Equal(t, 7, q.Len())
+	assert.Equal(t, 2, q.LaneLen(priorityLow))
+	assert.Equal(t, "hhhnnll", popAll(q))
+}
+
+func TestMessageQueue_Weighted(t *testing.T) {
+	q := newMessageQueue(20, true)
+	pushPriorities(q, "hhhhhhhhnnnnll")
+	// 4 high, 2 normal, 1 low per round, lanes without messages are skipped.
+	assert.Equal(t, "hhhhnnlhhhhnnl", popAll(q))
+}
+
+func TestMessageQueue_Pop(t *testing.T) {
+	q := newMessageQueue(2, false)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Push(&queuedMessage{ID: "late"})
+		q.Close()
+	}()
+	msg, ok := q.Pop(context.Background())
+	assert.True(t, ok)
+	assert.Equal(t, "late", msg.ID)
+	_, ok = q.Pop(context.Background())
+	assert.False(t, ok, "closed and empty")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, ok = newMessageQueue(2, false).Pop(ctx)
+	assert.False(t, ok, "canceled")
+}
+
+func TestMessageQueue_Capacity(t *testing.T) {
+	q := newMessageQueue(1, false)
+	assert.NoError(t, q.TryPush(&queuedMessage{ID: "first"}))
+	assert.Equal(t, errQueueFull, q.TryPush(&queuedMessage{ID: "second"}))
+	pushed := make(chan error)
+	go func() {
+		pushed <- q.Push(&queuedMessage{ID: "second"})
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("Push didn't wait for room")
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.Equal(t, "first", q.next().ID)
+	assert.NoError(t, <-pushed)
+	go func() {
+		pushed <- q.Push(&queuedMessage{ID: "third"})
+	}()
+	q.Close()
+	assert.Equal(t, errQueueClosed, <-pushed, "waiting pushes fail once the queue is closed")
+	assert.Equal(t, 1, q.Len())
+
+	// The ingress paths are rejected rather than waiting, processQueue's own follow ups are always queued,
+	// even once the queue is closed.
+	app := &App{
+		slackQueue: newMessageQueue(1, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+	}
+	app.push(newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Text: "part 1"}, ""))
+	app.pushFollowUp(newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Text: "part 2"}, ""))
+	assert.Equal(t, errQueueFull, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Text: "other"}, "")))
+	app.slackQueue.Close()
+	app.pushFollowUp(newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Text: "part 3"}, ""))
+	assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.QueueOverflow.WithLabelValues("#c")))
+	assert.Equal(t, 3, app.slackQueue.Len())
+}
+
+func TestHandleRequest_Priority(t *testing.T) {
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+	}
+	post := func(body string, header map[string]string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		app.handleRequest(rr, req)
+		return rr.Code
+	}
+	for range 9 {
+		assert.Equal(t, http.StatusOK, post(`{"channel":"#builds","text":"build ok","priority":"low"}`, nil))
+	}
+	// 90% full: only the high priority messages get in, up to the full capacity.
+	assert.Equal(t, http.StatusServiceUnavailable, post(`{"channel":"#builds","text":"build ok"}`, nil))
+	assert.Equal(t, http.StatusOK, post(`{"channel":"#pages","text":"down"}`, map[string]string{priorityHeader: "High"}))
+	assert.Equal(t, http.StatusServiceUnavailable, post(`{"channel":"#pages","text":"down","priority":"high"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, post(`{"channel":"#pages","text":"down","priority":"urgent"}`, nil))
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.QueueSize.WithLabelValues("high")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(app.metrics.QueueSize.WithLabelValues("normal")))
+	assert.Equal(t, 9.0, testutil.ToFloat64(app.metrics.QueueSize.WithLabelValues("low")))
+	assert.Equal(t, "#pages", app.slackQueue.next().Request.Channel, "high priority first")
+}
@@ -0,0 +1,476 @@
+// quiet.go
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/jrpc"
+	"fortio.org/log"
+)
+
+// Quiet hours (recurring, per time zone) and maintenance windows (one-off, from the config file or
+// opened through the admin api) hold, downgrade or drop the messages of the channels they match. Held
+// messages are posted as a digest once the channel isn't held anymore.
+
+const (
+	quietHold      = "hold"
+	quietDowngrade = "downgrade"
+	quietDrop      = "drop"
+)
+
+// Default maximum number of messages held per channel, see quietSuppressor.maxHeld.
+const defaultMaxHeld = 1000
+
+// errHeldFull is returned when a channel already holds maxHeld messages.
+var errHeldFull = errors.New("too many held messages")
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// quietRule is a recurring window, e.g. 22:00 to 07:00 (the next day) in Europe/Paris on weekdays.
+type quietRule struct {
+	Channels []string `json:"channels"` // glob patterns
+	Timezone string   `json:"timezone,omitempty"`
+	Days     []string `json:"days,omitempty"` // days the window starts on, all if empty
+	Start    string   `json:"start"`          // HH:MM
+	End      string   `json:"end"`            // HH:MM
+	Action   string   `json:"action"`
+	loc      *time.Location
+	start    int // minutes since midnight
+	end      int
+}
+
+// maintenanceWindow is a one-off window.
+type maintenanceWindow struct {
+	ID       string    `json:"id"`
+	Channels []string  `json:"channels"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Action   string    `json:"action"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// quietConfig is the json config file.
+type quietConfig struct {
+	QuietHours  []*quietRule         `json:"quiet_hours,omitempty"`
+	Maintenance []*maintenanceWindow `json:"maintenance,omitempty"`
+}
+
+func loadQuietConfig(configPath string) (*quietConfig, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var config quietConfig
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, config.check()
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func checkQuietAction(action string) error {
+	if action != quietHold && action != quietDowngrade && action != quietDrop {
+		return fmt.Errorf("invalid action %q, expected %s, %s or %s", action, quietHold, quietDowngrade, quietDrop)
+	}
+	return nil
+}
+
+func checkChannelPatterns(patterns []string) error {
+	if len(patterns) == 0 {
+		return errors.New("channels is not set")
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (c *quietConfig) check() error {
+	var errs []error
+	for i, rule := range c.QuietHours {
+		wrap := func(err error) {
+			if err != nil {
+				errs = append(errs, fmt.Errorf("quiet hours %d: %w", i, err))
+			}
+		}
+		wrap(checkChannelPatterns(rule.Channels))
+		wrap(checkQuietAction(rule.Action))
+		var err error
+		rule.loc, err = time.LoadLocation(rule.Timezone) // "" is UTC
+		wrap(err)
+		rule.start, err = parseClock(rule.Start)
+		wrap(err)
+		rule.end, err = parseClock(rule.End)
+		wrap(err)
+		for _, day := range rule.Days {
+			if !slices.Contains(weekdays, strings.ToLower(day)) {
+				wrap(fmt.Errorf("invalid day %q", day))
+			}
+		}
+	}
+	for i, window := range c.Maintenance {
+		if err := window.check(); err != nil {
+			errs = append(errs, fmt.Errorf("maintenance %d: %w", i, err))
+		}
+		if window.ID == "" {
+			window.ID = fmt.Sprintf("config-%d", i)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (w *maintenanceWindow) check() error {
+	err := errors.Join(checkChannelPatterns(w.Channels), checkQuietAction(w.Action))
+	if !w.End.After(w.Start) {
+		err = errors.Join(err, errors.New("end must be after start"))
+	}
+	return err
+}
+
+func matchesChannel(patterns []string, names ...string) bool {
+	for _, pattern := range patterns {
+		for _, name := range names {
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *quietRule) startsOn(day time.Weekday) bool {
+	return len(r.Days) == 0 || slices.ContainsFunc(r.Days, func(d string) bool {
+		return strings.EqualFold(d, weekdays[day])
+	})
+}
+
+// active returns true if now is within the window. Windows ending before they start span midnight.
+func (r *quietRule) active(now time.Time) bool {
+	local := now.In(r.loc)
+	minutes := local.Hour()*60 + local.Minute()
+	if r.start < r.end {
+		return r.startsOn(local.Weekday()) && minutes >= r.start && minutes < r.end
+	}
+	return (r.startsOn(local.Weekday()) && minutes >= r.start) ||
+		(r.startsOn(local.AddDate(0, 0, -1).Weekday()) && minutes < r.end)
+}
+
+type heldMessages struct {
+	reason   string
+	messages []*queuedMessage
+}
+
+// quietSuppressor is safe for concurrent use, a nil quietSuppressor doesn't suppress anything.
+type quietSuppressor struct {
+	mu      sync.Mutex
+	rules   []*quietRule
+	windows []*maintenanceWindow
+	held    map[string]*heldMessages // by channel
+	// Held messages don't take room in the queue, this bounds the memory they use during a long window.
+	maxHeld int
+	now     func() time.Time // for tests
+}
+
+func newQuietSuppressor(config *quietConfig) *quietSuppressor {
+	q := &quietSuppressor{
+		held:    make(map[string]*heldMessages),
+		maxHeld: defaultMaxHeld,
+		now:     time.Now,
+	}
+	if config != nil {
+		q.rules = config.QuietHours
+		q.windows = config.Maintenance
+	}
+	return q
+}
+
+// action returns what to do with messages for the channel right now (empty if nothing) and why.
+func (q *quietSuppressor) action(names ...string) (string, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	// Maintenance windows are more specific, so they win over the quiet hours.
+	for _, window := range q.windows {
+		if !now.Before(window.Start) && now.Before(window.End) && matchesChannel(window.Channels, names...) {
+			reason := "maintenance"
+			if window.Reason != "" {
+				reason += ": " + window.Reason
+			}
+			return window.Action, reason
+		}
+	}
+	for _, rule := range q.rules {
+		if rule.active(now) && matchesChannel(rule.Channels, names...) {
+			return rule.Action, "quiet hours"
+		}
+	}
+	return "", ""
+}
+
+// suppress applies the quiet hours and maintenance windows to the message. It returns true if the
+// message was held or dropped, in which case it must not be queued. Like a full queue, a channel already
+// holding maxHeld messages drops the message (counted as overflow) and errHeldFull is returned, for the
+// caller to reject the request.
+func (q *quietSuppressor) suppress(app *App, msg *queuedMessage) (bool, error) {
+	if q == nil {
+		return false, nil
+	}
+	channel := msg.Request.Channel
+	label := app.channelLabel(channel)
+	action, reason := q.action(channel, label)
+	switch action {
+	case quietHold:
+		q.mu.Lock()
+		held := q.held[channel]
+		if held == nil {
+			held = &heldMessages{reason: reason}
+			q.held[channel] = held
+		}
+		full := len(held.messages) >= q.maxHeld
+		if !full {
+			held.messages = append(held.messages, msg)
+		}
+		q.mu.Unlock()
+		if full {
+			log.S(log.Error, "Dropping message", log.Any("err", errHeldFull), log.String("channel", label),
+				log.String("message_id", msg.ID), log.Int("held", q.maxHeld))
+			app.metrics.QueueOverflow.WithLabelValues(label).Inc()
+			app.recordOutcome(msg, deliveryResult{Outcome: outcomeFailed, Error: errHeldFull.Error()})
+			return true, errHeldFull
+		}
+	case quietDowngrade:
+		msg.Priority = priorityLow
+	case quietDrop:
+		log.S(log.Info, "Dropping message", log.String("channel", label), log.String("reason", reason),
+			log.String("message_id", msg.ID))
+		app.recordOutcome(msg, deliveryResult{Outcome: outcomeSuppressed, Error: reason})
+	default:
+		return false, nil
+	}
+	app.metrics.RequestsSuppressed.WithLabelValues(label, action).Inc()
+	return action != quietDowngrade, nil
+}
+
+// releasable removes and returns the held messages of the channels not held anymore, all of them if
+// all is true.
+func (q *quietSuppressor) releasable(app *App, all bool) map[string]*heldMessages {
+	q.mu.Lock()
+	channels := make([]string, 0, len(q.held))
+	for channel := range q.held {
+		channels = append(channels, channel)
+	}
+	q.mu.Unlock()
+	released := make(map[string]*heldMessages)
+	for _, channel := range channels {
+		if !all {
+			if action, _ := q.action(channel, app.channelLabel(channel)); action == quietHold {
+				continue
+			}
+		}
+		q.mu.Lock()
+		released[channel] = q.held[channel]
+		delete(q.held, channel)
+		q.mu.Unlock()
+	}
+	return released
+}
+
+// release queues the held messages of the channels not held anymore (all of them on shutdown), merged
+// into digests.
+func (q *quietSuppressor) release(app *App, all bool) {
+	if q == nil {
+		return
+	}
+	for channel, held := range q.releasable(app, all) {
+		messages := heldDigests(held, app.auditMerged)
+		log.S(log.Info, "Releasing held messages", log.String("channel", app.channelLabel(channel)),
+			log.Int("held", len(held.messages)), log.Int("messages", len(messages)))
+		for _, msg := range messages {
+			app.push(msg)
+		}
+	}
+}
+
+// heldDigests merges the held text messages into as few digests as the text limit allows, the others
+// are posted as they are. merged is called for each message merged into another one.
+func heldDigests(held *heldMessages, merged func(msg, digest *queuedMessage)) []*queuedMessage {
+	var result []*queuedMessage
+	var digest *queuedMessage
+	var texts []string
+	length := 0
+	flush := func() {
+		if digest == nil {
+			return
+		}
+		if len(texts) > 1 {
+			digest.Request.Text = fmt.Sprintf(":zzz: *%d messages held during %s*%s%s",
+				len(texts), held.reason, digestSeparator, strings.Join(texts, digestSeparator))
+		}
+		result = append(result, digest)
+		digest, texts, length = nil, nil, 0
+	}
+	maxLength := slackMaxTextLength - 128 // room for the header
+	for _, msg := range held.messages {
+		if !digestible(msg) {
+			result = append(result, msg)
+			continue
+		}
+		if digest != nil && (length+len(digestSeparator)+len(msg.Request.Text) > maxLength ||
+			digestSender(msg) != digestSender(digest)) {
+			flush()
+		}
+		if digest == nil {
+			digest = msg
+			length = len(msg.Request.Text)
+		} else {
+			length += len(digestSeparator) + len(msg.Request.Text)
+			digest.Priority = min(digest.Priority, msg.Priority)
+			mergeExpiry(digest, msg)
+			merged(msg, digest)
+		}
+		texts = append(texts, msg.Request.Text)
+	}
+	flush()
+	return result
+}
+
+// ReleaseEvery releases the held messages once their channel isn't held anymore, until the context is
+// canceled.
+func (q *quietSuppressor) ReleaseEvery(ctx context.Context, app *App, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.release(app, false)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Maintenance returns the current and future maintenance windows, dropping the past ones.
+func (q *quietSuppressor) Maintenance() []*maintenanceWindow {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	q.windows = slices.DeleteFunc(q.windows, func(w *maintenanceWindow) bool { return !now.Before(w.End) })
+	return slices.Clone(q.windows)
+}
+
+// AddMaintenance opens a maintenance window.
+func (q *quietSuppressor) AddMaintenance(window *maintenanceWindow) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.windows = append(q.windows, window)
+}
+
+// EndMaintenance closes the window now, returning false if there is no such window.
+func (q *quietSuppressor) EndMaintenance(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, window := range q.windows {
+		if window.ID == id && q.now().Before(window.End) {
+			window.End = q.now()
+			return true
+		}
+	}
+	return false
+}
+
+// maintenanceRequest is what POST /admin/maintenance expects.
+type maintenanceRequest struct {
+	Channel  string `json:"channel"` // glob pattern
+	Duration string `json:"duration"`
+	Action   string `json:"action,omitempty"` // hold by default
+	Reason   string `json:"reason,omitempty"`
+}
+
+// handleMaintenance lists (GET) or opens (POST) maintenance windows.
+func (app *App) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !app.requireAdmin(w, r) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		windows := app.quiet.Maintenance()
+		if err := jrpc.Reply(w, http.StatusOK, &windows); err != nil {
+			log.S(log.Error, "Failed to write response", log.Any("err", err))
+		}
+		return
+	}
+	var request maintenanceRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	var duration time.Duration
+	if err == nil {
+		duration, err = time.ParseDuration(request.Duration)
+	}
+	if request.Action == "" {
+		request.Action = quietHold
+	}
+	now := app.quiet.now()
+	id := make([]byte, 8)
+	_, _ = rand.Read(id) // never returns an error
+	window := &maintenanceWindow{
+		ID:       hex.EncodeToString(id),
+		Channels: []string{request.Channel},
+		Start:    now,
+		End:      now.Add(duration),
+		Action:   request.Action,
+		Reason:   request.Reason,
+	}
+	if err == nil {
+		err = window.check()
+	}
+	if err != nil {
+		reply(w, http.StatusBadRequest, &SlackResponse{
+			Ok:    false,
+			Error: err.Error(),
+		})
+		return
+	}
+	app.quiet.AddMaintenance(window)
+	log.S(log.Info, "Maintenance window opened", log.String("channel", request.Channel), log.String("action", window.Action),
+		log.String("end", window.End.Format(time.RFC3339)), log.String("reason", window.Reason))
+	if err = jrpc.Reply(w, http.StatusOK, window); err != nil {
+		log.S(log.Error, "Failed to write response", log.Any("err", err))
+	}
+}
+
+// handleEndMaintenance closes (DELETE /admin/maintenance/{id}) a maintenance window early.
+func (app *App) handleEndMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !app.requireAdmin(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+	if !app.quiet.EndMaintenance(id) {
+		reply(w, http.StatusNotFound, &SlackResponse{
+			Ok:    false,
+			Error: "No open maintenance window with id " + id,
+		})
+		return
+	}
+	log.S(log.Info, "Maintenance window closed", log.String("id", id))
+	reply(w, http.StatusOK, &SlackResponse{Ok: true})
+}
@@ -0,0 +1,201 @@
+// quiet_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQuietRule_Active(t *testing.T) {
+	config := &quietConfig{QuietHours: []*quietRule{
+		{Channels: []string{"*"}, Timezone: "Europe/Paris", Days: []string{"fri"}, Start: "22:00", End: "07:00", Action: quietHold},
+		{Channels: []string{"*"}, Start: "12:00", End: "13:00", Action: quietHold},
+	}}
+	assert.NoError(t, config.check())
+	overnight, lunch := config.QuietHours[0], config.QuietHours[1]
+	tests := []struct {
+		name string
+		rule *quietRule
+		now  time.Time
+		want bool
+	}{
+		{"friday evening", overnight, time.Date(2026, 10, 16, 20, 30, 0, 0, time.UTC), true}, // 22:30 in Paris
+		{"friday before", overnight, time.Date(2026, 10, 16, 19, 0, 0, 0, time.UTC), false},
+		{"saturday morning", overnight, time.Date(2026, 10, 17, 4, 0, 0, 0, time.UTC), true},
+		{"saturday after", overnight, time.Date(2026, 10, 17, 5, 0, 0, 0, time.UTC), false},
+		{"sunday morning", overnight, time.Date(2026, 10, 18, 4, 0, 0, 0, time.UTC), false},
+		{"lunch", lunch, time.Date(2026, 10, 18, 12, 30, 0, 0, time.UTC), true},
+		{"after lunch", lunch, time.Date(2026, 10, 18, 13, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.rule.active(tt.now))
+		})
+	}
+}
+
+func TestQuietConfig_Check(t *testing.T) {
+	config := &quietConfig{
+		QuietHours: []*quietRule{{Channels: []string{"#a"}, Start: "25:00", End: "07:00", Action: "mute", Days: []string{"someday"}}},
+		Maintenance: []*maintenanceWindow{{
+			Channels: []string{"["}, Action: quietDrop, Start: time.Now(), End: time.Now().Add(-time.Hour),
+		}},
+	}
+	err := config.check()
+	assert.Error(t, err)
+	for _, want := range []string{
+		`invalid action "mute"`, `invalid time "25:00"`, `invalid day "someday"`, `invalid pattern "["`, "end must be after start",
+	} {
+		assert.Contains(t, err.Error(), want)
+	}
+}
+
+func TestQuietHours_Suppress(t *testing.T) {
+	now := time.Date(2026, 10, 18, 23, 0, 0, 0, time.UTC)
+	config := &quietConfig{
+		QuietHours: []*quietRule{
+			{Channels: []string{"#team-*"}, Start: "22:00", End: "07:00", Action: quietHold},
+			{Channels: []string{"#noise"}, Start: "22:00", End: "07:00", Action: quietDrop},
+			{Channels: []string{"#ops"}, Start: "22:00", End: "07:00", Action: quietDowngrade},
+		},
+		Maintenance: []*maintenanceWindow{{
+			Channels: []string{"#team-db"}, Start: now.Add(-time.Hour), End: now.Add(time.Hour), Action: quietDrop, Reason: "upgrade",
+		}},
+	}
+	assert.NoError(t, config.check())
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		quiet:      newQuietSuppressor(config),
+	}
+	app.quiet.now = func() time.Time { return now }
+	for _, m := range []struct{ channel, text string }{
+		{"#team-web", "first"},
+		{"#team-web", "second"},
+		{"#team-db", "maintenance wins"},
+		{"#noise", "dropped"},
+		{"#ops", "downgraded"},
+		{"#other", "posted"},
+	} {
+		assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: m.channel, Text: m.text}, "")))
+	}
+	// Past the limit, the messages are rejected like when the queue is full.
+	app.quiet.maxHeld = 2
+	assert.Equal(t, errHeldFull, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#team-web", Text: "third"}, "")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.QueueOverflow.WithLabelValues("#team-web")))
+	assert.Equal(t, 2, app.slackQueue.Len())
+	assert.Equal(t, "posted", app.slackQueue.next().Request.Text)
+	downgraded := app.slackQueue.next()
+	assert.Equal(t, "downgraded", downgraded.Request.Text)
+	assert.Equal(t, priorityLow, downgraded.Priority)
+	assert.Equal(t, 2.0, testutil.ToFloat64(app.metrics.RequestsSuppressed.WithLabelValues("#team-web", quietHold)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.RequestsSuppressed.WithLabelValues("#team-db", quietDrop)))
+
+	app.quiet.release(app, false)
+	assert.Equal(t, 0, app.slackQueue.Len(), "still quiet hours")
+	now = now.Add(9 * time.Hour)
+	app.quiet.release(app, false)
+	assert.Equal(t, 1, app.slackQueue.Len())
+	assert.Equal(t, ":zzz: *2 messages held during quiet hours*\n\nfirst\n\nsecond", app.slackQueue.next().Request.Text)
+}
+
+func TestHeldDigests(t *testing.T) {
+	held := &heldMessages{reason: "maintenance"}
+	long := strings.Repeat("x", slackMaxTextLength/2)
+	for _, text := range []string{"a", long, long, "b"} {
+		held.messages = append(held.messages, newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Text: text}, ""))
+	}
+	blocks := newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Blocks: json.RawMessage(`[]`)}, "")
+	held.messages = append(held.messages, blocks)
+	held.messages[3].Priority = priorityHigh
+	merged := map[*queuedMessage]*queuedMessage{}
+	messages := heldDigests(held, func(msg, digest *queuedMessage) { merged[msg] = digest })
+	assert.Equal(t, 3, len(messages))
+	assert.True(t, strings.HasPrefix(messages[0].Request.Text, ":zzz: *2 messages held during maintenance*\n\na\n\nxxx"))
+	assert.True(t, blocks == messages[1], "not digestible, posted as is")
+	assert.True(t, strings.HasPrefix(messages[2].Request.Text, ":zzz: *2 messages held during maintenance*\n\nxxx"))
+	assert.True(t, strings.HasSuffix(messages[2].Request.Text, "xxx\n\nb"))
+	assert.Equal(t, priorityHigh, messages[2].Priority, "highest priority of the merged messages")
+	assert.Equal(t, 2, len(merged))
+	assert.True(t, merged[held.messages[1]] == messages[0], "merged into the first digest")
+	assert.True(t, merged[held.messages[3]] == messages[2], "merged into the second digest")
+	for _, msg := range []*queuedMessage{messages[0], messages[2]} {
+		assert.True(t, len(msg.Request.Text) <= slackMaxTextLength, "digest too long")
+	}
+
+	held = &heldMessages{reason: "maintenance"}
+	for _, username := range []string{"", "", "bot", ""} {
+		held.messages = append(held.messages, newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Text: "x", Username: username}, ""))
+	}
+	messages = heldDigests(held, func(*queuedMessage, *queuedMessage) {})
+	assert.Equal(t, 3, len(messages), "only merged with the messages posted the same way")
+	assert.Equal(t, "bot", messages[1].Request.Username)
+}
+
+func TestMaintenanceAPI(t *testing.T) {
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		quiet:      newQuietSuppressor(nil),
+		policy: &channelPolicy{
+			tokens: map[string]string{"ops": "s3cret", "ci": "other"},
+			config: policyConfig{Admins: []string{"ops"}},
+		},
+	}
+	call := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		if method == http.MethodDelete {
+			req.SetPathValue("id", strings.TrimPrefix(target, "/admin/maintenance/"))
+			app.handleEndMaintenance(rr, req)
+		} else {
+			app.handleMaintenance(rr, req)
+		}
+		return rr
+	}
+	body := `{"channel":"#db-*","duration":"1h","reason":"failover"}`
+	assert.Equal(t, http.StatusForbidden, call(http.MethodPost, "/admin/maintenance", "", body).Code)
+	assert.Equal(t, http.StatusForbidden, call(http.MethodPost, "/admin/maintenance", "other", body).Code)
+	assert.Equal(t, http.StatusForbidden, call(http.MethodPost, "/admin/maintenance", "wrong", body).Code, "anonymous")
+	assert.Equal(t, http.StatusBadRequest,
+		call(http.MethodPost, "/admin/maintenance", "s3cret", `{"channel":"#db","duration":"soon"}`).Code)
+	rr := call(http.MethodPost, "/admin/maintenance", "s3cret", body)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var window maintenanceWindow
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&window))
+	assert.Equal(t, quietHold, window.Action)
+
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#db-main", Text: "held"}, "")))
+	assert.Equal(t, 0, app.slackQueue.Len())
+
+	rr = call(http.MethodGet, "/admin/maintenance", "s3cret", "")
+	var windows []maintenanceWindow
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&windows))
+	assert.Equal(t, 1, len(windows))
+	assert.Equal(t, "failover", windows[0].Reason)
+
+	assert.Equal(t, http.StatusOK, call(http.MethodDelete, "/admin/maintenance/"+window.ID, "s3cret", "").Code)
+	assert.Equal(t, http.StatusNotFound, call(http.MethodDelete, "/admin/maintenance/"+window.ID, "s3cret", "").Code)
+	app.quiet.release(app, false)
+	assert.Equal(t, "held", app.slackQueue.next().Request.Text)
+
+	// Without admins in the policy (or without a policy), nobody can mute channels.
+	app.policy.config.Admins = nil
+	assert.Equal(t, http.StatusForbidden, call(http.MethodPost, "/admin/maintenance", "s3cret", body).Code)
+	app.policy = nil
+	assert.Equal(t, http.StatusForbidden, call(http.MethodPost, "/admin/maintenance", "", body).Code)
+	assert.Equal(t, 0, len(app.quiet.Maintenance()))
+}
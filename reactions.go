@@ -0,0 +1,291 @@
+// reactions.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Reactions mark a message the proxy posted (e.g. :white_check_mark: once an alert is resolved) instead
+// of posting another one. The message is referenced by its message id (the receipt) or by its
+// correlation key (the thread root), resolved to the Slack channel and ts recorded when it was posted.
+
+// slackReaction is a reaction to add (or remove), queued like messages (see queuedMessage.reaction).
+type slackReaction struct {
+	Name   string // emoji name, without colons
+	TS     string
+	Remove bool
+}
+
+// SlackReactor is implemented by the messengers able to add and remove reactions.
+type SlackReactor interface {
+	React(ctx context.Context, reaction *slackReaction, channel, url, token string) (SlackResponse, error)
+}
+
+// errReactionsNotSupported is returned, as a permanent error, when the messenger can't react.
+var errReactionsNotSupported = errors.New("reactions_not_supported")
+
+type postedEntry struct {
+	Channel string // id
+	TS      string
+	Posted  time.Time
+	Client  string
+	// The channel as requested, before the override and resolution, which the policy applies to.
+	Requested string
+}
+
+// postedStore remembers where the messages were posted, by message id, for the reactions. It also learns
+// the channel ids, which the reactions API requires, from the responses. Entries expire after the ttl.
+// It is safe for concurrent use, and a nil store records nothing.
+type postedStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	messages  map[string]postedEntry
+	channels  map[string]string // as requested to id
+	nextPrune time.Time
+	now       func() time.Time // for tests
+}
+
+func newPostedStore(ttl time.Duration) *postedStore {
+	return &postedStore{
+		ttl:      ttl,
+		messages: make(map[string]postedEntry),
+		channels: make(map[string]string),
+		now:      time.Now,
+	}
+}
+
+// Record remembers the message after a successful post.
+func (s *postedStore) Record(msg *queuedMessage, response SlackResponse) {
+	if s == nil || msg.upload != nil || msg.reaction != nil || response.TS == "" {
+		return
+	}
+	channel := response.Channel
+	if channel == "" {
+		channel = msg.Request.Channel
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.After(s.nextPrune) {
+		for id, entry := range s.messages {
+			if now.Sub(entry.Posted) >= s.ttl {
+				delete(s.messages, id)
+			}
+		}
+		s.nextPrune = now.Add(s.ttl / 2)
+	}
+	requested := msg.Request.Channel
+	if msg.accepted != nil {
+		requested = msg.accepted.Channel
+	}
+	s.messages[msg.ID] = postedEntry{Channel: channel, TS: response.TS, Posted: now, Client: msg.Client, Requested: requested}
+	s.channels[msg.Request.Channel] = channel
+}
+
+// Message returns where the message was posted, false if it wasn't (yet) or is too old.
+func (s *postedStore) Message(id string) (postedEntry, bool) {
+	if s == nil {
+		return postedEntry{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, found := s.messages[id]
+	if !found || s.now().Sub(entry.Posted) >= s.ttl {
+		return postedEntry{}, false
+	}
+	return entry, true
+}
+
+// ChannelID returns the id of the channel if a message was posted to it, the channel as is otherwise.
+func (s *postedStore) ChannelID(channel string) string {
+	if s == nil {
+		return channel
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id := s.channels[channel]; id != "" {
+		return id
+	}
+	return channel
+}
+
+// reactionRequest references the message either by message_id or by channel and thread_key.
+type reactionRequest struct {
+	Name      string `json:"name"`
+	MessageID string `json:"message_id,omitempty"`
+	Channel   string `json:"channel,omitempty"`
+	ThreadKey string `json:"thread_key,omitempty"`
+	Priority  string `json:"priority,omitempty"`
+}
+
+// reactionChannel returns the channel the reaction is authorized against, before resolving it (so the
+// callers not allowed to a channel can't learn which messages or threads it has): the one of the message
+// as it was requested, or the one the caller names. With the policy enabled, the messages are only found
+// by the client which posted them (and the admins), the anonymous callers use the thread keys.
+func (app *App) reactionChannel(request *reactionRequest, authenticated string) (string, error) {
+	if request.MessageID == "" {
+		return request.Channel, nil
+	}
+	entry, found := app.posted.Message(request.MessageID)
+	if found && app.policy != nil && !slices.Contains(app.policy.config.Admins, authenticated) &&
+		(authenticated == "" || entry.Client != authenticated) {
+		found = false // the same as unknown ones, not to tell they exist
+	}
+	if !found {
+		return "", fmt.Errorf("message %s not found (not posted yet or too old)", request.MessageID)
+	}
+	return entry.Requested, nil
+}
+
+// resolveReaction returns the channel and ts of the referenced message, an error if it can't be found.
+func (app *App) resolveReaction(request *reactionRequest) (string, string, error) {
+	switch {
+	case request.MessageID != "":
+		entry, found := app.posted.Message(request.MessageID)
+		if !found {
+			return "", "", fmt.Errorf("message %s not found (not posted yet or too old)", request.MessageID)
+		}
+		return entry.Channel, entry.TS, nil
+	case request.Channel != "" && request.ThreadKey != "":
+		// The threads are recorded in the channels the messages were posted to: after the routing aliases,
+		// the override and the channel resolution (see enqueue). The first one with the thread wins.
+		for _, channel := range app.aliasChannels(request.Channel) {
+			if app.channelOverride != "" {
+				channel = app.channelOverride
+			}
+			if app.channels != nil {
+				channel, _, _ = app.channels.Resolve(channel)
+			}
+			if app.threads == nil {
+				break
+			}
+			if ts := app.threads.Get(channel, request.ThreadKey); ts != "" {
+				return app.posted.ChannelID(channel), ts, nil
+			}
+		}
+		return "", "", fmt.Errorf("no thread for key %s in %s", request.ThreadKey, request.Channel)
+	}
+	return "", "", errors.New("either message_id or channel and thread_key must be set")
+}
+
+// handleReaction returns the handler adding (or removing) a reaction to a posted message.
+func (app *App) handleReaction(remove bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w, span, end := app.traceRequest(w, r, "handleReaction")
+		defer end()
+		authenticated := app.authenticate(r)
+		client := clientName(r)
+		if authenticated != "" {
+			client = authenticated
+		}
+
+		var request reactionRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if key := r.Header.Get(threadKeyHeader); key != "" {
+			request.ThreadKey = key
+		}
+		request.Name = strings.Trim(request.Name, ":")
+		if err == nil && request.Name == "" {
+			err = errors.New("name is not set")
+		}
+		if err == nil && request.MessageID == "" && (request.Channel == "" || request.ThreadKey == "") {
+			err = errors.New("either message_id or channel and thread_key must be set")
+		}
+		method := "reactions.add"
+		if remove {
+			method = "reactions.remove"
+		}
+		prio := priorityNormal
+		if err == nil {
+			prio, err = requestPriority(r, request.Priority)
+		}
+		if err != nil {
+			log.S(log.Error, "Invalid reaction request", log.Any("err", err))
+			app.auditRejected(r.RemoteAddr, method, client, request.Channel, "", err.Error())
+			reply(w, http.StatusBadRequest, &SlackResponse{Ok: false, Error: err.Error()})
+			return
+		}
+		notFound := func(id string, err error) {
+			log.S(log.Info, "Message to react to not found", log.Any("err", err), log.String("client", client))
+			app.auditRejected(r.RemoteAddr, method, client, request.Channel, id, err.Error())
+			reply(w, http.StatusNotFound, &SlackResponse{Ok: false, Error: err.Error()})
+		}
+		requested, err := app.reactionChannel(&request, authenticated)
+		if err != nil {
+			notFound("", err)
+			return
+		}
+
+		msg := newQueuedMessage(SlackPostMessageRequest{Channel: requested}, client)
+		msg.Priority = prio
+		msg.spanContext = span.SpanContext()
+		span.SetAttributes(attribute.String("slack_proxy.message_id", msg.ID), attribute.String("slack_proxy.client", client),
+			attribute.String("slack_proxy.channel", app.channelLabel(requested)))
+		app.auditMessage(msg, auditEntry{Event: auditReceived, Remote: r.RemoteAddr})
+		if !app.authorize(w, r, authenticated, []*queuedMessage{msg}) {
+			return
+		}
+		channel, ts, err := app.resolveReaction(&request)
+		if err != nil {
+			notFound(msg.ID, err)
+			return
+		}
+		if app.queueAlmostFull(prio, 1) {
+			app.auditRejected(r.RemoteAddr, method, client, requested, msg.ID, "Queue is almost full")
+			reply(w, http.StatusServiceUnavailable, &SlackResponse{Ok: false, Error: "Queue is almost full"})
+			return
+		}
+		msg.Request.Channel = channel
+		msg.reaction = &slackReaction{Name: request.Name, TS: ts, Remove: remove}
+		log.S(log.Info, "Queuing reaction", log.String("channel", channel), log.String("ts", ts),
+			log.String("name", request.Name), log.Any("remove", remove), log.String("message_id", msg.ID))
+		if err := app.enqueue(msg); err != nil {
+			reply(w, http.StatusServiceUnavailable, &SlackResponse{Ok: false, Error: "Queue is full"})
+			return
+		}
+		reply(w, http.StatusOK, &SlackResponse{
+			Ok:        true,
+			Channel:   channel,
+			TS:        ts,
+			MessageID: msg.ID,
+		})
+	}
+}
+
+func (s *SlackClient) React(ctx context.Context, reaction *slackReaction, channel, postMessageURL, token string) (SlackResponse, error) {
+	method := "reactions.add"
+	if reaction.Remove {
+		method = "reactions.remove"
+	}
+	body, err := json.Marshal(map[string]string{"channel": channel, "timestamp": reaction.TS, "name": reaction.Name})
+	if err != nil {
+		return SlackResponse{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, slackMethodURL(postMessageURL, method),
+		bytes.NewReader(body))
+	if err != nil {
+		return SlackResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	var response SlackResponse
+	err = s.call(req, token, &response, &response)
+	// Already in the requested state (e.g. a retry after a timeout that actually went through).
+	if err != nil && (response.Error == "already_reacted" || response.Error == "no_reaction") {
+		log.S(log.Debug, "Reaction already in place", log.String("channel", channel), log.String("error", response.Error))
+		return SlackResponse{Ok: true}, nil
+	}
+	return response, err
+}
@@ -0,0 +1,259 @@
+// reactions_test.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// ReactingSlackMessenger also records the reactions.
+type ReactingSlackMessenger struct {
+	RecordingSlackMessenger
+	mu        sync.Mutex
+	reactions []recordedReaction
+	// Slack error returned by React, if any.
+	err string
+}
+
+type recordedReaction struct {
+	reaction slackReaction
+	channel  string
+}
+
+func (m *ReactingSlackMessenger) React(_ context.Context, reaction *slackReaction, channel, _, _ string) (SlackResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reactions = append(m.reactions, recordedReaction{*reaction, channel})
+	if m.err != "" {
+		return SlackResponse{Ok: false, Error: m.err}, errors.New(m.err)
+	}
+	return SlackResponse{Ok: true}, nil
+}
+
+func (m *ReactingSlackMessenger) Reactions() []recordedReaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]recordedReaction(nil), m.reactions...)
+}
+
+func TestPostedStore(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newPostedStore(time.Hour)
+	s.now = func() time.Time { return now }
+	msg := &queuedMessage{ID: "m1", Request: SlackPostMessageRequest{Channel: "#alerts"}}
+	s.Record(msg, SlackResponse{Ok: true, Channel: "C123", TS: "1700000000.000001"})
+	s.Record(&queuedMessage{ID: "f1", upload: &slackFile{}}, SlackResponse{Ok: true, TS: "1"})
+
+	entry, found := s.Message("m1")
+	assert.True(t, found)
+	assert.Equal(t, postedEntry{Channel: "C123", TS: "1700000000.000001", Posted: now, Requested: "#alerts"}, entry)
+	_, found = s.Message("f1")
+	assert.False(t, found, "uploads aren't recorded")
+	assert.Equal(t, "C123", s.ChannelID("#alerts"))
+	assert.Equal(t, "#other", s.ChannelID("#other"))
+
+	now = now.Add(time.Hour)
+	_, found = s.Message("m1")
+	assert.False(t, found, "expired")
+	s.Record(&queuedMessage{ID: "m2", Request: SlackPostMessageRequest{Channel: "C123"}}, SlackResponse{Ok: true, TS: "2"})
+	assert.Equal(t, 1, len(s.messages), "pruned")
+
+	var nilStore *postedStore
+	nilStore.Record(msg, SlackResponse{Ok: true, TS: "1"})
+	_, found = nilStore.Message("m1")
+	assert.False(t, found)
+}
+
+func postReaction(app *App, path, body string) (int, SlackResponse) {
+	rr := httptest.NewRecorder()
+	app.handleReaction(path == "/reactions/remove")(rr, httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body)))
+	var response SlackResponse
+	_ = json.NewDecoder(rr.Body).Decode(&response)
+	return rr.Code, response
+}
+
+func TestHandleReaction(t *testing.T) {
+	messenger := &ReactingSlackMessenger{}
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		messenger:  messenger,
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		threads:    newThreadStore(time.Hour, ""),
+		posted:     newPostedStore(time.Hour),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.processQueue(ctx, 0, time.Millisecond, 10, time.Millisecond)
+
+	alert := newQueuedMessage(SlackPostMessageRequest{Channel: "#alerts", Text: "Disk full"}, "")
+	alert.ThreadKey = "disk-db1"
+	assert.NoError(t, app.enqueue(alert))
+	app.wg.Wait()
+
+	code, response := postReaction(app, "/reactions/add", `{"name":":white_check_mark:","message_id":"`+alert.ID+`"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "C123", response.Channel)
+	assert.Equal(t, "1700000000.000001", response.TS)
+	code, _ = postReaction(app, "/reactions/remove", `{"name":"fire","channel":"#alerts","thread_key":"disk-db1"}`)
+	assert.Equal(t, http.StatusOK, code)
+	app.wg.Wait()
+
+	reactions := messenger.Reactions()
+	assert.Equal(t, 2, len(reactions))
+	assert.Equal(t, recordedReaction{slackReaction{Name: "white_check_mark", TS: "1700000000.000001"}, "C123"}, reactions[0])
+	assert.Equal(t, recordedReaction{slackReaction{Name: "fire", TS: "1700000000.000001", Remove: true}, "C123"}, reactions[1])
+	assert.Equal(t, 1, len(messenger.Requests()), "no message posted for the reactions")
+
+	code, response = postReaction(app, "/reactions/add", `{"name":"eyes","message_id":"unknown"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "message unknown not found (not posted yet or too old)", response.Error)
+	code, response = postReaction(app, "/reactions/add", `{"name":"eyes","channel":"#alerts","thread_key":"other"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "no thread for key other in #alerts", response.Error)
+	code, response = postReaction(app, "/reactions/add", `{"message_id":"`+alert.ID+`"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "name is not set", response.Error)
+}
+
+func TestHandleReaction_ThreadChannel(t *testing.T) {
+	rules, err := newRoutingRules(writeRoutingRules(t, testRoutingRules))
+	assert.NoError(t, err)
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		threads:    newThreadStore(time.Hour, ""),
+		routing:    rules,
+	}
+	// Recorded where the messages were posted, after the aliases and the override.
+	app.threads.Set("#payments-oncall", "refund-42", "1700000000.000002")
+	code, response := postReaction(app, "/reactions/add", `{"name":"eyes","channel":"team:payments","thread_key":"refund-42"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "#payments-oncall", response.Channel)
+	assert.Equal(t, "1700000000.000002", response.TS)
+
+	app.channelOverride = "#sandbox"
+	app.threads.Set("#sandbox", "refund-43", "1700000000.000003")
+	code, response = postReaction(app, "/reactions/add", `{"name":"eyes","channel":"#payments","thread_key":"refund-43"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "#sandbox", response.Channel)
+
+	// Like the messages, rejected rather than waiting when the queue is full.
+	for app.slackQueue.Len() < 10 {
+		assert.NoError(t, app.slackQueue.Push(newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Text: "fill"}, "")))
+	}
+	code, _ = postReaction(app, "/reactions/add", `{"name":"eyes","channel":"#payments","thread_key":"refund-43","priority":"high"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, 10, app.slackQueue.Len())
+}
+
+func TestSlackClient_React(t *testing.T) {
+	var requests []map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		body["path"] = r.URL.Path
+		requests = append(requests, body)
+		switch body["name"] {
+		case "eyes":
+			_, _ = w.Write([]byte(`{"ok":false,"error":"already_reacted"}`))
+		case "nope":
+			_, _ = w.Write([]byte(`{"ok":false,"error":"invalid_name"}`))
+		default:
+			_, _ = w.Write([]byte(`{"ok":true}`))
+		}
+	}))
+	defer server.Close()
+
+	client := &SlackClient{client: server.Client()}
+	url := server.URL + "/api/chat.postMessage"
+	_, err := client.React(context.Background(), &slackReaction{Name: "fire", TS: "1.2", Remove: true}, "C123", url, "xoxb-test")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"path": "/api/reactions.remove", "channel": "C123", "timestamp": "1.2", "name": "fire"},
+		requests[0])
+	response, err := client.React(context.Background(), &slackReaction{Name: "eyes", TS: "1.2"}, "C123", url, "xoxb-test")
+	assert.NoError(t, err, "already reacted is a success")
+	assert.True(t, response.Ok)
+	assert.Equal(t, "/api/reactions.add", requests[1]["path"])
+	_, err = client.React(context.Background(), &slackReaction{Name: "nope", TS: "1.2"}, "C123", url, "xoxb-test")
+	assert.Error(t, err)
+	retryable, _, _ := CheckError(err.Error())
+	assert.False(t, retryable)
+}
+
+func TestReaction_PermanentErrors(t *testing.T) {
+	for _, slackErr := range []string{"bad_timestamp", "invalid_name", "message_not_found", "too_many_emoji", "too_many_reactions"} {
+		t.Run(slackErr, func(t *testing.T) {
+			messenger := &ReactingSlackMessenger{err: slackErr}
+			app := &App{
+				slackQueue: newMessageQueue(10, false),
+				messenger:  messenger,
+				metrics:    NewMetrics(prometheus.NewRegistry()),
+				threads:    newThreadStore(time.Hour, ""),
+				posted:     newPostedStore(time.Hour),
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go app.processQueue(ctx, 3, time.Millisecond, 10, time.Millisecond)
+			app.posted.Record(&queuedMessage{ID: "m1", Request: SlackPostMessageRequest{Channel: "#alerts"}},
+				SlackResponse{Ok: true, Channel: "C123", TS: "1700000000.000001"})
+
+			code, _ := postReaction(app, "/reactions/add", `{"name":"fire","message_id":"m1"}`)
+			assert.Equal(t, http.StatusOK, code)
+			app.wg.Wait()
+			assert.Equal(t, 1, len(messenger.Reactions()), "not retried")
+			assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.RequestsFailedTotal.WithLabelValues("C123")))
+		})
+	}
+}
+
+func TestHandleReaction_Policy(t *testing.T) {
+	app, _ := newPolicyTestApp(t)
+	app.posted = newPostedStore(time.Hour)
+	app.threads = newThreadStore(time.Hour, "")
+	ops := newQueuedMessage(SlackPostMessageRequest{Channel: "#random", Text: "hi"}, "ops")
+	app.posted.Record(ops, SlackResponse{Ok: true, Channel: "C111", TS: "1"})
+	ci := newQueuedMessage(SlackPostMessageRequest{Channel: "#builds", Text: "hi"}, "ci")
+	app.posted.Record(ci, SlackResponse{Ok: true, Channel: "C222", TS: "2"})
+	app.threads.Set("#exec-board", "k", "3")
+
+	react := func(token, body string) (int, SlackResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/reactions/add", bytes.NewBufferString(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		app.handleReaction(false)(rr, req)
+		var response SlackResponse
+		_ = json.NewDecoder(rr.Body).Decode(&response)
+		return rr.Code, response
+	}
+	// Authorized against the channel the message was requested to, not its id.
+	code, response := react("ci-secret", `{"name":"eyes","message_id":"`+ci.ID+`"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "C222", response.Channel)
+	// Other clients' messages are unknown.
+	code, response = react("ci-secret", `{"name":"eyes","message_id":"`+ops.ID+`"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "message "+ops.ID+" not found (not posted yet or too old)", response.Error)
+	code, _ = react("", `{"name":"eyes","message_id":"`+ci.ID+`"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+	// Denied before looking for the thread, whether there is one or not.
+	for _, key := range []string{"k", "nope"} {
+		code, response = react("ci-secret", `{"name":"eyes","channel":"#exec-board","thread_key":"`+key+`"}`)
+		assert.Equal(t, http.StatusForbidden, code)
+		assert.Equal(t, "client ci is not allowed to post to #exec-board: not in the allowlist", response.Error)
+	}
+	assert.Equal(t, 1, app.slackQueue.Len())
+}
@@ -0,0 +1,253 @@
+// routing.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/log"
+)
+
+// Unlike the all-or-nothing channelOverride, routing rules pick the destinations per request: aliases
+// name logical destinations (e.g. "team:payments"), rules rewrite the channel based on the channel,
+// client, headers or text, and both can fan a request out to several channels. Each copy is queued as
+// its own message (own id, metrics, retries). The rules file is reloaded when it changes.
+
+// Placeholder for the requested channel in a rule's channels.
+const routeOriginalChannel = "$channel"
+
+// routeMatch criteria are regular expressions, all the set ones must match.
+type routeMatch struct {
+	Channel string            `json:"channel,omitempty"`
+	Client  string            `json:"client,omitempty"`
+	Header  map[string]string `json:"header,omitempty"`
+	Text    string            `json:"text,omitempty"`
+}
+
+type routeRule struct {
+	Match    routeMatch `json:"match"`
+	Channels []string   `json:"channels"` // replace the requested channel, "$channel" keeps it
+	channel  *regexp.Regexp
+	client   *regexp.Regexp
+	header   map[string]*regexp.Regexp
+	text     *regexp.Regexp
+}
+
+// routingConfig is the json rules file. The first matching rule wins, then aliases are expanded.
+type routingConfig struct {
+	Aliases map[string][]string `json:"aliases,omitempty"`
+	Rules   []*routeRule        `json:"rules,omitempty"`
+}
+
+func loadRoutingConfig(configPath string) (*routingConfig, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var config routingConfig
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, config.compile()
+}
+
+func (c *routingConfig) compile() error {
+	var errs []error
+	compile := func(i int, what, expr string) *regexp.Regexp {
+		if expr == "" {
+			return nil
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("routing rule %d: invalid %s regexp: %w", i, what, err))
+		}
+		return re
+	}
+	for i, rule := range c.Rules {
+		if len(rule.Channels) == 0 {
+			errs = append(errs, fmt.Errorf("routing rule %d: channels is not set", i))
+		}
+		rule.channel = compile(i, "channel", rule.Match.Channel)
+		rule.client = compile(i, "client", rule.Match.Client)
+		rule.text = compile(i, "text", rule.Match.Text)
+		rule.header = make(map[string]*regexp.Regexp, len(rule.Match.Header))
+		for name, expr := range rule.Match.Header {
+			rule.header[name] = compile(i, "header "+name, expr)
+		}
+	}
+	for alias, channels := range c.Aliases {
+		if len(channels) == 0 {
+			errs = append(errs, fmt.Errorf("routing alias %q: no channels", alias))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *routeRule) matches(request *SlackPostMessageRequest, client string, header http.Header) bool {
+	if r.channel != nil && !r.channel.MatchString(request.Channel) {
+		return false
+	}
+	if r.client != nil && !r.client.MatchString(client) {
+		return false
+	}
+	if r.text != nil && !r.text.MatchString(request.Text) {
+		return false
+	}
+	for name, re := range r.header {
+		if !re.MatchString(header.Get(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// destinations returns the channels the request should be posted to, without duplicates. Header can
+// be nil for the ingresses without any.
+func (c *routingConfig) destinations(request *SlackPostMessageRequest, client string, header http.Header) []string {
+	channels := []string{request.Channel}
+	for _, rule := range c.Rules {
+		if rule.matches(request, client, header) {
+			channels = rule.Channels
+			break
+		}
+	}
+	var result []string
+	seen := make(map[string]bool)
+	for _, channel := range channels {
+		if channel == routeOriginalChannel {
+			channel = request.Channel
+		}
+		for _, channel := range c.expand(channel) {
+			if !seen[channel] {
+				seen[channel] = true
+				result = append(result, channel)
+			}
+		}
+	}
+	return result
+}
+
+// expand returns the channels of the alias, the channel itself when it isn't one.
+func (c *routingConfig) expand(channel string) []string {
+	if expanded, isAlias := c.Aliases[channel]; isAlias {
+		return expanded
+	}
+	return []string{channel}
+}
+
+// routingRules holds the current config, swapped atomically on reload.
+type routingRules struct {
+	path    string
+	config  atomic.Pointer[routingConfig]
+	modTime time.Time
+}
+
+func newRoutingRules(configPath string) (*routingRules, error) {
+	rules := &routingRules{path: configPath}
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return nil, err
+	}
+	config, err := loadRoutingConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	rules.config.Store(config)
+	rules.modTime = info.ModTime()
+	return rules, nil
+}
+
+// reload loads the file again if it changed. An invalid file is logged and the previous rules are kept.
+func (r *routingRules) reload() {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		log.S(log.Error, "Failed to check the routing rules", log.Any("err", err), log.String("path", r.path))
+		return
+	}
+	if info.ModTime().Equal(r.modTime) {
+		return
+	}
+	r.modTime = info.ModTime()
+	config, err := loadRoutingConfig(r.path)
+	if err != nil {
+		log.S(log.Error, "Invalid routing rules, keeping the previous ones", log.Any("err", err), log.String("path", r.path))
+		return
+	}
+	r.config.Store(config)
+	log.S(log.Info, "Routing rules reloaded", log.Int("rules", len(config.Rules)), log.Int("aliases", len(config.Aliases)))
+}
+
+// ReloadEvery checks the rules file for changes periodically until the context is canceled.
+func (r *routingRules) ReloadEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.reload()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// route returns the copies of the message for each of its destinations, the first one keeping the
+// message id (the receipt returned to the caller) and the others getting derived ids. The message itself
+// is left as requested (e.g. for its content hash).
+func (app *App) route(msg *queuedMessage, header http.Header) []*queuedMessage {
+	if app.routing == nil {
+		return []*queuedMessage{msg}
+	}
+	destinations := app.routing.config.Load().destinations(&msg.Request, msg.Client, header)
+	if len(destinations) > 1 || destinations[0] != msg.Request.Channel {
+		log.S(log.Debug, "Routing message", log.String("channel", msg.Request.Channel),
+			log.String("destinations", strings.Join(destinations, ",")), log.String("message_id", msg.ID))
+	}
+	copies := make([]*queuedMessage, 0, len(destinations))
+	for i, channel := range destinations {
+		c := *msg
+		if i > 0 {
+			c.ID = fmt.Sprintf("%s-%d", msg.ID, i)
+		}
+		c.Request.Channel = channel
+		copies = append(copies, &c)
+	}
+	return copies
+}
+
+// aliasChannels returns the channels of the routing alias, the channel itself when it isn't one (or
+// without routing rules).
+func (app *App) aliasChannels(channel string) []string {
+	if app.routing == nil {
+		return []string{channel}
+	}
+	return app.routing.config.Load().expand(channel)
+}
+
+// validateCopies validates each of the routed copies, returning the first error.
+func (app *App) validateCopies(copies []*queuedMessage) error {
+	for _, c := range copies {
+		// For the rest (splitting, digests,...) too, validate reports the errors.
+		_ = decodeBlockKit(&c.Request)
+		channels := app.channels
+		if isBackend, err := app.validateBackend(c.Request.Channel); isBackend {
+			if err != nil {
+				return err
+			}
+			channels = nil // the directory only knows the proxy's workspace
+		}
+		if err := validate(c.Request, channels, app.splitMode != ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
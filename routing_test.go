@@ -0,0 +1,171 @@
+// routing_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testRoutingRules = `{
+  "aliases": {"team:payments": ["#payments-alerts", "#payments-oncall"]},
+  "rules": [
+    {"match": {"channel": "^#alerts$", "header": {"X-Env": "^staging$"}}, "channels": ["#staging-alerts"]},
+    {"match": {"client": "^billing$", "text": "(?i)refund"}, "channels": ["$channel", "team:payments"]}
+  ]
+}`
+
+func writeRoutingRules(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "routing.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRoutingConfig_Destinations(t *testing.T) {
+	rules, err := newRoutingRules(writeRoutingRules(t, testRoutingRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := rules.config.Load()
+	staging := http.Header{}
+	staging.Set("X-Env", "staging")
+	tests := []struct {
+		name    string
+		request SlackPostMessageRequest
+		client  string
+		header  http.Header
+		want    []string
+	}{
+		{"no match", SlackPostMessageRequest{Channel: "#alerts"}, "", nil, []string{"#alerts"}},
+		{"rewrite", SlackPostMessageRequest{Channel: "#alerts"}, "", staging, []string{"#staging-alerts"}},
+		{"alias", SlackPostMessageRequest{Channel: "team:payments"}, "", nil, []string{"#payments-alerts", "#payments-oncall"}},
+		{
+			"fan-out", SlackPostMessageRequest{Channel: "#billing", Text: "Refund issued"}, "billing", nil,
+			[]string{"#billing", "#payments-alerts", "#payments-oncall"},
+		},
+		{
+			"no duplicates", SlackPostMessageRequest{Channel: "#payments-oncall", Text: "refund"}, "billing", nil,
+			[]string{"#payments-oncall", "#payments-alerts"},
+		},
+		{"text mismatch", SlackPostMessageRequest{Channel: "#billing", Text: "invoice"}, "billing", nil, []string{"#billing"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, config.destinations(&tt.request, tt.client, tt.header))
+		})
+	}
+}
+
+func TestRoutingConfig_Invalid(t *testing.T) {
+	_, err := newRoutingRules(writeRoutingRules(t, `{"aliases":{"a":[]},"rules":[{"match":{"text":"("}},{"channels":["#x"]}]}`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "routing rule 0: channels is not set")
+	assert.Contains(t, err.Error(), "routing rule 0: invalid text regexp")
+	assert.Contains(t, err.Error(), `routing alias "a": no channels`)
+}
+
+func TestRoutingRules_Reload(t *testing.T) {
+	path := writeRoutingRules(t, `{"aliases":{"ops":["#ops"]}}`)
+	rules, err := newRoutingRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := SlackPostMessageRequest{Channel: "ops"}
+	assert.Equal(t, []string{"#ops"}, rules.config.Load().destinations(&request, "", nil))
+
+	// Invalid content is ignored.
+	later := time.Now().Add(time.Minute)
+	if err = os.WriteFile(path, []byte(`{"aliases":`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(path, later, later)
+	rules.reload()
+	assert.Equal(t, []string{"#ops"}, rules.config.Load().destinations(&request, "", nil))
+
+	if err = os.WriteFile(path, []byte(`{"aliases":{"ops":["#ops","#sre"]}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	_ = os.Chtimes(path, later, later)
+	rules.reload()
+	assert.Equal(t, []string{"#ops", "#sre"}, rules.config.Load().destinations(&request, "", nil))
+}
+
+func TestHandleRequest_FanOut(t *testing.T) {
+	rules, err := newRoutingRules(writeRoutingRules(t, testRoutingRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		routing:    rules,
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"channel":"team:payments","text":"hi"}`))
+	rr := httptest.NewRecorder()
+	app.handleRequest(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response SlackResponse
+	if err = json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, app.slackQueue.Len())
+	first, second := app.slackQueue.next(), app.slackQueue.next()
+	assert.Equal(t, "#payments-alerts", first.Request.Channel)
+	assert.Equal(t, "#payments-oncall", second.Request.Channel)
+	assert.Equal(t, response.MessageID, first.ID)
+	assert.Equal(t, response.MessageID+"-1", second.ID)
+	assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.RequestsReceivedTotal.WithLabelValues("#payments-alerts")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.RequestsReceivedTotal.WithLabelValues("#payments-oncall")))
+}
+
+func TestHandleRequest_FanOutQueueFull(t *testing.T) {
+	rules, err := newRoutingRules(writeRoutingRules(t, testRoutingRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		routing:    rules,
+	}
+	// Room for one more normal priority message but not for both copies.
+	for app.slackQueue.Len() < 8 {
+		app.slackQueue.Push(newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Text: "fill"}, ""))
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"channel":"team:payments","text":"hi"}`))
+	rr := httptest.NewRecorder()
+	app.handleRequest(rr, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, 8, app.slackQueue.Len())
+}
+
+func TestRoute_KeepsMessage(t *testing.T) {
+	rules, err := newRoutingRules(writeRoutingRules(t, testRoutingRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{routing: rules}
+	msg := newQueuedMessage(SlackPostMessageRequest{Channel: "team:payments", Text: "hi"}, "")
+	hash := contentHash(&msg.Request)
+	copies := app.route(msg, nil)
+	assert.Equal(t, 2, len(copies))
+	assert.Equal(t, "#payments-alerts", copies[0].Request.Channel)
+	assert.Equal(t, msg.ID, copies[0].ID)
+	assert.Equal(t, "team:payments", msg.Request.Channel)
+	assert.Equal(t, hash, contentHash(&msg.Request))
+}
@@ -0,0 +1,288 @@
+// scheduler.go
+
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/jrpc"
+	"fortio.org/log"
+)
+
+// Messages with a deliver_at or delay are held by the scheduler until they are due and only then
+// queued like the others, so they go through the same rate limited send path. This works for any
+// message and doesn't need the token to have Slack's scheduling scopes. Like the queue, the scheduled
+// messages aren't persisted.
+
+type scheduledMessage struct {
+	msg       *queuedMessage
+	receipt   string // id returned to the caller, shared by the routed copies
+	deliverAt time.Time
+	index     int // in the heap
+}
+
+// scheduledHeap orders the messages by delivery time, implementing heap.Interface.
+type scheduledHeap []*scheduledMessage
+
+func (h scheduledHeap) Len() int           { return len(h) }
+func (h scheduledHeap) Less(i, j int) bool { return h[i].deliverAt.Before(h[j].deliverAt) }
+
+func (h scheduledHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *scheduledHeap) Push(x any) {
+	item := x.(*scheduledMessage)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *scheduledHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// Default maximum number of pending scheduled messages, see scheduler.maxPending.
+const defaultMaxScheduled = 1000
+
+// How long a due message waits before being retried when the queue is almost full.
+const scheduledRetryDelay = 10 * time.Second
+
+// errTooManyScheduled is returned when the scheduler already holds maxPending messages.
+var errTooManyScheduled = errors.New("too many scheduled messages")
+
+// scheduler is safe for concurrent use.
+type scheduler struct {
+	maxDelay time.Duration
+	// Pending messages don't take room in the queue, this bounds the memory they use.
+	maxPending int
+	mu         sync.Mutex
+	pending    scheduledHeap
+	wake       chan struct{}
+}
+
+func newScheduler(maxDelay time.Duration) *scheduler {
+	return &scheduler{
+		maxDelay:   maxDelay,
+		maxPending: defaultMaxScheduled,
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// deliveryTime parses the deliver_at (RFC 3339 or unix seconds) and delay fields, returning the zero
+// time when the message isn't scheduled.
+func (s *scheduler) deliveryTime(deliverAt, delay string, now time.Time) (time.Time, error) {
+	var at time.Time
+	switch {
+	case deliverAt != "" && delay != "":
+		return at, errors.New("only one of deliver_at and delay can be set")
+	case deliverAt != "":
+		if seconds, err := strconv.ParseInt(deliverAt, 10, 64); err == nil {
+			at = time.Unix(seconds, 0)
+		} else if at, err = time.Parse(time.RFC3339, deliverAt); err != nil {
+			return at, fmt.Errorf("invalid deliver_at %q, expected RFC 3339 or unix seconds", deliverAt)
+		}
+	case delay != "":
+		d, err := time.ParseDuration(delay)
+		if err != nil || d < 0 {
+			return at, fmt.Errorf("invalid delay %q, expected a positive duration (e.g. 10m)", delay)
+		}
+		at = now.Add(d)
+	default:
+		return at, nil
+	}
+	if s == nil {
+		return time.Time{}, errors.New("scheduled delivery is disabled")
+	}
+	if at.Sub(now) > s.maxDelay {
+		return time.Time{}, fmt.Errorf("delivery is too far in the future, the maximum is %s", s.maxDelay)
+	}
+	return at, nil
+}
+
+// Schedule holds the messages (the routed copies of a request) until deliverAt. None of them are when
+// that would exceed maxPending, errTooManyScheduled is returned instead.
+func (s *scheduler) Schedule(copies []*queuedMessage, receipt string, deliverAt time.Time) error {
+	s.mu.Lock()
+	if len(s.pending)+len(copies) > s.maxPending {
+		s.mu.Unlock()
+		return errTooManyScheduled
+	}
+	for _, msg := range copies {
+		heap.Push(&s.pending, &scheduledMessage{msg: msg, receipt: receipt, deliverAt: deliverAt})
+	}
+	s.mu.Unlock()
+	s.signal()
+	return nil
+}
+
+// retry holds a due message some more, it already was counted in maxPending.
+func (s *scheduler) retry(item *scheduledMessage, deliverAt time.Time) {
+	s.mu.Lock()
+	item.deliverAt = deliverAt
+	heap.Push(&s.pending, item)
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Cancel drops the messages (all the routed copies) with the given receipt, optionally only the ones of
+// the client. Returns how many were canceled.
+func (s *scheduler) Cancel(receipt, client string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var canceled []*scheduledMessage
+	for _, item := range s.pending {
+		if item.receipt == receipt && (client == "" || item.msg.Client == client) {
+			canceled = append(canceled, item)
+		}
+	}
+	// Removing moves the other items around, their index is kept up to date by Swap.
+	for _, item := range canceled {
+		heap.Remove(&s.pending, item.index)
+		forgetDuplicate(item.msg)
+	}
+	return len(canceled)
+}
+
+// scheduledInfo is what the api lists.
+type scheduledInfo struct {
+	ID        string    `json:"id"`
+	MessageID string    `json:"message_id"`
+	Channel   string    `json:"channel"`
+	Client    string    `json:"client,omitempty"`
+	DeliverAt time.Time `json:"deliver_at"`
+}
+
+// List returns the pending messages, optionally only the ones of the client, by delivery time.
+func (s *scheduler) List(client string) []scheduledInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []scheduledInfo{}
+	for _, item := range s.pending {
+		if client != "" && item.msg.Client != client {
+			continue
+		}
+		list = append(list, scheduledInfo{
+			ID:        item.receipt,
+			MessageID: item.msg.ID,
+			Channel:   item.msg.Request.Channel,
+			Client:    item.msg.Client,
+			DeliverAt: item.deliverAt,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeliverAt.Before(list[j].DeliverAt) })
+	return list
+}
+
+// due removes and returns the messages due at now.
+func (s *scheduler) due(now time.Time) ([]*scheduledMessage, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []*scheduledMessage
+	for len(s.pending) > 0 && !s.pending[0].deliverAt.After(now) {
+		due = append(due, heap.Pop(&s.pending).(*scheduledMessage))
+	}
+	next := time.Hour
+	if len(s.pending) > 0 {
+		next = s.pending[0].deliverAt.Sub(now)
+	}
+	return due, next
+}
+
+// Run releases the messages when they are due, until the context is canceled.
+func (s *scheduler) Run(ctx context.Context, release func(*scheduledMessage)) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-ctx.Done():
+			return
+		}
+		due, next := s.due(time.Now())
+		for _, item := range due {
+			release(item)
+		}
+		timer.Reset(next)
+	}
+}
+
+// releaseScheduled queues a due message. Its ttl starts at the delivery time, not when it was received.
+// The message was accepted long ago, so a burst filling up the queue only delays it (by
+// scheduledRetryDelay) rather than failing it.
+func (app *App) releaseScheduled(item *scheduledMessage) {
+	msg := item.msg
+	now := time.Now()
+	if !msg.Expires.IsZero() {
+		msg.Expires = msg.Expires.Add(now.Sub(msg.Received))
+	}
+	msg.Received = now
+	if app.queueAlmostFull(msg.Priority, 1) {
+		log.S(log.Warning, "Scheduled message is due but the queue is almost full, retrying later",
+			log.String("channel", msg.Request.Channel), log.String("message_id", msg.ID))
+		app.scheduler.retry(item, now.Add(scheduledRetryDelay))
+		return
+	}
+	log.S(log.Info, "Scheduled message is due", log.String("channel", msg.Request.Channel), log.String("message_id", msg.ID))
+	_ = app.enqueue(msg)
+}
+
+// handleScheduled lists (GET) the scheduled messages. When the channel policy is enabled, clients other
+// than the admins only see their own messages, see ownClient.
+func (app *App) handleScheduled(w http.ResponseWriter, r *http.Request) {
+	client, ok := app.ownClient(w, r, app.authenticate(r))
+	if !ok {
+		return
+	}
+	list := []scheduledInfo{}
+	if app.scheduler != nil {
+		list = app.scheduler.List(client)
+	}
+	if err := jrpc.Reply(w, http.StatusOK, &list); err != nil {
+		log.S(log.Error, "Failed to write response", log.Any("err", err))
+	}
+}
+
+// handleCancelScheduled cancels (DELETE /scheduled/{id}) a scheduled message, by the id returned when
+// it was posted. Like for the list, clients other than the admins only cancel their own messages.
+func (app *App) handleCancelScheduled(w http.ResponseWriter, r *http.Request) {
+	client, ok := app.ownClient(w, r, app.authenticate(r))
+	if !ok {
+		return
+	}
+	id := r.PathValue("id")
+	if app.scheduler == nil || app.scheduler.Cancel(id, client) == 0 {
+		reply(w, http.StatusNotFound, &SlackResponse{
+			Ok:    false,
+			Error: "No scheduled message with id " + id,
+		})
+		return
+	}
+	log.S(log.Info, "Scheduled message canceled", log.String("message_id", id), log.String("client", client))
+	reply(w, http.StatusOK, &SlackResponse{
+		Ok:        true,
+		MessageID: id,
+	})
+}
@@ -0,0 +1,193 @@
+// scheduler_test.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScheduler_DeliveryTime(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	s := newScheduler(24 * time.Hour)
+	tests := []struct {
+		name, deliverAt, delay string
+		want                   time.Time
+		wantErr                string
+	}{
+		{name: "not scheduled"},
+		{name: "rfc3339", deliverAt: "2026-10-18T14:00:00+02:00", want: now},
+		{name: "unix", deliverAt: "1760796000", want: time.Unix(1760796000, 0)},
+		{name: "delay", delay: "90m", want: now.Add(90 * time.Minute)},
+		{name: "both", deliverAt: "1760796000", delay: "1m", wantErr: "only one of deliver_at and delay can be set"},
+		{name: "bad date", deliverAt: "tomorrow", wantErr: `invalid deliver_at "tomorrow", expected RFC 3339 or unix seconds`},
+		{name: "bad delay", delay: "-1m", wantErr: `invalid delay "-1m", expected a positive duration (e.g. 10m)`},
+		{name: "too far", delay: "25h", wantErr: "delivery is too far in the future, the maximum is 24h0m0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at, err := s.deliveryTime(tt.deliverAt, tt.delay, now)
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				assert.Equal(t, tt.wantErr, err.Error())
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, tt.want.Equal(at), at.String())
+		})
+	}
+	var disabled *scheduler
+	_, err := disabled.deliveryTime("", "1m", now)
+	assert.Equal(t, "scheduled delivery is disabled", err.Error())
+}
+
+func TestScheduledDelivery(t *testing.T) {
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		scheduler:  newScheduler(time.Hour),
+	}
+	post := func(body string) string {
+		rr := httptest.NewRecorder()
+		app.handleRequest(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body)))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var response SlackResponse
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+		return response.MessageID
+	}
+	soon := post(`{"channel":"#c","text":"soon","delay":"200ms","ttl":"1m"}`)
+	later := post(`{"channel":"#c","text":"later","delay":"30m"}`)
+	canceled := post(`{"channel":"#c","text":"canceled","delay":"10m"}`)
+	post(`{"channel":"#c","text":"now"}`)
+	assert.Equal(t, 1, app.slackQueue.Len())
+
+	rr := httptest.NewRecorder()
+	app.handleScheduled(rr, httptest.NewRequest(http.MethodGet, "/scheduled", nil))
+	var list []scheduledInfo
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&list))
+	assert.Equal(t, 3, len(list))
+	assert.Equal(t, []string{soon, canceled, later}, []string{list[0].ID, list[1].ID, list[2].ID})
+
+	req := httptest.NewRequest(http.MethodDelete, "/scheduled/"+canceled, nil)
+	req.SetPathValue("id", canceled)
+	rr = httptest.NewRecorder()
+	app.handleCancelScheduled(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = httptest.NewRecorder()
+	app.handleCancelScheduled(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code, "already canceled")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.scheduler.Run(ctx, app.releaseScheduled)
+	assert.Equal(t, "now", app.slackQueue.next().Request.Text)
+	popCtx, popCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer popCancel()
+	msg, ok := app.slackQueue.Pop(popCtx)
+	assert.True(t, ok)
+	assert.Equal(t, "soon", msg.Request.Text)
+	assert.Equal(t, time.Minute, msg.Expires.Sub(msg.Received), "the ttl starts at the delivery")
+	pending := app.scheduler.List("")
+	assert.Equal(t, 1, len(pending))
+	assert.Equal(t, later, pending[0].ID)
+}
+
+func TestScheduledDelivery_Policy(t *testing.T) {
+	app, _ := newPolicyTestApp(t)
+	app.scheduler = newScheduler(time.Hour)
+	do := func(method, target, token, remote string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.RemoteAddr = remote
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		switch method {
+		case http.MethodPost:
+			app.handleRequest(rr, req)
+		case http.MethodGet:
+			app.handleScheduled(rr, req)
+		default:
+			req.SetPathValue("id", target[len("/scheduled/"):])
+			app.handleCancelScheduled(rr, req)
+		}
+		return rr
+	}
+	rr := do(http.MethodPost, "/", "ci-secret", "192.0.2.1:1234", `{"channel":"#builds","text":"ci","delay":"10m"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response SlackResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	ciID := response.MessageID
+	rr = do(http.MethodPost, "/", "", "10.1.2.3:1234", `{"channel":"#infra","text":"anonymous","delay":"10m"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = do(http.MethodGet, "/scheduled", "", "10.1.2.3:1234", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code, "anonymous callers can't list")
+	rr = do(http.MethodDelete, "/scheduled/"+ciID, "", "10.1.2.3:1234", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code, "anonymous callers can't cancel")
+	rr = do(http.MethodGet, "/scheduled", "ci-secret", "192.0.2.1:1234", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var list []scheduledInfo
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&list))
+	assert.Equal(t, 1, len(list), "only its own messages")
+	assert.Equal(t, ciID, list[0].ID)
+	rr = do(http.MethodDelete, "/scheduled/"+ciID, "ops-secret", "192.0.2.1:1234", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code, "not one of its messages")
+	assert.Equal(t, 2, len(app.scheduler.List("")))
+}
+
+func TestScheduledDelivery_QueueFullAndShutdown(t *testing.T) {
+	app := &App{
+		slackQueue: newMessageQueue(1, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		scheduler:  newScheduler(time.Hour),
+	}
+	app.slackQueue.Push(newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Text: "queued"}, ""))
+	due := newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Text: "due"}, "")
+	app.releaseScheduled(&scheduledMessage{msg: due, receipt: due.ID, deliverAt: time.Now()})
+	assert.Equal(t, 1, app.slackQueue.Len(), "not queued while the queue is full")
+	assert.Equal(t, 0.0, testutil.ToFloat64(app.metrics.RequestsFailedTotal.WithLabelValues("#c")), "nor failed")
+	pending := app.scheduler.List("")
+	assert.Equal(t, 1, len(pending), "retried later")
+	assert.True(t, pending[0].DeliverAt.After(time.Now().Add(scheduledRetryDelay/2)))
+
+	app.slackQueue.next()
+	app.startReleases(context.Background())
+	msg := newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Text: "during shutdown"}, "")
+	assert.NoError(t, app.scheduler.Schedule([]*queuedMessage{msg}, msg.ID, time.Now().Add(100*time.Millisecond)))
+	app.Shutdown()
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 0, app.slackQueue.Len(), "not released once the queue is closed")
+	assert.Equal(t, 2, len(app.scheduler.List("")))
+}
+
+func TestScheduledDelivery_MaxScheduled(t *testing.T) {
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		scheduler:  newScheduler(time.Hour),
+		routing:    &routingRules{},
+	}
+	app.routing.config.Store(&routingConfig{Aliases: map[string][]string{"#both": {"#a", "#b"}}})
+	app.scheduler.maxPending = 3
+	post := func(body string) int {
+		rr := httptest.NewRecorder()
+		app.handleRequest(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body)))
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusOK, post(`{"channel":"#both","text":"a","delay":"10m"}`))
+	assert.Equal(t, http.StatusServiceUnavailable, post(`{"channel":"#both","text":"b","delay":"10m"}`), "no room for both copies")
+	assert.Equal(t, http.StatusOK, post(`{"channel":"#c","text":"c","delay":"10m"}`))
+	assert.Equal(t, http.StatusServiceUnavailable, post(`{"channel":"#c","text":"d","delay":"10m"}`))
+	assert.Equal(t, http.StatusOK, post(`{"channel":"#c","text":"not scheduled"}`))
+	assert.Equal(t, 3, len(app.scheduler.List("")))
+}
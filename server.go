@@ -4,14 +4,19 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"fortio.org/fortio/fhttp"
 	"fortio.org/fortio/jrpc"
 	"fortio.org/log"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func (app *App) StartServer(ctx context.Context, applicationPort string) error {
@@ -20,6 +25,26 @@ func (app *App) StartServer(ctx context.Context, applicationPort string) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", app.handleRequest)
 	mux.HandleFunc("/health", HealthCheck)
+	if app.cloudEvents != nil {
+		mux.HandleFunc("/cloudevents", app.handleCloudEvent)
+	}
+	if app.maxUploadSize > 0 {
+		mux.HandleFunc("POST /files", app.handleUpload)
+	}
+	mux.HandleFunc("POST /reactions/add", app.handleReaction(false))
+	mux.HandleFunc("POST /reactions/remove", app.handleReaction(true))
+	mux.HandleFunc("GET /scheduled", app.handleScheduled)
+	mux.HandleFunc("DELETE /scheduled/{id}", app.handleCancelScheduled)
+	// The admin api can mute every channel and the audit log tells who posts what where, they only exist
+	// for the admins of the policy (the other clients only getting their own audit entries).
+	if app.policy.hasAdmins() {
+		if app.audit != nil {
+			mux.HandleFunc("GET /audit", app.handleAudit)
+		}
+		mux.HandleFunc("GET /admin/maintenance", app.handleMaintenance)
+		mux.HandleFunc("POST /admin/maintenance", app.handleMaintenance)
+		mux.HandleFunc("DELETE /admin/maintenance/{id}", app.handleEndMaintenance)
+	}
 
 	server := &http.Server{
 		Addr:              applicationPort,
@@ -29,6 +54,18 @@ func (app *App) StartServer(ctx context.Context, applicationPort string) error {
 		ErrorLog:          log.NewStdLogger("http srv "+name, log.Error),
 	}
 
+	// The other (non http) ingresses share the server lifecycle.
+	if app.syslog != nil {
+		if err := app.syslog.start(ctx, app); err != nil {
+			return err
+		}
+	}
+	if app.smtp != nil {
+		if err := app.smtp.start(ctx, app); err != nil {
+			return err
+		}
+	}
+
 	doneCh := make(chan error)
 	go func() {
 		// Start the server
@@ -51,91 +88,294 @@ func HealthCheck(w http.ResponseWriter, _ *http.Request) {
 }
 
 func (app *App) handleRequest(w http.ResponseWriter, r *http.Request) {
+	w, span, end := app.traceRequest(w, r, "handleRequest")
+	defer end()
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	maxQueueSize := int(float64(cap(app.slackQueue)) * 0.9)
-	// Reject requests if the queue is almost full
-	// If the channel is full, the request will block until there is space in the channel.
-	// Ideally we don't reject at 90%, but initially after some tests I got blocked. So I decided to be
-	// a bit more conservative.
-	// ToDo: Fix this behavior so we can reach 100% channel size without problems.
-	if len(app.slackQueue) >= maxQueueSize {
-		log.S(log.Warning, "Queue is almost full, returning StatusServiceUnavailable", log.Int("queueSize", len(app.slackQueue)))
-
-		err := jrpc.Reply[SlackResponse](w, http.StatusServiceUnavailable, &SlackResponse{
-			Ok:    false,
-			Error: "Queue is almost full",
-		})
-		if err != nil {
-			log.S(log.Error, "Failed to write response", log.Any("err", err))
-		}
-
-		return
+	authenticated := app.authenticate(r)
+	client := clientName(r)
+	if authenticated != "" {
+		client = authenticated
 	}
 
-	var request SlackPostMessageRequest
-	requestErr := json.NewDecoder(r.Body).Decode(&request)
+	var body proxyRequest
+	requestErr := json.NewDecoder(r.Body).Decode(&body)
+	request := body.SlackPostMessageRequest
 
+	prio := priorityNormal
+	if requestErr == nil {
+		prio, requestErr = requestPriority(r, body.Priority)
+	}
+	var ttl time.Duration
+	if requestErr == nil {
+		ttl, requestErr = requestTTL(r, body.TTL)
+	}
+	var deliverAt time.Time
+	if requestErr == nil {
+		deliverAt, requestErr = app.scheduler.deliveryTime(body.DeliverAt, body.Delay, time.Now())
+	}
 	// If we can't decode, we don't bother validating. In the end it's the same outcome if either one
 	// is invalid.
+	var msg *queuedMessage
+	var copies []*queuedMessage
 	if requestErr == nil {
-		requestErr = validate(request)
+		msg = newQueuedMessage(request, client)
+		msg.spanContext = span.SpanContext()
+		span.SetAttributes(attribute.String("slack_proxy.message_id", msg.ID), attribute.String("slack_proxy.client", client),
+			attribute.String("slack_proxy.channel", app.channelLabel(request.Channel)))
+		app.auditMessage(msg, auditEntry{Event: auditReceived, Remote: r.RemoteAddr})
+		msg.Priority = prio
+		app.setExpiry(msg, ttl)
+		msg.ThreadKey = body.ThreadKey
+		if key := r.Header.Get(threadKeyHeader); key != "" {
+			msg.ThreadKey = key
+		}
+		copies = app.route(msg, r.Header)
+		requestErr = app.validateCopies(copies)
 	}
 
 	if requestErr != nil {
 		log.S(log.Error, "Invalid request", log.Any("err", requestErr))
+		id := ""
+		if msg != nil {
+			id = msg.ID
+		}
+		app.auditRejected(r.RemoteAddr, "chat.postMessage", client, request.Channel, id, requestErr.Error())
 
-		err := jrpc.Reply[SlackResponse](w, http.StatusBadRequest, &SlackResponse{
+		reply(w, http.StatusBadRequest, &SlackResponse{
 			Ok:    false,
 			Error: requestErr.Error(),
 		})
-		if err != nil {
-			log.S(log.Error, "Failed to write response", log.Any("err", err))
+		return
+	}
+
+	if !app.authorize(w, r, authenticated, copies) {
+		return
+	}
+
+	// All the routed copies must fit, the high priority ones using the reserved capacity.
+	if app.queueAlmostFull(prio, len(copies)) {
+		app.auditRejected(r.RemoteAddr, "chat.postMessage", client, request.Channel, msg.ID, "Queue is almost full")
+		reply(w, http.StatusServiceUnavailable, &SlackResponse{
+			Ok:    false,
+			Error: "Queue is almost full",
+		})
+		return
+	}
+
+	if original, duplicate := app.duplicateOf(r.Header.Get(idempotencyKeyHeader), msg, copies); duplicate {
+		log.S(log.Info, "Duplicate request, not posting it again", log.String("channel", request.Channel),
+			log.String("client", msg.Client), log.String("message_id", original))
+		app.metrics.RequestsDeduplicated.WithLabelValues(app.channelLabel(request.Channel)).Inc()
+		app.auditMessage(msg, auditEntry{Event: auditDeduplicated, Reason: "duplicate of " + original})
+		reply(w, http.StatusOK, &SlackResponse{
+			Ok:        true,
+			Warning:   "duplicate",
+			MessageID: original,
+		})
+		return
+	}
+	if time.Now().Before(deliverAt) {
+		if err := app.scheduler.Schedule(copies, msg.ID, deliverAt); err != nil {
+			log.S(log.Warning, "Rejecting scheduled request", log.Any("err", err), log.String("client", client))
+			forgetDuplicate(msg)
+			app.auditRejected(r.RemoteAddr, "chat.postMessage", client, request.Channel, msg.ID, err.Error())
+			reply(w, http.StatusServiceUnavailable, &SlackResponse{
+				Ok:    false,
+				Error: err.Error(),
+			})
+			return
 		}
+		for _, c := range copies {
+			app.auditMessage(c, auditEntry{Event: auditScheduled, Reason: "deliver at " + deliverAt.Format(time.RFC3339)})
+		}
+	} else if err := app.enqueueAll(copies); err != nil {
+		reply(w, http.StatusServiceUnavailable, &SlackResponse{
+			Ok:    false,
+			Error: "Queue is full",
+		})
 		return
 	}
 
+	// Respond, this is not entirely accurate as we have no idea if the message will be processed
+	// successfully.
+	// This is the downside of having a queue which could potentially delay responses by a lot.
+	// We do our due diligences on the received message and can make a fair assumption we will be able
+	// to process it.
+	// Application should utilize this application's metrics and logs to find out if there are any issues.
+	reply(w, http.StatusOK, &SlackResponse{
+		Ok:        true,
+		MessageID: msg.ID,
+	})
+}
+
+// clientName returns the name the caller identifies itself with, for the logs, audit and tee records. It
+// is purely informational, unlike the name of authenticated clients which replaces it.
+func clientName(r *http.Request) string {
+	return r.Header.Get(clientHeader)
+}
+
+// requestPriority returns the priority set by the header or, if not, the body field.
+func requestPriority(r *http.Request, bodyPriority string) (priority, error) {
+	if header := r.Header.Get(priorityHeader); header != "" {
+		return parsePriority(header)
+	}
+	return parsePriority(bodyPriority)
+}
+
+// queueAlmostFull returns true (and logs) when new requests of the given priority, queuing n messages
+// (e.g. the routed copies), should be rejected.
+func (app *App) queueAlmostFull(p priority, n int) bool {
+	maxQueueSize := int(float64(app.slackQueue.Cap()) * 0.9)
+	// The last 10% are reserved to the high priority messages, which are only rejected once the queue
+	// is completely full.
+	if p == priorityHigh {
+		maxQueueSize = app.slackQueue.Cap()
+	}
+	// Reject requests if the queue is almost full
+	// Ideally we don't reject at 90%, but initially after some tests I got blocked. So I decided to be
+	// a bit more conservative.
+	if app.slackQueue.Len()+n > maxQueueSize {
+		log.S(log.Warning, "Queue is almost full, returning StatusServiceUnavailable", log.Int("queueSize", app.slackQueue.Len()),
+			log.String("priority", p.String()))
+		return true
+	}
+	return false
+}
+
+// newQueuedMessage wraps the request with a new, unique, message id.
+func newQueuedMessage(request SlackPostMessageRequest, client string) *queuedMessage {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id) // never returns an error
+	return &queuedMessage{
+		ID:       hex.EncodeToString(id),
+		Client:   client,
+		Request:  request,
+		Priority: priorityNormal,
+		Received: time.Now(),
+	}
+}
+
+// enqueue hands a valid message over to processQueue. This is common to all the ingress paths (http,
+// cloudevents,...) and must only be called after queueAlmostFull() returned false. It doesn't wait for
+// room in the queue: errQueueFull (or errHeldFull, see quietSuppressor) is returned, and the message
+// counted as overflow, when it is full, for the caller to reject the request rather than blocking.
+func (app *App) enqueue(msg *queuedMessage) error {
+	accepted := msg.Request
+	msg.accepted = &accepted
 	// Start the logic (as we passed all our checks) to process the request.
-	app.metrics.RequestsReceivedTotal.WithLabelValues(request.Channel).Inc()
+	app.metrics.RequestsReceivedTotal.WithLabelValues(app.channelLabel(msg.Request.Channel)).Inc()
+	app.metrics.RequestsReceivedByClient.WithLabelValues(app.clientLabel(msg.Client)).Inc()
+	// Reactions are sent to the channel their message was posted to, already resolved (see
+	// resolveReaction), and don't notify anyone: the override, flood protection and quiet hours don't apply.
+	if msg.reaction != nil {
+		return app.pushWith(msg, app.slackQueue.TryPush)
+	}
 
 	// If the channelOverride flag is set, we override the channel for all messages.
 	// We still use the original channel for the metrics (see above).
 	if app.channelOverride != "" {
-		log.S(log.Debug, "Overriding channel", log.String("channelOverride", app.channelOverride), log.String("channel", request.Channel))
-		request.Channel = app.channelOverride
+		log.S(log.Debug, "Overriding channel", log.String("channelOverride", app.channelOverride), log.String("channel", msg.Request.Channel))
+		msg.Request.Channel = app.channelOverride
+	}
+	app.normalizeChannel(msg)
+
+	// Dropped (or sampled) while the channel is flooded.
+	if app.flood.check(app, msg) {
+		app.recordOutcome(msg, deliveryResult{Outcome: outcomeSuppressed, Error: "flood"})
+		return nil
+	}
+	// Held, downgraded or dropped during quiet hours and maintenance windows.
+	if suppressed, err := app.quiet.suppress(app, msg); suppressed {
+		return err
+	}
+	return app.pushWith(msg, app.slackQueue.TryPush)
+}
+
+// enqueueAll enqueues the copies of a request. It returns the error (e.g. errQueueFull) when none of
+// them could be queued, for the caller to reject the request; the copies that were are still posted (and the others
+// counted as overflow).
+func (app *App) enqueueAll(copies []*queuedMessage) error {
+	var err error
+	queued := 0
+	for _, c := range copies {
+		if err = app.enqueue(c); err == nil {
+			queued++
+		}
+	}
+	if queued > 0 {
+		return nil
+	}
+	return err
+}
+
+// push queues the message for processQueue, waiting while the queue is full. It is only for the
+// goroutines releasing messages (held, flood summaries), ingress paths use enqueue.
+func (app *App) push(msg *queuedMessage) {
+	_ = app.pushWith(msg, app.slackQueue.Push)
+}
+
+// pushFollowUp is push for processQueue itself, which can't wait for room in the queue: the message is
+// queued even when the queue is full (or closed, while draining it), see messageQueue.ForcePush.
+func (app *App) pushFollowUp(msg *queuedMessage) {
+	_ = app.pushWith(msg, app.slackQueue.ForcePush)
+}
+
+// pushWith queues the message with push, the messages it can't queue (full or closed) are dropped,
+// counted as overflow and push's error is returned.
+func (app *App) pushWith(msg *queuedMessage, push func(*queuedMessage) error) error {
+	// Merged into a digest that is already queued, nothing else to do.
+	if app.digests != nil {
+		if digest := app.digests.admit(msg); digest != nil {
+			app.auditMerged(msg, digest)
+			return nil
+		}
 	}
 
 	// Add a counter to the wait group, this is important to wait for all the messages to be processed
 	// before shutting down the server.
 	app.wg.Add(1)
 	// Send the message to the slackQueue to be processed
-	app.slackQueue <- request
+	msg.queued = time.Now()
+	if err := push(msg); err != nil {
+		app.wg.Done()
+		if app.digests != nil {
+			app.digests.done(msg)
+		}
+		label := app.channelLabel(msg.Request.Channel)
+		log.S(log.Error, "Dropping message", log.Any("err", err), log.String("channel", label), log.String("message_id", msg.ID),
+			log.Int("queueSize", app.slackQueue.Len()))
+		app.metrics.QueueOverflow.WithLabelValues(label).Inc()
+		app.recordOutcome(msg, deliveryResult{Outcome: outcomeFailed, Error: err.Error()})
+		return err
+	}
+	app.auditMessage(msg, auditEntry{Event: auditQueued})
 	// Update the queue size metric after any change on the queue size
-	app.metrics.QueueSize.With(nil).Set(float64(len(app.slackQueue)))
+	app.updateQueueSize()
+	return nil
+}
 
-	// Respond, this is not entirely accurate as we have no idea if the message will be processed
-	// successfully.
-	// This is the downside of having a queue which could potentially delay responses by a lot.
-	// We do our due diligences on the received message and can make a fair assumption we will be able
-	// to process it.
-	// Application should utilize this application's metrics and logs to find out if there are any issues.
-	err := jrpc.Reply[SlackResponse](w, http.StatusOK, &SlackResponse{
-		Ok: true,
-	})
+// reply sends the json response, logging (as there is nothing else we can do) write errors.
+func reply(w http.ResponseWriter, status int, response *SlackResponse) {
+	err := jrpc.Reply(w, status, response)
 	if err != nil {
 		log.S(log.Error, "Failed to write response", log.Any("err", err))
 	}
 }
 
-func validate(request SlackPostMessageRequest) error {
+// validate checks the request is complete and, when the channel directory is available (not nil), that
+// the channel exists. Messages with too many blocks are only accepted when they get split.
+func validate(request SlackPostMessageRequest, channels *channelDirectory, splitting bool) error {
 	var errorMessages []string
 
 	// Check if 'Channel' is set
 	if request.Channel == "" {
 		errorMessages = append(errorMessages, "Channel is not set")
+	} else if !channels.Exists(request.Channel) {
+		errorMessages = append(errorMessages, fmt.Sprintf("Channel %s not found", request.Channel))
 	}
 
 	// Check if at least one of 'attachments', 'blocks', or 'text' is set
@@ -143,6 +383,11 @@ func validate(request SlackPostMessageRequest) error {
 		errorMessages = append(errorMessages, "Neither attachments, blocks, nor text is set")
 	}
 
+	// Check the blocks and attachments are well formed, so Slack doesn't reject them later on.
+	if err := validateBlockKit(&request, splitting); err != nil {
+		errorMessages = append(errorMessages, "Invalid Block Kit: "+err.Error())
+	}
+
 	if len(errorMessages) > 0 {
 		return errors.New(strings.Join(errorMessages, " and "))
 	}
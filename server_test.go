@@ -51,7 +51,7 @@ func TestHandleRequest(t *testing.T) {
 			metrics := NewMetrics(r)
 
 			app := &App{
-				slackQueue: make(chan SlackPostMessageRequest, 10),
+				slackQueue: newMessageQueue(10, false),
 				metrics:    metrics,
 			}
 
@@ -71,6 +71,11 @@ func TestHandleRequest(t *testing.T) {
 				if err != nil {
 					t.Fatal(err)
 				}
+				// The receipt is random, so we only check there is one.
+				if response.Ok {
+					assert.NotEqual(t, "", response.MessageID, "accepted messages should get a receipt")
+					response.MessageID = ""
+				}
 				assert.Equal(t, tt.wantBody, response)
 			}
 		})
@@ -81,7 +86,7 @@ func TestStartServer(t *testing.T) {
 	r := prometheus.NewRegistry()
 	metrics := NewMetrics(r)
 	app := &App{
-		slackQueue: make(chan SlackPostMessageRequest, 10),
+		slackQueue: newMessageQueue(10, false),
 		metrics:    metrics,
 	}
 	testPort := ":9090"
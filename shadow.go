@@ -0,0 +1,166 @@
+// shadow.go
+
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+	"golang.org/x/time/rate"
+)
+
+// Shadow mode posts a sampled copy of the traffic to a second destination (e.g. a test workspace, a new
+// Slack app or slackURL) and compares the outcomes. The copies are posted once the primary delivery is
+// over, from their own goroutine and rate limiter and without retries, so they never delay the primary
+// path or use its retry budget.
+
+const (
+	// Environment variable with the token of the shadow destination.
+	shadowTokenEnv = "SHADOW_SLACK_TOKEN"
+	// Placeholder, in the shadow channel, for the name of the primary channel (without #).
+	shadowChannelPlaceholder = "{channel}"
+	shadowBufferSize         = 100
+	shadowOK                 = "ok"
+	shadowDropped            = "dropped"
+	shadowOtherError         = "other_error"
+)
+
+type shadowConfig struct {
+	URL     string
+	Token   string
+	Channel string  // e.g. "#shadow-{channel}", required as the primary channel may not exist there
+	Sample  float64 // fraction of the messages copied
+	Rate    time.Duration
+}
+
+type shadowCopy struct {
+	id      string
+	label   string
+	primary string
+	request SlackPostMessageRequest
+}
+
+// shadow is safe for concurrent use, a nil shadow copies nothing.
+type shadow struct {
+	config    shadowConfig
+	messenger SlackMessenger
+	metrics   *Metrics
+	limiter   *rate.Limiter
+	copies    chan shadowCopy
+	wg        sync.WaitGroup
+	// Canceled once Close's deadline is reached, the copies still buffered are dropped.
+	ctx    context.Context //nolint:containedctx // the copies are posted from run, which outlives the callers
+	cancel context.CancelFunc
+	random func() float64 // for tests
+}
+
+func newShadow(config shadowConfig, messenger SlackMessenger, metrics *Metrics) *shadow {
+	s := &shadow{
+		config:    config,
+		messenger: messenger,
+		metrics:   metrics,
+		limiter:   rate.NewLimiter(rate.Every(config.Rate), 1),
+		copies:    make(chan shadowCopy, shadowBufferSize),
+		random:    rand.Float64,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+// resultCode is "ok" or the Slack error code, other errors (network,...) are grouped to keep the metrics
+// cardinality low.
+func resultCode(err string) string {
+	if err == "" {
+		return shadowOK
+	}
+	if _, _, description := CheckError(err); description == "Unknown error" {
+		return shadowOtherError
+	}
+	return err
+}
+
+// channel returns the shadow channel for the primary channel's label.
+func (s *shadow) channel(label string) string {
+	return strings.ReplaceAll(s.config.Channel, shadowChannelPlaceholder, strings.TrimPrefix(label, "#"))
+}
+
+// Compare queues, if sampled, a copy of the message to compare with its primary result. Only the
+// messages Slack was asked to post (or refused) are compared, not the expired or suppressed ones.
+func (s *shadow) Compare(app *App, msg *queuedMessage, result deliveryResult) {
+	if s == nil || msg.upload != nil || msg.reaction != nil {
+		return
+	}
+	switch result.Outcome {
+	case outcomePosted, outcomeFailed, outcomeNotProcessed:
+	default:
+		return
+	}
+	if s.random() >= s.config.Sample {
+		return
+	}
+	label := app.channelLabel(msg.Request.Channel)
+	request := msg.Request
+	request.Channel = s.channel(label)
+	request.Token = ""
+	request.ThreadTS = "" // the threads only exist in the primary workspace
+	request.ReplyBroadcast = false
+	primary := resultCode(result.Error)
+	c := shadowCopy{id: msg.ID, label: label, primary: primary, request: request}
+	select {
+	case s.copies <- c:
+	default:
+		s.metrics.ShadowResults.WithLabelValues(primary, shadowDropped).Inc()
+	}
+}
+
+func (s *shadow) run() {
+	defer s.wg.Done()
+	for c := range s.copies {
+		if s.limiter.Wait(s.ctx) != nil {
+			s.metrics.ShadowResults.WithLabelValues(c.primary, shadowDropped).Inc()
+			continue
+		}
+		shadowErr := ""
+		if _, err := s.messenger.PostMessage(s.ctx, c.request, s.config.URL, s.config.Token); err != nil {
+			if s.ctx.Err() != nil {
+				s.metrics.ShadowResults.WithLabelValues(c.primary, shadowDropped).Inc()
+				continue
+			}
+			shadowErr = err.Error()
+		}
+		result := resultCode(shadowErr)
+		s.metrics.ShadowResults.WithLabelValues(c.primary, result).Inc()
+		if result != c.primary {
+			log.S(log.Info, "Shadow result diverged", log.String("channel", c.label), log.String("message_id", c.id),
+				log.String("primary", c.primary), log.String("shadow", result), log.String("shadow_error", shadowErr))
+			s.metrics.ShadowDivergences.WithLabelValues(c.label).Inc()
+		}
+	}
+}
+
+// Close posts the queued copies and stops. The copies not posted yet once ctx is done are dropped.
+func (s *shadow) Close(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	close(s.copies)
+	stopped := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.S(log.Warning, "Dropping the shadow copies not posted yet", log.Any("err", ctx.Err()))
+		s.cancel()
+		<-stopped
+	}
+	s.cancel()
+}
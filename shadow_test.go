@@ -0,0 +1,62 @@
+// shadow_test.go
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestShadow(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	// The shadow workspace refuses the messages to #shadow-ok, but takes the ones to #shadow-bad.
+	shadowMessenger := &FailingChannelSlackMessenger{failChannel: "#shadow-ok"}
+	shadow := newShadow(shadowConfig{URL: "https://shadow.example.com", Token: "xoxb-shadow",
+		Channel: "#shadow-{channel}", Sample: 0.5, Rate: time.Millisecond}, shadowMessenger, metrics)
+	sampled := []float64{0.1, 0.9, 0.2}
+	shadow.random = func() float64 {
+		r := sampled[0]
+		sampled = sampled[1:]
+		return r
+	}
+	messenger := &FailingChannelSlackMessenger{failChannel: "#bad"}
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		messenger:  messenger,
+		metrics:    metrics,
+		shadow:     shadow,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.processQueue(ctx, 2, time.Millisecond, 10, time.Millisecond)
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Token: "xoxb-primary", Channel: "#ok", Text: "a"}, "")))
+	app.wg.Wait()
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#ok", Text: "not sampled"}, "")))
+	app.wg.Wait()
+	assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#bad", Text: "c", ThreadTS: "1700000000.000001"}, "")))
+	app.wg.Wait()
+	shadow.Close(context.Background())
+
+	assert.Equal(t, 2, len(messenger.Requests()), "the primary path isn't affected by the shadow failures")
+	assert.Equal(t, 1, len(shadowMessenger.Requests()))
+	copied := shadowMessenger.Requests()[0]
+	assert.Equal(t, "#shadow-bad", copied.Channel)
+	assert.Equal(t, "", copied.Token)
+	assert.Equal(t, "", copied.ThreadTS)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.ShadowResults.WithLabelValues("ok", "invalid_blocks")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.ShadowResults.WithLabelValues("invalid_blocks", "ok")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.ShadowDivergences.WithLabelValues("#ok")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.ShadowDivergences.WithLabelValues("#bad")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.RequestsRetriedTotal.WithLabelValues("#ok")))
+}
+
+func TestResultCode(t *testing.T) {
+	assert.Equal(t, "ok", resultCode(""))
+	assert.Equal(t, "channel_not_found", resultCode("channel_not_found"))
+	assert.Equal(t, "other_error", resultCode("dial tcp: connection refused"))
+}
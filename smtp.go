@@ -0,0 +1,415 @@
+// smtp.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// Minimal SMTP server (RFC 5321 subset, no auth nor TLS) so tools that can only send emails can post to
+// Slack. Recipients are mapped to channels, the subject and plain text body become the message.
+
+const (
+	smtpClient         = "smtp"
+	smtpCommandTimeout = 5 * time.Minute
+	// Emails can be much longer than what is readable in a channel.
+	smtpMaxBodyLength = 4000
+	// RFC 5321 requires accepting at least 100 recipients, more are refused (the sender retries them).
+	smtpMaxRecipients = 100
+	// Further connections are refused (the senders retry later), like for syslog.
+	smtpMaxConnections = 100
+)
+
+type smtpIngress struct {
+	Addr string
+	// Domain, when set, maps any local part to the channel of the same name, e.g. team-infra@Domain
+	// to #team-infra.
+	Domain string
+	// Recipients maps (lower case) addresses to channels, it takes precedence over Domain.
+	Recipients map[string]string
+	// MaxSize is the maximum size of a message (headers included) in bytes.
+	MaxSize int64
+	// Bound listener, set by start().
+	listener net.Listener
+}
+
+func loadSMTPRecipients(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var recipients map[string]string
+	err = json.Unmarshal(data, &recipients)
+	if err != nil {
+		return nil, err
+	}
+	normalized := make(map[string]string, len(recipients))
+	for address, channel := range recipients {
+		normalized[strings.ToLower(address)] = channel
+	}
+	return normalized, nil
+}
+
+// channel returns the channel for the recipient address, empty if it isn't one of ours.
+func (s *smtpIngress) channel(address string) string {
+	address = strings.ToLower(address)
+	if channel, found := s.Recipients[address]; found {
+		return channel
+	}
+	local, domain, found := strings.Cut(address, "@")
+	if found && local != "" && s.Domain != "" && domain == strings.ToLower(s.Domain) {
+		return "#" + local
+	}
+	return ""
+}
+
+// start binds the listener and serves it until the context is canceled.
+func (s *smtpIngress) start(ctx context.Context, app *App) error {
+	var err error
+	s.listener, err = net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("smtp listener: %w", err)
+	}
+	log.S(log.Info, "SMTP listener started", log.String("addr", s.listener.Addr().String()))
+	go func() {
+		<-ctx.Done()
+		s.listener.Close()
+	}()
+	go s.serve(ctx, app)
+	return nil
+}
+
+func (s *smtpIngress) serve(ctx context.Context, app *App) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	connections := make(chan struct{}, smtpMaxConnections)
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.S(log.Error, "SMTP accept error", log.Any("err", err))
+			}
+			return
+		}
+		select {
+		case connections <- struct{}{}:
+		default:
+			log.S(log.Warning, "Too many SMTP connections, refusing", log.String("remote", conn.RemoteAddr().String()),
+				log.Int("max", smtpMaxConnections))
+			_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+			_, _ = io.WriteString(conn, "421 4.3.2 Too many connections, try again later\r\n")
+			conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-connections }()
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			defer stop()
+			defer conn.Close()
+			s.session(app, conn)
+		}()
+	}
+}
+
+// smtpEnvelope is the state of the current mail transaction.
+type smtpEnvelope struct {
+	remote   string
+	from     string
+	channels []string
+}
+
+// session handles one client connection.
+func (s *smtpIngress) session(app *App, conn net.Conn) {
+	c := textproto.NewConn(conn)
+	remote := conn.RemoteAddr().String()
+	hostname, _ := os.Hostname()
+	var env *smtpEnvelope
+	replyLine := func(format string, args ...any) bool {
+		err := c.PrintfLine(format, args...)
+		if err != nil {
+			log.S(log.Warning, "SMTP write error", log.Any("err", err), log.String("remote", remote))
+		}
+		return err == nil
+	}
+	if !replyLine("220 %s slack-proxy ESMTP ready", hostname) {
+		return
+	}
+	for {
+		_ = conn.SetDeadline(time.Now().Add(smtpCommandTimeout))
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		var ok bool
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			ok = replyLine("250 %s", hostname)
+		case "EHLO":
+			ok = replyLine("250-%s\r\n250-8BITMIME\r\n250-SIZE %d\r\n250 SMTPUTF8", hostname, s.MaxSize)
+		case "MAIL":
+			from, found := smtpPathArg(arg, "FROM:")
+			if !found {
+				ok = replyLine("501 5.5.4 Syntax: MAIL FROM:<address>")
+				break
+			}
+			env = &smtpEnvelope{remote: remote, from: from}
+			ok = replyLine("250 2.1.0 OK")
+		case "RCPT":
+			to, found := smtpPathArg(arg, "TO:")
+			switch {
+			case env == nil:
+				ok = replyLine("503 5.5.1 MAIL first")
+			case !found:
+				ok = replyLine("501 5.5.4 Syntax: RCPT TO:<address>")
+			case s.channel(to) == "":
+				ok = replyLine("550 5.1.1 <%s>: no channel for this recipient", to)
+			case slices.Contains(env.channels, s.channel(to)):
+				// The same address twice, or another one for the same channel: posted once.
+				ok = replyLine("250 2.1.5 OK")
+			case len(env.channels) >= smtpMaxRecipients:
+				ok = replyLine("452 4.5.3 Too many recipients")
+			default:
+				env.channels = append(env.channels, s.channel(to))
+				ok = replyLine("250 2.1.5 OK")
+			}
+		case "DATA":
+			if env == nil || len(env.channels) == 0 {
+				ok = replyLine("503 5.5.1 RCPT first")
+				break
+			}
+			if !replyLine("354 End data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			ok = s.data(app, c, env, replyLine)
+			env = nil
+		case "RSET":
+			env = nil
+			ok = replyLine("250 2.0.0 OK")
+		case "NOOP":
+			ok = replyLine("250 2.0.0 OK")
+		case "VRFY":
+			ok = replyLine("252 2.5.0 Cannot VRFY user")
+		case "QUIT":
+			replyLine("221 2.0.0 Bye")
+			return
+		default:
+			ok = replyLine("502 5.5.2 Command not implemented")
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// smtpPathArg extracts the address from "FROM:<address> [params]" style arguments.
+func smtpPathArg(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+	start := strings.IndexByte(path, '<')
+	end := strings.IndexByte(path, '>')
+	if start != 0 || end < start {
+		return "", false
+	}
+	return path[1:end], true
+}
+
+// data reads the message and enqueues it for each recipient channel. It returns false if the connection
+// should be closed.
+func (s *smtpIngress) data(app *App, c *textproto.Conn, env *smtpEnvelope, replyLine func(string, ...any) bool) bool {
+	dr := c.DotReader()
+	raw, err := io.ReadAll(io.LimitReader(dr, s.MaxSize+1))
+	if err != nil {
+		return false
+	}
+	if int64(len(raw)) > s.MaxSize {
+		env.reject(app, "Message too big")
+		// Drain the rest so the connection is left in a sane state.
+		_, err = io.Copy(io.Discard, dr)
+		return err == nil && replyLine("552 5.3.4 Message too big")
+	}
+	subject, body, messageID, err := parseEmail(bytes.NewReader(raw))
+	if err != nil {
+		log.S(log.Warning, "Invalid email", log.Any("err", err), log.String("from", env.from))
+		env.reject(app, err.Error())
+		return replyLine("554 5.6.0 Invalid message: %s", err)
+	}
+	text := formatEmail(subject, env.from, body)
+	msgs := make([]*queuedMessage, len(env.channels))
+	routed := make([][]*queuedMessage, len(env.channels))
+	var copies []*queuedMessage
+	for i, channel := range env.channels {
+		msgs[i] = newQueuedMessage(SlackPostMessageRequest{Channel: channel, Text: text}, smtpClient)
+		app.auditMessage(msgs[i], auditEntry{Event: auditReceived, Remote: env.remote})
+		app.setExpiry(msgs[i], 0)
+		routed[i] = app.route(msgs[i], nil)
+		copies = append(copies, routed[i]...)
+	}
+	// Like for the http requests, the whole message is rejected when any of its destinations is invalid
+	// or denied, rather than posting it to some of them.
+	if err = app.validateCopies(copies); err != nil {
+		log.S(log.Warning, "Invalid email", log.Any("err", err), log.String("from", env.from))
+		env.reject(app, err.Error())
+		return replyLine("554 5.6.0 Invalid message: %s", err)
+	}
+	if err = app.checkPolicy("", env.remote, copies); err != nil {
+		return replyLine("550 5.7.1 %s", err)
+	}
+	if app.queueAlmostFull(priorityNormal, len(copies)) {
+		env.reject(app, "Queue is almost full")
+		return replyLine("451 4.3.0 Queue is almost full, try again later")
+	}
+	// Once a channel got the message, the sender can't be asked to retry (it would retry them all): the
+	// channels still finding the queue full are dropped (and counted as overflow).
+	queued, full := 0, false
+	for i, msg := range msgs {
+		// Mail servers retry the deliveries they aren't sure about with the same Message-ID.
+		key := ""
+		if messageID != "" {
+			key = messageID + "\x00" + env.channels[i]
+		}
+		if original, duplicate := app.duplicateOf(key, msg, routed[i]); duplicate {
+			log.S(log.Info, "Duplicate email, not posting it again", log.String("channel", env.channels[i]),
+				log.String("message_id", original))
+			app.metrics.RequestsDeduplicated.WithLabelValues(app.channelLabel(env.channels[i])).Inc()
+			app.auditMessage(msg, auditEntry{Event: auditDeduplicated, Reason: "duplicate of " + original})
+			continue
+		}
+		if err = app.enqueueAll(routed[i]); err != nil {
+			full = true
+			continue
+		}
+		queued++
+	}
+	if full && queued == 0 {
+		return replyLine("451 4.3.0 Queue is full, try again later")
+	}
+	return replyLine("250 2.0.0 OK queued for %d channel(s)", len(env.channels))
+}
+
+// reject audits the rejection of the message, for each of its channels.
+func (env *smtpEnvelope) reject(app *App, reason string) {
+	for _, channel := range env.channels {
+		app.auditRejected(env.remote, "chat.postMessage", smtpClient, channel, "", reason)
+	}
+}
+
+// parseEmail returns the decoded subject, plain text body and Message-ID of the message.
+func parseEmail(r io.Reader) (string, string, string, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return "", "", "", err
+	}
+	decoder := &mime.WordDecoder{CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	}}
+	subject, err := decoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	body, err := plainTextBody(textproto.MIMEHeader(msg.Header), msg.Body)
+	return subject, body, msg.Header.Get("Message-Id"), err
+}
+
+// plainTextBody finds the (first) text/plain part, recursing into multipart messages.
+func plainTextBody(header textproto.MIMEHeader, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// Missing (or broken) content type defaults to text/plain.
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if errors.Is(err, io.EOF) {
+				return "", nil
+			}
+			if err != nil {
+				return "", err
+			}
+			// NextPart already decoded quoted-printable parts.
+			text, err := plainTextBody(part.Header, part)
+			if err != nil || text != "" {
+				return text, err
+			}
+		}
+	}
+	if mediaType != "text/plain" {
+		return "", nil
+	}
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	text, err := decodeCharset(params["charset"], raw)
+	return strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n")), err
+}
+
+// decodeCharset converts the text, in the given charset (e.g. iso-8859-1 or windows-1252), to UTF-8.
+// Unknown charsets are an error rather than garbled text in the channel.
+func decodeCharset(charset string, text []byte) (string, error) {
+	if charset == "" || strings.EqualFold(charset, "utf-8") || strings.EqualFold(charset, "us-ascii") {
+		return string(text), nil
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return "", fmt.Errorf("unsupported charset %q", charset)
+	}
+	decoded, err := enc.NewDecoder().Bytes(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s text: %w", charset, err)
+	}
+	return string(decoded), nil
+}
+
+// slackEscaper escapes the characters with a special meaning in Slack's mrkdwn.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func formatEmail(subject, from, body string) string {
+	if subject == "" {
+		subject = "(no subject)"
+	}
+	if body == "" {
+		body = "(no plain text body)"
+	}
+	if len(body) > smtpMaxBodyLength {
+		body = strings.ToValidUTF8(body[:smtpMaxBodyLength], "") + "\n… (truncated)"
+	}
+	return fmt.Sprintf(":email: *%s*\n_From: %s_\n%s", slackEscaper.Replace(subject), slackEscaper.Replace(from),
+		slackEscaper.Replace(body))
+}
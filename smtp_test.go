@@ -0,0 +1,191 @@
+// smtp_test.go
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseEmail(t *testing.T) {
+	tests := []struct {
+		name        string
+		email       string
+		wantSubject string
+		wantBody    string
+	}{
+		{
+			name:        "plain",
+			email:       "Subject: Disk full\r\n\r\n/var is at 99%\r\n",
+			wantSubject: "Disk full",
+			wantBody:    "/var is at 99%",
+		},
+		{
+			name: "encoded subject and quoted-printable body",
+			email: "Subject: =?UTF-8?Q?Caf=C3=A9_alert?=\r\nContent-Type: text/plain; charset=utf-8\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n\r\nsoft=\r\nwrapped line =E2=9C=93\r\n",
+			wantSubject: "Café alert",
+			wantBody:    "softwrapped line ✓",
+		},
+		{
+			name: "multipart alternative",
+			email: "Subject: Build failed\r\nContent-Type: multipart/alternative; boundary=XX\r\n\r\n" +
+				"--XX\r\nContent-Type: text/html\r\n\r\n<b>html</b>\r\n" +
+				"--XX\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\ncGxhaW4gdGV4dA==\r\n" +
+				"--XX--\r\n",
+			wantSubject: "Build failed",
+			wantBody:    "plain text",
+		},
+		{
+			name:        "html only",
+			email:       "Subject: x\r\nContent-Type: text/html\r\n\r\n<b>html</b>\r\n",
+			wantSubject: "x",
+			wantBody:    "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject, body, _, err := parseEmail(strings.NewReader(tt.email))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantSubject, subject)
+			assert.Equal(t, tt.wantBody, body)
+		})
+	}
+}
+
+func TestParseEmail_Charset(t *testing.T) {
+	subject, body, _, err := parseEmail(strings.NewReader("Subject: =?windows-1252?Q?=80_caf=E9?=\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nd=E9j=E0 vu\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "€ café", subject)
+	assert.Equal(t, "déjà vu", body)
+	_, _, _, err = parseEmail(strings.NewReader("Subject: x\r\nContent-Type: text/plain; charset=x-unknown\r\n\r\ny\r\n"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `unsupported charset "x-unknown"`)
+}
+
+func TestFormatEmail(t *testing.T) {
+	assert.Equal(t, ":email: *a &lt;b&gt;*\n_From: ci@example.com_\nx &amp; y",
+		formatEmail("a <b>", "ci@example.com", "x & y"))
+	assert.Equal(t, ":email: *(no subject)*\n_From: _\n(no plain text body)", formatEmail("", "", ""))
+	long := formatEmail("s", "f", strings.Repeat("é", smtpMaxBodyLength))
+	assert.True(t, strings.HasSuffix(long, "é\n… (truncated)"), "should truncate on a rune boundary")
+}
+
+func TestSMTPRecipients(t *testing.T) {
+	s := &smtpIngress{Domain: "Proxy.Local", Recipients: map[string]string{"oncall@example.com": "#pager"}}
+	assert.Equal(t, "#pager", s.channel("OnCall@example.com"))
+	assert.Equal(t, "#team-infra", s.channel("team-infra@proxy.local"))
+	assert.Equal(t, "", s.channel("team-infra@elsewhere.com"))
+	assert.Equal(t, "", s.channel("@proxy.local"))
+}
+
+func TestSMTPServer(t *testing.T) {
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+	}
+	s := &smtpIngress{
+		Addr: "127.0.0.1:0", Domain: "proxy.local", MaxSize: 1024,
+		Recipients: map[string]string{"infra-oncall@example.com": "#team-infra"},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, s.start(ctx, app))
+	addr := s.listener.Addr().String()
+
+	err := smtp.SendMail(addr, nil, "alerts@vendor.com",
+		[]string{"team-infra@proxy.local", "team-db@proxy.local", "team-infra@proxy.local", "infra-oncall@example.com"},
+		[]byte("Subject: Backup failed\r\n\r\nThe nightly backup failed.\r\n.starting with a dot\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, app.slackQueue.Len())
+	first := app.slackQueue.next().Request
+	second := app.slackQueue.next().Request
+	assert.Equal(t, "#team-infra", first.Channel)
+	assert.Equal(t, "#team-db", second.Channel)
+	want := ":email: *Backup failed*\n_From: alerts@vendor.com_\nThe nightly backup failed.\n.starting with a dot"
+	assert.Equal(t, want, first.Text)
+	assert.Equal(t, want, second.Text)
+	assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.RequestsReceivedTotal.WithLabelValues("#team-db")))
+
+	err = smtp.SendMail(addr, nil, "alerts@vendor.com", []string{"nobody@example.com"}, []byte("Subject: x\r\n\r\ny\r\n"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "<nobody@example.com>: no channel for this recipient")
+
+	err = smtp.SendMail(addr, nil, "alerts@vendor.com", []string{"big@proxy.local"},
+		[]byte("Subject: big\r\n\r\n"+strings.Repeat("x", 2048)+"\r\n"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Message too big")
+	assert.Equal(t, 0, app.slackQueue.Len())
+
+	client, err := smtp.Dial(addr)
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.NoError(t, client.Mail("alerts@vendor.com"))
+	for i := range smtpMaxRecipients {
+		assert.NoError(t, client.Rcpt(fmt.Sprintf("team-%d@proxy.local", i)))
+	}
+	err = client.Rcpt("one-too-many@proxy.local")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Too many recipients")
+}
+
+func TestSMTPServer_PolicyAndDedup(t *testing.T) {
+	app, _ := newPolicyTestApp(t)
+	app.dedup = newDedupCache(time.Hour)
+	s := &smtpIngress{Addr: "127.0.0.1:0", Domain: "proxy.local", MaxSize: 1024}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, s.start(ctx, app))
+	addr := s.listener.Addr().String()
+
+	// Not from a policy network, so the default rule applies.
+	err := smtp.SendMail(addr, nil, "alerts@vendor.com", []string{"public-news@proxy.local", "exec-staff@proxy.local"},
+		[]byte("Subject: hi\r\n\r\nhello\r\n"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "client anonymous is not allowed to post to #exec-staff: not in the allowlist")
+	assert.Equal(t, 0, app.slackQueue.Len(), "rejected as a whole")
+
+	email := []byte("Message-ID: <1@vendor.com>\r\nSubject: hi\r\n\r\nhello\r\n")
+	assert.NoError(t, smtp.SendMail(addr, nil, "alerts@vendor.com", []string{"public-news@proxy.local"}, email))
+	assert.NoError(t, smtp.SendMail(addr, nil, "alerts@vendor.com", []string{"public-news@proxy.local", "public-jobs@proxy.local"}, email))
+	assert.Equal(t, 2, app.slackQueue.Len(), "the retried delivery is only posted to the new recipient")
+	assert.Equal(t, "#public-news", app.slackQueue.next().Request.Channel)
+	assert.Equal(t, "#public-jobs", app.slackQueue.next().Request.Channel)
+	assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.RequestsDeduplicated.WithLabelValues("#public-news")))
+}
+
+func TestSMTPServer_MaxConnections(t *testing.T) {
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+	}
+	s := &smtpIngress{Addr: "127.0.0.1:0", Domain: "proxy.local", MaxSize: 1024}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, s.start(ctx, app))
+	addr := s.listener.Addr().String()
+
+	greeting := func() string {
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		assert.NoError(t, err)
+		return line
+	}
+	for range smtpMaxConnections {
+		assert.True(t, strings.HasPrefix(greeting(), "220 "))
+	}
+	assert.Equal(t, "421 4.3.2 Too many connections, try again later\r\n", greeting())
+}
@@ -0,0 +1,186 @@
+// split.go
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"fortio.org/log"
+)
+
+// Long texts (log excerpts,...) fail with msg_too_long, a permanent error, and more than 50 blocks are
+// rejected too. When enabled, such messages are split instead: the text at line boundaries (keeping
+// code fences balanced) and the blocks in chunks of 50. The first part is posted as is and the others
+// follow as replies in its thread or, for the overflowing text, as a snippet file.
+
+const (
+	splitThread  = "thread"
+	splitSnippet = "snippet"
+	codeFence    = "```"
+	// Fence lines longer than this aren't considered as opening a code block.
+	maxFenceLine = 64
+	snippetNote  = "\n_… continued in the snippet below_"
+)
+
+// splitText cuts the text in parts of at most limit bytes, preferably between lines. A part ending
+// within a code block gets a closing fence and the next one reopens it. It also returns where each part
+// ends in the text.
+func splitText(text string, limit int) ([]string, []int) {
+	if len(text) <= limit {
+		return []string{text}, []int{len(text)}
+	}
+	closing := "\n" + codeFence
+	var parts []string
+	var ends []int
+	var b strings.Builder
+	fence := "" // opening line of the code block we are in, if any
+	start := 0  // length of the reopened fence at the start of the part
+	offset := 0 // in text
+	flush := func() {
+		part := b.String()
+		if fence != "" {
+			part = strings.TrimRight(part, "\n") + closing
+		}
+		parts = append(parts, part)
+		ends = append(ends, offset)
+		b.Reset()
+		if fence != "" {
+			b.WriteString(fence + "\n")
+		}
+		start = b.Len()
+	}
+	for line := range strings.SplitAfterSeq(text, "\n") {
+		for line != "" {
+			trimmed := strings.TrimSpace(line)
+			room := limit - b.Len() - len(closing)
+			if fence != "" && trimmed == codeFence {
+				room += len(closing) // no need for ours then
+			}
+			if len(line) <= room {
+				b.WriteString(line)
+				offset += len(line)
+				switch {
+				case !strings.HasPrefix(trimmed, codeFence) || len(trimmed) > maxFenceLine:
+				case fence == "":
+					fence = trimmed
+				default:
+					fence = ""
+				}
+				break
+			}
+			if b.Len() > start {
+				flush()
+				continue
+			}
+			// A single line longer than a whole part, cut it (at a rune boundary).
+			cut := max(room, 1)
+			for cut > 1 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			b.WriteString(line[:cut])
+			offset += cut
+			line = line[cut:]
+			flush()
+		}
+	}
+	if b.Len() > start {
+		parts = append(parts, b.String())
+		ends = append(ends, offset)
+	}
+	return parts, ends
+}
+
+// chunkBlocks cuts the blocks array in arrays of at most maxBlocks blocks. Blocks which can't be
+// parsed are returned as is, validate() already rejected invalid ones.
+func chunkBlocks(blocks json.RawMessage) []json.RawMessage {
+	var list []json.RawMessage
+	if len(blocks) == 0 || json.Unmarshal(blocks, &list) != nil || len(list) <= maxBlocks {
+		return []json.RawMessage{blocks}
+	}
+	var chunks []json.RawMessage
+	for i := 0; i < len(list); i += maxBlocks {
+		chunk, _ := json.Marshal(list[i:min(i+maxBlocks, len(list))])
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// splitMessage splits the message, when enabled and needed, keeping the first part as the message and
+// the others as its follow ups (queued once it is posted, see queueFollowUps).
+func (app *App) splitMessage(msg *queuedMessage) {
+	if app.splitMode == "" || msg.upload != nil {
+		return
+	}
+	limit := app.splitLength
+	if app.splitMode == splitSnippet {
+		limit -= len(snippetNote)
+	}
+	texts, ends := splitText(msg.Request.Text, limit)
+	blocks := chunkBlocks(msg.Request.Blocks)
+	if len(texts) == 1 && len(blocks) == 1 {
+		return
+	}
+	log.S(log.Info, "Splitting oversized message", log.String("channel", msg.Request.Channel),
+		log.String("message_id", msg.ID), log.Int("texts", len(texts)), log.Int("block_chunks", len(blocks)))
+	followUp := func(request SlackPostMessageRequest) {
+		part := *msg
+		part.ID = fmt.Sprintf("%s-part%d", msg.ID, len(msg.followUps)+2)
+		part.ThreadKey = ""
+		part.followUps = nil
+		part.digest = nil
+		part.Expires = time.Time{} // the rest of a posted message is posted too
+		part.Request = request
+		part.accepted = nil // the replayed message gets split again
+		msg.followUps = append(msg.followUps, &part)
+	}
+	base := msg.Request
+	base.Attachments = nil
+	base.ReplyBroadcast = false
+	if app.splitMode == splitSnippet && len(texts) > 1 {
+		overflow := msg.Request.Text[ends[0]:]
+		texts = texts[:1]
+		texts[0] += snippetNote
+		upload := base
+		upload.Text, upload.Blocks = "", nil
+		followUp(upload)
+		msg.followUps[0].upload = &slackFile{
+			Filename:    msg.ID + ".txt",
+			Title:       "Continuation",
+			SnippetType: "text",
+			Content:     []byte(overflow),
+		}
+	}
+	for i := 1; i < max(len(texts), len(blocks)); i++ {
+		request := base
+		request.Text, request.Blocks = "", nil
+		if i < len(texts) {
+			request.Text = texts[i]
+		}
+		if i < len(blocks) {
+			request.Blocks = blocks[i]
+		}
+		followUp(request)
+	}
+	msg.Request.Text = texts[0]
+	msg.Request.Blocks = blocks[0]
+}
+
+// queueFollowUps queues the other parts of a split message, as replies in the thread of the first one.
+func (app *App) queueFollowUps(msg *queuedMessage, response SlackResponse) {
+	threadTS := msg.Request.ThreadTS // when the first part already is a reply
+	if threadTS == "" {
+		threadTS = response.TS
+	}
+	for _, part := range msg.followUps {
+		if response.Channel != "" {
+			part.Request.Channel = response.Channel // the id, needed for the uploads
+		}
+		part.Request.ThreadTS = threadTS
+		app.pushFollowUp(part)
+	}
+	msg.followUps = nil
+}
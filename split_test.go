@@ -0,0 +1,126 @@
+// split_test.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// UploadingSlackMessenger also records the file uploads.
+type UploadingSlackMessenger struct {
+	RecordingSlackMessenger
+	mu      sync.Mutex
+	uploads []recordedUpload
+}
+
+type recordedUpload struct {
+	file              slackFile
+	channel, threadTS string
+}
+
+func (m *UploadingSlackMessenger) UploadFile(_ context.Context, file *slackFile, channel, threadTS, _, _ string) (SlackResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploads = append(m.uploads, recordedUpload{*file, channel, threadTS})
+	return SlackResponse{Ok: true}, nil
+}
+
+func TestSplitText(t *testing.T) {
+	parts, ends := splitText("short", 100)
+	assert.Equal(t, []string{"short"}, parts)
+	assert.Equal(t, []int{5}, ends)
+
+	text := "line one\nline two\nline three\n"
+	parts, ends = splitText(text, 24)
+	assert.Equal(t, []string{"line one\nline two\n", "line three\n"}, parts)
+	assert.Equal(t, []int{18, len(text)}, ends)
+
+	text = "log:\n```go\na := 1\nb := 2\nc := 3\n```\ndone"
+	parts, _ = splitText(text, 26)
+	assert.Equal(t, []string{"log:\n```go\na := 1\n```", "```go\nb := 2\nc := 3\n```\n", "done"}, parts)
+	for _, part := range parts {
+		assert.True(t, len(part) <= 26, part)
+		assert.Equal(t, 0, strings.Count(part, "```")%2, "balanced fences: "+part)
+	}
+
+	long := strings.Repeat("é", 30) // 60 bytes
+	parts, ends = splitText(long, 25)
+	assert.Equal(t, long, strings.Join(parts, ""))
+	assert.Equal(t, len(long), ends[len(ends)-1])
+	for _, part := range parts {
+		assert.True(t, len(part) <= 25 && strings.Count(part, "�") == 0, part)
+	}
+}
+
+func TestChunkBlocks(t *testing.T) {
+	blocks := json.RawMessage("[" + strings.Repeat(`{"type":"divider"},`, 119) + `{"type":"divider"}]`)
+	chunks := chunkBlocks(blocks)
+	assert.Equal(t, 3, len(chunks))
+	for i, want := range []int{50, 50, 20} {
+		var list []json.RawMessage
+		assert.NoError(t, json.Unmarshal(chunks[i], &list))
+		assert.Equal(t, want, len(list))
+	}
+	small := json.RawMessage(`[{"type":"divider"}]`)
+	assert.Equal(t, []json.RawMessage{small}, chunkBlocks(small))
+}
+
+func runSplit(t *testing.T, mode string, request SlackPostMessageRequest) *UploadingSlackMessenger {
+	t.Helper()
+	messenger := &UploadingSlackMessenger{}
+	app := &App{
+		slackQueue:  newMessageQueue(10, false),
+		messenger:   messenger,
+		metrics:     NewMetrics(prometheus.NewRegistry()),
+		splitMode:   mode,
+		splitLength: 1000,
+	}
+	assert.NoError(t, app.enqueue(newQueuedMessage(request, "")))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.processQueue(ctx, 0, time.Millisecond, 10, time.Millisecond)
+	app.wg.Wait()
+	return messenger
+}
+
+func TestSplitMessage_Thread(t *testing.T) {
+	line := strings.Repeat("x", 99) + "\n"
+	text := strings.Repeat(line, 25) // 2500 bytes
+	blocks := json.RawMessage("[" + strings.Repeat(`{"type":"divider"},`, 59) + `{"type":"divider"}]`)
+	messenger := runSplit(t, splitThread, SlackPostMessageRequest{Channel: "#logs", Text: text, Blocks: blocks})
+	requests := messenger.Requests()
+	assert.Equal(t, 3, len(requests))
+	assert.Equal(t, strings.Repeat(line, 9), requests[0].Text)
+	assert.Equal(t, "#logs", requests[0].Channel)
+	assert.Equal(t, "", requests[0].ThreadTS)
+	for _, r := range requests[1:] {
+		assert.Equal(t, "C123", r.Channel)
+		assert.Equal(t, "1700000000.000001", r.ThreadTS, "reply to the first part")
+	}
+	assert.Equal(t, text, requests[0].Text+requests[1].Text+requests[2].Text)
+	assert.True(t, len(requests[1].Blocks) > 0 && len(requests[2].Blocks) == 0, "second chunk of blocks with the second text")
+	assert.Equal(t, 0, len(messenger.uploads))
+}
+
+func TestSplitMessage_Snippet(t *testing.T) {
+	text := strings.Repeat(strings.Repeat("y", 99)+"\n", 25)
+	messenger := runSplit(t, splitSnippet, SlackPostMessageRequest{Channel: "#logs", Text: text})
+	requests := messenger.Requests()
+	assert.Equal(t, 1, len(requests))
+	assert.True(t, strings.HasSuffix(requests[0].Text, snippetNote))
+	assert.True(t, len(requests[0].Text) <= 1000)
+	assert.Equal(t, 1, len(messenger.uploads))
+	upload := messenger.uploads[0]
+	assert.Equal(t, "C123", upload.channel)
+	assert.Equal(t, "1700000000.000001", upload.threadTS)
+	assert.Equal(t, "text", upload.file.SnippetType)
+	assert.Equal(t, text, strings.TrimSuffix(requests[0].Text, snippetNote)+string(upload.file.Content))
+}
@@ -0,0 +1,479 @@
+// syslog.go
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+)
+
+// Syslog ingress, for the appliances and hosts that can't do anything else. Both RFC 5424 and the
+// older BSD (RFC 3164) formats are accepted, over UDP (one message per datagram) and TCP (octet
+// counting or newline framing, see RFC 6587).
+
+const (
+	syslogClient      = "syslog"
+	syslogMaxMessage  = 64 * 1024
+	syslogMaxPriority = 191
+	// TCP connections idle (or stuck in the middle of a frame) for longer are closed, the senders reconnect.
+	syslogReadTimeout = 5 * time.Minute
+	// Further TCP connections are refused, so a misbehaving sender can't exhaust the file descriptors.
+	syslogMaxConnections = 100
+	// Longest length prefix of the octet counted frames, plenty for syslogMaxMessage.
+	syslogMaxLengthDigits = 10
+)
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp",
+	"ntp", "security", "console", "clock", "local0", "local1", "local2", "local3", "local4", "local5",
+	"local6", "local7",
+}
+
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// syslogSeverityStyle is how each severity is rendered in Slack, indexed by severity.
+var syslogSeverityStyle = []struct {
+	emoji, color string
+}{
+	{":rotating_light:", "#8b0000"},     // emerg
+	{":rotating_light:", "#a30200"},     // alert
+	{":red_circle:", "#d00000"},         // crit
+	{":red_circle:", "#e01e5a"},         // err
+	{":warning:", "#daa038"},            // warning
+	{":large_blue_circle:", "#439fe0"},  // notice
+	{":information_source:", "#2eb886"}, // info
+	{":mag:", "#aaaaaa"},                // debug
+}
+
+type syslogMessage struct {
+	Facility  int
+	Severity  int
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcID    string
+	MsgID     string
+	Message   string
+}
+
+// syslogRoute sends the messages matching all of its (optional) criteria to Channel.
+type syslogRoute struct {
+	Facilities  []string `json:"facilities,omitempty"`   // facility names, any if empty
+	MaxSeverity string   `json:"max_severity,omitempty"` // e.g. "warning" matches emerg to warning
+	Hostname    string   `json:"hostname,omitempty"`     // glob pattern
+	Channel     string   `json:"channel"`
+}
+
+// syslogConfig is the json routing file. The first matching route wins, messages matching none go to
+// the default channel or are dropped if there isn't one.
+type syslogConfig struct {
+	DefaultChannel string        `json:"default_channel,omitempty"`
+	Routes         []syslogRoute `json:"routes"`
+}
+
+type syslogIngress struct {
+	UDPAddr string
+	TCPAddr string
+	config  syslogConfig
+	// Bound listeners, set by start().
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+}
+
+func loadSyslogConfig(configPath string) (syslogConfig, error) {
+	var config syslogConfig
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, err
+	}
+	return config, config.check()
+}
+
+func (c *syslogConfig) check() error {
+	var errs []error
+	for i, route := range c.Routes {
+		if route.Channel == "" {
+			errs = append(errs, fmt.Errorf("syslog route %d: channel is not set", i))
+		}
+		for _, facility := range route.Facilities {
+			if !slices.Contains(syslogFacilities, facility) {
+				errs = append(errs, fmt.Errorf("syslog route %d: unknown facility %q", i, facility))
+			}
+		}
+		if route.MaxSeverity != "" && !slices.Contains(syslogSeverities, route.MaxSeverity) {
+			errs = append(errs, fmt.Errorf("syslog route %d: unknown severity %q", i, route.MaxSeverity))
+		}
+		if _, err := path.Match(route.Hostname, ""); err != nil {
+			errs = append(errs, fmt.Errorf("syslog route %d: invalid hostname pattern %q: %w", i, route.Hostname, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// channel returns where the message should be posted, empty if nowhere.
+func (c *syslogConfig) channel(msg syslogMessage) string {
+	for _, route := range c.Routes {
+		if len(route.Facilities) > 0 && !slices.Contains(route.Facilities, syslogFacilities[msg.Facility]) {
+			continue
+		}
+		if route.MaxSeverity != "" && msg.Severity > slices.Index(syslogSeverities, route.MaxSeverity) {
+			continue
+		}
+		if route.Hostname != "" {
+			if matched, _ := path.Match(route.Hostname, msg.Hostname); !matched {
+				continue
+			}
+		}
+		return route.Channel
+	}
+	return c.DefaultChannel
+}
+
+// parseSyslog parses a RFC 5424 message, falling back to RFC 3164 (which is loosely defined, so we
+// are lenient there).
+func parseSyslog(data []byte) (syslogMessage, error) {
+	var msg syslogMessage
+	line := strings.TrimRight(string(data), "\r\n\x00")
+	if !strings.HasPrefix(line, "<") {
+		return msg, errors.New("syslog message doesn't start with a <priority>")
+	}
+	end := strings.IndexByte(line, '>')
+	if end < 2 || end > 4 {
+		return msg, errors.New("invalid syslog priority")
+	}
+	priority, err := strconv.Atoi(line[1:end])
+	if err != nil || priority < 0 || priority > syslogMaxPriority {
+		return msg, fmt.Errorf("invalid syslog priority %q", line[1:end])
+	}
+	msg.Facility = priority / 8
+	msg.Severity = priority % 8
+	line = line[end+1:]
+	if isSyslog5424(line) {
+		return msg, parseSyslog5424(&msg, line[2:])
+	}
+	parseSyslog3164(&msg, line)
+	return msg, nil
+}
+
+// isSyslog5424 returns true when the line, after the priority, starts with a RFC 5424 header: the version
+// then the timestamp or the nil value. A RFC 3164 message without header can start with "1 " too.
+func isSyslog5424(line string) bool {
+	rest, found := strings.CutPrefix(line, "1 ")
+	if !found {
+		return false
+	}
+	timestamp, _, _ := strings.Cut(rest, " ")
+	if timestamp == "-" {
+		return true
+	}
+	_, err := time.Parse(time.RFC3339Nano, timestamp)
+	return err == nil
+}
+
+// RFC 5424: TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG].
+func parseSyslog5424(msg *syslogMessage, line string) error {
+	fields := strings.SplitN(line, " ", 6)
+	if len(fields) < 6 {
+		return errors.New("truncated RFC 5424 syslog header")
+	}
+	nilValue := func(s string) string {
+		if s == "-" {
+			return ""
+		}
+		return s
+	}
+	if fields[0] != "-" {
+		ts, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return fmt.Errorf("invalid RFC 5424 syslog timestamp: %w", err)
+		}
+		msg.Timestamp = ts
+	}
+	msg.Hostname = nilValue(fields[1])
+	msg.AppName = nilValue(fields[2])
+	msg.ProcID = nilValue(fields[3])
+	msg.MsgID = nilValue(fields[4])
+	rest, err := skipStructuredData(fields[5])
+	if err != nil {
+		return err
+	}
+	msg.Message = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\ufeff")
+	return nil
+}
+
+// skipStructuredData returns what follows the STRUCTURED-DATA part ("-" or [elements]).
+func skipStructuredData(s string) (string, error) {
+	if strings.HasPrefix(s, "-") {
+		return s[1:], nil
+	}
+	inElement, inValue, escaped := false, false, false
+	for i, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case inValue && c == '\\':
+			escaped = true
+		case inElement && c == '"':
+			inValue = !inValue
+		case !inElement && c == '[':
+			inElement = true
+		case inElement && !inValue && c == ']':
+			inElement = false
+		case !inElement:
+			return s[i:], nil
+		}
+	}
+	if inElement {
+		return "", errors.New("unterminated RFC 5424 structured data")
+	}
+	return "", nil
+}
+
+// RFC 3164: "Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG", any part of which may be missing in practice.
+func parseSyslog3164(msg *syslogMessage, line string) {
+	const stampLen = len(time.Stamp)
+	if len(line) > stampLen {
+		if ts, err := time.Parse(time.Stamp, line[:stampLen]); err == nil {
+			now := time.Now()
+			msg.Timestamp = ts.AddDate(now.Year(), 0, 0)
+			line = strings.TrimPrefix(line[stampLen:], " ")
+			if host, rest, found := strings.Cut(line, " "); found {
+				msg.Hostname = host
+				line = rest
+			}
+		}
+	}
+	if tag, rest, found := strings.Cut(line, ": "); found && !strings.ContainsAny(tag, " ") {
+		if name, pid, hasPid := strings.Cut(tag, "["); hasPid {
+			msg.AppName = name
+			msg.ProcID = strings.TrimSuffix(pid, "]")
+		} else {
+			msg.AppName = tag
+		}
+		line = rest
+	}
+	msg.Message = line
+}
+
+// toSlack formats the message, with the severity driving the emoji and the attachment color.
+func (msg *syslogMessage) toSlack(channel string) SlackPostMessageRequest {
+	style := syslogSeverityStyle[msg.Severity]
+	source := msg.Hostname
+	if msg.AppName != "" {
+		source = strings.TrimSpace(source + " " + msg.AppName)
+	}
+	text := fmt.Sprintf("%s [%s] %s", style.emoji, syslogSeverities[msg.Severity], source)
+	attachment := map[string]any{
+		"color":    style.color,
+		"fallback": text + ": " + msg.Message,
+		"text":     msg.Message,
+		"footer":   fmt.Sprintf("%s.%s", syslogFacilities[msg.Facility], syslogSeverities[msg.Severity]),
+	}
+	if !msg.Timestamp.IsZero() {
+		attachment["ts"] = msg.Timestamp.Unix()
+	}
+	attachments, _ := json.Marshal([]any{attachment})
+	return SlackPostMessageRequest{
+		Channel:     channel,
+		Text:        strings.TrimSpace(text),
+		Attachments: attachments,
+	}
+}
+
+// start binds the configured listeners and serves them until the context is canceled.
+func (s *syslogIngress) start(ctx context.Context, app *App) error {
+	var err error
+	if s.UDPAddr != "" {
+		s.udpConn, err = net.ListenPacket("udp", s.UDPAddr)
+		if err != nil {
+			return fmt.Errorf("syslog udp listener: %w", err)
+		}
+		log.S(log.Info, "Syslog UDP listener started", log.String("addr", s.udpConn.LocalAddr().String()))
+		go s.serveUDP(app)
+	}
+	if s.TCPAddr != "" {
+		s.tcpListener, err = net.Listen("tcp", s.TCPAddr)
+		if err != nil {
+			s.close()
+			return fmt.Errorf("syslog tcp listener: %w", err)
+		}
+		log.S(log.Info, "Syslog TCP listener started", log.String("addr", s.tcpListener.Addr().String()))
+		go s.serveTCP(ctx, app)
+	}
+	go func() {
+		<-ctx.Done()
+		s.close()
+	}()
+	return nil
+}
+
+func (s *syslogIngress) close() {
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+	}
+}
+
+func (s *syslogIngress) serveUDP(app *App) {
+	buf := make([]byte, syslogMaxMessage)
+	for {
+		n, addr, err := s.udpConn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.S(log.Error, "Syslog UDP read error", log.Any("err", err))
+			}
+			return
+		}
+		s.handle(app, addr.String(), buf[:n])
+	}
+}
+
+func (s *syslogIngress) serveTCP(ctx context.Context, app *App) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	connections := make(chan struct{}, syslogMaxConnections)
+	for {
+		conn, err := s.tcpListener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.S(log.Error, "Syslog TCP accept error", log.Any("err", err))
+			}
+			return
+		}
+		select {
+		case connections <- struct{}{}:
+		default:
+			log.S(log.Warning, "Too many syslog TCP connections, refusing", log.String("remote", conn.RemoteAddr().String()),
+				log.Int("max", syslogMaxConnections))
+			conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-connections }()
+			// Unblock the reads on shutdown.
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			defer stop()
+			defer conn.Close()
+			s.serveConn(app, conn)
+		}()
+	}
+}
+
+// serveConn reads framed messages: "<length> <message>" (octet counting) or newline terminated.
+func (s *syslogIngress) serveConn(app *App, conn net.Conn) {
+	r := bufio.NewReaderSize(conn, syslogMaxMessage)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(syslogReadTimeout))
+		first, err := r.Peek(1)
+		if err != nil {
+			return
+		}
+		var frame []byte
+		if first[0] >= '0' && first[0] <= '9' {
+			frame, err = readOctetCountedFrame(r)
+		} else {
+			frame, err = r.ReadSlice('\n')
+			if errors.Is(err, io.EOF) && len(frame) > 0 {
+				err = nil
+			}
+		}
+		if err != nil {
+			// Idle connections time out, the senders reconnect.
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+				log.S(log.Error, "Syslog TCP read error", log.Any("err", err),
+					log.String("remote", conn.RemoteAddr().String()))
+			}
+			return
+		}
+		if len(bytes.TrimSpace(frame)) > 0 {
+			s.handle(app, conn.RemoteAddr().String(), frame)
+		}
+	}
+}
+
+// readOctetCountedFrame reads a "LENGTH SP MSG" frame. The length is read a byte at a time, so neither
+// a long prefix nor one that isn't a number is buffered.
+func readOctetCountedFrame(r *bufio.Reader) ([]byte, error) {
+	length := 0
+	for digits := 0; ; digits++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == ' ' && digits > 0 {
+			break
+		}
+		if c < '0' || c > '9' || digits == syslogMaxLengthDigits {
+			return nil, fmt.Errorf("invalid syslog frame length, unexpected %q after %d digits", c, digits)
+		}
+		length = length*10 + int(c-'0')
+	}
+	if length <= 0 || length > syslogMaxMessage {
+		return nil, fmt.Errorf("invalid syslog frame length %d", length)
+	}
+	frame := make([]byte, length)
+	_, err := io.ReadFull(r, frame)
+	return frame, err
+}
+
+// handle parses, routes and enqueues one message from the remote address. There is no one to reply to,
+// so problems are only logged and audited (and counted as not processed when we drop a valid message).
+func (s *syslogIngress) handle(app *App, remote string, data []byte) {
+	msg, err := parseSyslog(data)
+	if err != nil {
+		log.S(log.Warning, "Invalid syslog message", log.Any("err", err), log.String("data", string(data)))
+		app.auditRejected(remote, "chat.postMessage", syslogClient, "", "", err.Error())
+		return
+	}
+	channel := s.config.channel(msg)
+	if channel == "" {
+		log.S(log.Debug, "No route for syslog message, dropping it", log.String("host", msg.Hostname),
+			log.String("facility", syslogFacilities[msg.Facility]), log.String("severity", syslogSeverities[msg.Severity]))
+		return
+	}
+	queued := newQueuedMessage(msg.toSlack(channel), syslogClient)
+	app.auditMessage(queued, auditEntry{Event: auditReceived, Remote: remote})
+	app.setExpiry(queued, 0)
+	copies := app.route(queued, nil)
+	if err = app.validateCopies(copies); err != nil {
+		log.S(log.Warning, "Invalid syslog message", log.Any("err", err), log.String("channel", channel),
+			log.String("host", msg.Hostname))
+		app.auditRejected(remote, "chat.postMessage", syslogClient, channel, queued.ID, err.Error())
+		return
+	}
+	// The senders are identified by their address only, see the policy's network rules.
+	if app.checkPolicy("", remote, copies) != nil {
+		return
+	}
+	if app.queueAlmostFull(priorityNormal, len(copies)) {
+		app.metrics.RequestsNotProcessed.WithLabelValues(app.channelLabel(channel)).Inc()
+		app.auditRejected(remote, "chat.postMessage", syslogClient, channel, queued.ID, "Queue is almost full")
+		return
+	}
+	// Never wait for room in the queue, that would stall the (single) UDP read loop: the copies are
+	// dropped and counted as overflow instead.
+	_ = app.enqueueAll(copies)
+}
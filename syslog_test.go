@@ -0,0 +1,192 @@
+// syslog_test.go
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseSyslog(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    syslogMessage
+		wantErr bool
+	}{
+		{
+			name:  "RFC 5424",
+			input: "<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - 'su root' failed for lonvick on /dev/pts/8\n",
+			want: syslogMessage{
+				Facility: 4, Severity: 2, Timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+				Hostname: "mymachine.example.com", AppName: "su", MsgID: "ID47",
+				Message: "'su root' failed for lonvick on /dev/pts/8",
+			},
+		},
+		{
+			name:  "RFC 5424 with structured data and BOM",
+			input: `<165>1 - host evntslog 42 - [exampleSDID@32473 iut="3" eventID="1011" x="a\]b"][other] ` + "\ufeffAn application event",
+			want: syslogMessage{
+				Facility: 20, Severity: 5, Hostname: "host", AppName: "evntslog", ProcID: "42",
+				Message: "An application event",
+			},
+		},
+		{
+			name:  "RFC 5424 without message",
+			input: "<14>1 - - - - - -",
+			want:  syslogMessage{Facility: 1, Severity: 6},
+		},
+		{
+			name:  "RFC 3164",
+			input: "<13>Feb  5 17:32:18 fw-1 sshd[1234]: Failed password for root",
+			want: syslogMessage{
+				Facility: 1, Severity: 5, Timestamp: time.Date(time.Now().Year(), 2, 5, 17, 32, 18, 0, time.UTC),
+				Hostname: "fw-1", AppName: "sshd", ProcID: "1234", Message: "Failed password for root",
+			},
+		},
+		{
+			name:  "RFC 3164 without header",
+			input: "<0>kernel panic",
+			want:  syslogMessage{Message: "kernel panic"},
+		},
+		{
+			name:  "RFC 3164 starting like the RFC 5424 version",
+			input: "<13>1 disk failed",
+			want:  syslogMessage{Facility: 1, Severity: 5, Message: "1 disk failed"},
+		},
+		{name: "no priority", input: "hello", wantErr: true},
+		{name: "bad priority", input: "<192>1 - - - - - -", wantErr: true},
+		{name: "truncated RFC 5424", input: "<14>1 - host", wantErr: true},
+		{name: "unterminated structured data", input: `<14>1 - h a p m [id x="]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSyslog([]byte(tt.input))
+			if tt.wantErr {
+				assert.True(t, err != nil, "expected an error")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSyslogRouting(t *testing.T) {
+	config := syslogConfig{
+		DefaultChannel: "#syslog",
+		Routes: []syslogRoute{
+			{Facilities: []string{"auth", "authpriv"}, MaxSeverity: "warning", Channel: "#security"},
+			{Hostname: "fw-*", Channel: "#network"},
+		},
+	}
+	assert.NoError(t, config.check())
+	assert.Equal(t, "#security", config.channel(syslogMessage{Facility: 4, Severity: 3, Hostname: "fw-1"}))
+	assert.Equal(t, "#network", config.channel(syslogMessage{Facility: 4, Severity: 6, Hostname: "fw-1"}))
+	assert.Equal(t, "#syslog", config.channel(syslogMessage{Facility: 1, Severity: 0, Hostname: "db-1"}))
+
+	invalid := syslogConfig{Routes: []syslogRoute{{Facilities: []string{"nope"}, MaxSeverity: "bad", Hostname: "["}}}
+	assert.Equal(t, "syslog route 0: channel is not set\n"+
+		"syslog route 0: unknown facility \"nope\"\n"+
+		"syslog route 0: unknown severity \"bad\"\n"+
+		"syslog route 0: invalid hostname pattern \"[\": syntax error in pattern", invalid.check().Error())
+}
+
+func TestReadOctetCountedFrame(t *testing.T) {
+	frame, err := readOctetCountedFrame(bufio.NewReader(strings.NewReader("5 hello5 world")))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(frame))
+	for data, want := range map[string]string{
+		"12x hello":                      `invalid syslog frame length, unexpected 'x' after 2 digits`,
+		" 5 hello":                       `invalid syslog frame length, unexpected ' ' after 0 digits`,
+		strings.Repeat("1", 1000) + " x": `invalid syslog frame length, unexpected '1' after 10 digits`,
+		"99999999 x":                     "invalid syslog frame length 99999999",
+		"0 x":                            "invalid syslog frame length 0",
+	} {
+		_, err = readOctetCountedFrame(bufio.NewReader(strings.NewReader(data)))
+		assert.Error(t, err)
+		assert.Equal(t, want, err.Error())
+	}
+}
+
+func TestSyslogToSlack(t *testing.T) {
+	msg := syslogMessage{Facility: 4, Severity: 4, Hostname: "fw-1", AppName: "sshd", Message: "Failed password"}
+	request := msg.toSlack("#security")
+	assert.Equal(t, "#security", request.Channel)
+	assert.Equal(t, ":warning: [warning] fw-1 sshd", request.Text)
+	var attachments []map[string]any
+	assert.NoError(t, json.Unmarshal(request.Attachments, &attachments))
+	assert.Equal(t, "#daa038", attachments[0]["color"])
+	assert.Equal(t, "Failed password", attachments[0]["text"])
+	assert.Equal(t, "auth.warning", attachments[0]["footer"])
+}
+
+func TestSyslogListeners(t *testing.T) {
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+	}
+	s := &syslogIngress{
+		UDPAddr: "127.0.0.1:0",
+		TCPAddr: "127.0.0.1:0",
+		config:  syslogConfig{DefaultChannel: "#syslog"},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, s.start(ctx, app))
+
+	udp, err := net.Dial("udp", s.udpConn.LocalAddr().String())
+	assert.NoError(t, err)
+	_, err = udp.Write([]byte("<11>1 - udp-host app - - - over udp"))
+	assert.NoError(t, err)
+	udp.Close()
+
+	tcp, err := net.Dial("tcp", s.tcpListener.Addr().String())
+	assert.NoError(t, err)
+	octetCounted := "<12>1 - tcp-host app - - - octet counted"
+	_, err = fmt.Fprintf(tcp, "%d %s<13>newline framed\n", len(octetCounted), octetCounted)
+	assert.NoError(t, err)
+	tcp.Close()
+
+	var texts []string
+	popCtx, popCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer popCancel()
+	for range 3 {
+		msg, ok := app.slackQueue.Pop(popCtx)
+		if !ok {
+			t.Fatalf("timeout waiting for syslog messages, got %v", texts)
+		}
+		var attachments []map[string]any
+		assert.NoError(t, json.Unmarshal(msg.Request.Attachments, &attachments))
+		texts = append(texts, attachments[0]["text"].(string))
+	}
+	// UDP and TCP are independent, so the order between them isn't guaranteed.
+	slices.Sort(texts)
+	assert.Equal(t, []string{"newline framed", "octet counted", "over udp"}, texts)
+
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	_, err = net.Dial("tcp", s.tcpListener.Addr().String())
+	assert.True(t, err != nil, "tcp listener should be closed")
+}
+
+func TestSyslogPolicy(t *testing.T) {
+	app, _ := newPolicyTestApp(t)
+	s := &syslogIngress{config: syslogConfig{DefaultChannel: "#infra"}}
+	s.handle(app, "10.1.2.3:514", []byte("<11>1 - host app - - - from the network"))
+	assert.Equal(t, 1, app.slackQueue.Len())
+	s.handle(app, "192.0.2.1:514", []byte("<11>1 - host app - - - from elsewhere"))
+	assert.Equal(t, 1, app.slackQueue.Len(), "denied by the default rule")
+	assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.RequestsDenied.WithLabelValues("#infra", "")))
+}
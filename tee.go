@@ -0,0 +1,293 @@
+// tee.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/log"
+)
+
+// The tee copies each message, once its delivery is over, to secondary sinks: a json lines file (e.g.
+// for compliance archiving), an http endpoint receiving the same records, or another proxy receiving the
+// request itself (e.g. to replay the production traffic against a staging workspace). Each sink has
+// its own buffer and goroutine, so neither the delivery nor the other sinks wait for a slow sink; when
+// its buffer is full the records are dropped (and counted).
+
+const (
+	teeJSONL = "jsonl"
+	teeHTTP  = "http"
+	teeProxy = "proxy"
+
+	// Final outcomes of the messages.
+	outcomePosted       = "posted"
+	outcomeFailed       = "failed"
+	outcomeNotProcessed = "not_processed" // the channel is paused
+	outcomeExpired      = "expired"
+	outcomeSuppressed   = "suppressed" // by flood protection or quiet hours
+
+	teeBufferSize = 1000
+)
+
+// errTeeSkipped is returned by the sinks not copying some records.
+var errTeeSkipped = errors.New("skipped")
+
+// deliveryResult is how the delivery of a message ended.
+type deliveryResult struct {
+	Outcome  string
+	Error    string
+	TS       string
+	Attempts int
+}
+
+type teeRecord struct {
+	Time      time.Time               `json:"time"`
+	MessageID string                  `json:"message_id"`
+	Client    string                  `json:"client,omitempty"`
+	Channel   string                  `json:"channel"`
+	Received  time.Time               `json:"received"`
+	Outcome   string                  `json:"outcome"`
+	Error     string                  `json:"error,omitempty"`
+	TS        string                  `json:"ts,omitempty"`
+	Attempts  int                     `json:"attempts,omitempty"`
+	ThreadKey string                  `json:"thread_key,omitempty"`
+	Request   SlackPostMessageRequest `json:"request"`
+	// The request as accepted, to replay to another proxy, nil for the parts of split messages.
+	replay *SlackPostMessageRequest
+}
+
+// teeSink writes the records, from a single goroutine.
+type teeSink interface {
+	Write(record *teeRecord) error
+	Close() error
+}
+
+type teeWorker struct {
+	name    string
+	sink    teeSink
+	records chan *teeRecord
+}
+
+// tee is safe for concurrent use, a nil tee copies nothing.
+type tee struct {
+	workers []*teeWorker
+	metrics *Metrics
+	wg      sync.WaitGroup
+	// Set once Close's deadline is reached, the records still buffered are dropped.
+	dropping atomic.Bool
+}
+
+// newTee parses the comma separated sinks, each one being kind=target: jsonl=/path/to/file.jsonl,
+// http=https://archive.example.com/ingest or proxy=http://staging-proxy:8080/.
+func newTee(specs string, client *http.Client, metrics *Metrics) (*tee, error) {
+	t := &tee{metrics: metrics}
+	for spec := range strings.SplitSeq(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		kind, target, found := strings.Cut(spec, "=")
+		if !found || target == "" {
+			t.Close(context.Background())
+			return nil, fmt.Errorf("invalid tee sink %q, expected kind=target", spec)
+		}
+		var sink teeSink
+		name := kind + ":" + target
+		switch kind {
+		case teeJSONL:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+			if err != nil {
+				t.Close(context.Background())
+				return nil, err
+			}
+			sink = &jsonlSink{w: f}
+		case teeHTTP, teeProxy:
+			u, err := url.Parse(target)
+			if err != nil || u.Host == "" {
+				t.Close(context.Background())
+				return nil, fmt.Errorf("invalid tee sink %q, expected an http(s) url", spec)
+			}
+			name = kind + ":" + u.Host // the path and query may have secrets
+			sink = &httpSink{client: client, url: target, proxy: kind == teeProxy}
+		default:
+			t.Close(context.Background())
+			return nil, fmt.Errorf("invalid tee sink %q, expected %s, %s or %s", spec, teeJSONL, teeHTTP, teeProxy)
+		}
+		t.start(name, sink)
+	}
+	if len(t.workers) == 0 {
+		return nil, errors.New("no tee sink")
+	}
+	return t, nil
+}
+
+func (t *tee) start(name string, sink teeSink) {
+	w := &teeWorker{name: name, sink: sink, records: make(chan *teeRecord, teeBufferSize)}
+	t.workers = append(t.workers, w)
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		for record := range w.records {
+			if t.dropping.Load() {
+				t.metrics.TeeRecords.WithLabelValues(w.name, "dropped").Inc()
+				continue
+			}
+			err := w.sink.Write(record)
+			if errors.Is(err, errTeeSkipped) {
+				t.metrics.TeeRecords.WithLabelValues(w.name, "skipped").Inc()
+				continue
+			}
+			if err != nil {
+				log.S(log.Warning, "Failed to tee the message", log.Any("err", err), log.String("sink", w.name),
+					log.String("message_id", record.MessageID))
+				t.metrics.TeeRecords.WithLabelValues(w.name, "failed").Inc()
+				continue
+			}
+			t.metrics.TeeRecords.WithLabelValues(w.name, "sent").Inc()
+		}
+	}()
+}
+
+// Record copies the message and how its delivery ended to the sinks, without waiting for them. The
+// uploads and reactions aren't copied.
+func (t *tee) Record(msg *queuedMessage, result deliveryResult) {
+	if t == nil || msg.upload != nil || msg.reaction != nil {
+		return
+	}
+	record := &teeRecord{
+		Time:      time.Now(),
+		MessageID: msg.ID,
+		Client:    msg.Client,
+		Channel:   msg.Request.Channel,
+		Received:  msg.Received,
+		Outcome:   result.Outcome,
+		Error:     result.Error,
+		TS:        result.TS,
+		Attempts:  result.Attempts,
+		ThreadKey: msg.ThreadKey,
+		Request:   msg.Request,
+	}
+	record.Request.Token = "" // never copy credentials
+	if msg.accepted != nil {
+		replay := *msg.accepted
+		replay.Token = ""
+		replay.ThreadTS = "" // the threads only exist in this workspace, the thread key is passed instead
+		replay.ReplyBroadcast = false
+		record.replay = &replay
+	}
+	for _, w := range t.workers {
+		select {
+		case w.records <- record:
+		default:
+			t.metrics.TeeRecords.WithLabelValues(w.name, "dropped").Inc()
+		}
+	}
+}
+
+// Close flushes the buffered records and closes the sinks. The records still buffered once ctx is done
+// are dropped (and counted), the ones being written finish (bounded by the sinks' timeouts).
+func (t *tee) Close(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	for _, w := range t.workers {
+		close(w.records)
+	}
+	flushed := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		log.S(log.Warning, "Dropping the tee records not flushed yet", log.Any("err", ctx.Err()))
+		t.dropping.Store(true)
+		<-flushed
+	}
+	for _, w := range t.workers {
+		if err := w.sink.Close(); err != nil {
+			log.S(log.Error, "Failed to close the tee sink", log.Any("err", err), log.String("sink", w.name))
+		}
+	}
+}
+
+// jsonlSink appends the records, as json lines, to a file.
+type jsonlSink struct {
+	w io.WriteCloser
+}
+
+func (s *jsonlSink) Write(record *teeRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+func (s *jsonlSink) Close() error {
+	return s.w.Close()
+}
+
+// httpSink posts the records as json, or only the requests to another proxy (which posts them again).
+// The proxy gets the requests as they were accepted, not as they were posted (with the channel ids and
+// threads of this workspace, the text split, annotated,...), and it splits them again itself. The
+// messages suppressed by flood protection or quiet hours are replayed too, as they were accepted: the
+// other proxy gets the same traffic and applies its own flood protection and quiet hours to it.
+type httpSink struct {
+	client *http.Client
+	url    string
+	proxy  bool
+}
+
+func (s *httpSink) Write(record *teeRecord) error {
+	var body any = record
+	if s.proxy {
+		if record.replay == nil {
+			return errTeeSkipped
+		}
+		body = record.replay
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if s.proxy && record.Client != "" {
+		req.Header.Set(clientHeader, record.Client)
+	}
+	if s.proxy && record.ThreadKey != "" {
+		req.Header.Set(threadKeyHeader, record.ThreadKey)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	return nil
+}
@@ -0,0 +1,263 @@
+// tee_test.go
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// FailingChannelSlackMessenger records the posted requests, except for one channel which fails with
+// a permanent error.
+type FailingChannelSlackMessenger struct {
+	RecordingSlackMessenger
+	failChannel string
+}
+
+func (m *FailingChannelSlackMessenger) PostMessage(ctx context.Context, req SlackPostMessageRequest, url, token string) (SlackResponse, error) {
+	if req.Channel == m.failChannel {
+		return SlackResponse{Ok: false, Error: "invalid_blocks"}, errors.New("invalid_blocks")
+	}
+	return m.RecordingSlackMessenger.PostMessage(ctx, req, url, token)
+}
+
+func TestNewTee_Invalid(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	for spec, want := range map[string]string{
+		"":                    "no tee sink",
+		"/tmp/x.jsonl":        `invalid tee sink "/tmp/x.jsonl", expected kind=target`,
+		"kafka=broker:9092":   `invalid tee sink "kafka=broker:9092", expected jsonl, http or proxy`,
+		"http=not a url":      `invalid tee sink "http=not a url", expected an http(s) url`,
+		"jsonl=/nope/x.jsonl": "open /nope/x.jsonl: no such file or directory",
+	} {
+		_, err := newTee(spec, http.DefaultClient, metrics)
+		assert.Error(t, err)
+		assert.Equal(t, want, err.Error())
+	}
+}
+
+func TestTee(t *testing.T) {
+	var mu sync.Mutex
+	var records []teeRecord
+	var replayed []SlackPostMessageRequest
+	var replayClient string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/archive" {
+			var record teeRecord
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&record))
+			records = append(records, record)
+			return
+		}
+		var request SlackPostMessageRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		replayed = append(replayed, request)
+		replayClient = r.Header.Get(clientHeader)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "tee.jsonl")
+	metrics := NewMetrics(prometheus.NewRegistry())
+	tee, err := newTee("jsonl="+path+", http="+server.URL+"/archive,proxy="+server.URL+"/", server.Client(), metrics)
+	assert.NoError(t, err)
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		messenger:  &FailingChannelSlackMessenger{failChannel: "#bad"},
+		metrics:    metrics,
+		tee:        tee,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.processQueue(ctx, 0, time.Millisecond, 10, time.Millisecond)
+	ok := newQueuedMessage(SlackPostMessageRequest{Token: "xoxb-secret", Channel: "#ok", Text: "hello"}, "ci")
+	assert.NoError(t, app.enqueue(ok))
+	bad := newQueuedMessage(SlackPostMessageRequest{Channel: "#bad", Text: "oops"}, "ci")
+	assert.NoError(t, app.enqueue(bad))
+	app.wg.Wait()
+	tee.Close(context.Background())
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	var lines []teeRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record teeRecord
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		lines = append(lines, record)
+	}
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, ok.ID, lines[0].MessageID)
+	assert.Equal(t, outcomePosted, lines[0].Outcome)
+	assert.Equal(t, "1700000000.000001", lines[0].TS)
+	assert.Equal(t, 1, lines[0].Attempts)
+	assert.Equal(t, "", lines[0].Request.Token, "no credentials in the copies")
+	assert.Equal(t, "hello", lines[0].Request.Text)
+	assert.Equal(t, bad.ID, lines[1].MessageID)
+	assert.Equal(t, outcomeFailed, lines[1].Outcome)
+	assert.Equal(t, "invalid_blocks", lines[1].Error)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, outcomeFailed, records[1].Outcome)
+	assert.Equal(t, 2, len(replayed))
+	assert.Equal(t, "#ok", replayed[0].Channel)
+	assert.Equal(t, "", replayed[0].Token)
+	assert.Equal(t, "ci", replayClient)
+	host := server.Listener.Addr().String()
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.TeeRecords.WithLabelValues("proxy:"+host, "sent")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.TeeRecords.WithLabelValues("jsonl:"+path, "sent")))
+}
+
+func TestTee_Dropped(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	block := make(chan struct{})
+	tee := &tee{metrics: metrics}
+	tee.start("slow", &blockingSink{block: block})
+	msg := newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Text: "x"}, "")
+	for range teeBufferSize + 2 {
+		tee.Record(msg, deliveryResult{Outcome: outcomePosted})
+	}
+	close(block)
+	tee.Close(context.Background())
+	// One being written when the buffer filled up, so at least one dropped.
+	dropped := testutil.ToFloat64(metrics.TeeRecords.WithLabelValues("slow", "dropped"))
+	assert.True(t, dropped >= 1 && dropped <= 2, "dropped")
+	assert.Equal(t, teeBufferSize+2.0, dropped+testutil.ToFloat64(metrics.TeeRecords.WithLabelValues("slow", "sent")))
+}
+
+func TestTee_CloseDeadline(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	block := make(chan struct{})
+	tee := &tee{metrics: metrics}
+	tee.start("slow", &blockingSink{block: block})
+	msg := newQueuedMessage(SlackPostMessageRequest{Channel: "#c", Text: "x"}, "")
+	for range 5 {
+		tee.Record(msg, deliveryResult{Outcome: outcomePosted})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	go func() {
+		for !tee.dropping.Load() {
+			time.Sleep(time.Millisecond)
+		}
+		close(block) // the record being written finishes
+	}()
+	tee.Close(ctx)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.TeeRecords.WithLabelValues("slow", "sent")))
+	assert.Equal(t, 4.0, testutil.ToFloat64(metrics.TeeRecords.WithLabelValues("slow", "dropped")))
+}
+
+type blockingSink struct {
+	block chan struct{}
+}
+
+func (s *blockingSink) Write(*teeRecord) error {
+	<-s.block
+	return nil
+}
+
+func (s *blockingSink) Close() error {
+	return nil
+}
+
+func TestTee_ProxyReplaysAcceptedRequest(t *testing.T) {
+	var mu sync.Mutex
+	var replayed []SlackPostMessageRequest
+	var threadKeys []string
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var request SlackPostMessageRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		replayed = append(replayed, request)
+		threadKeys = append(threadKeys, r.Header.Get(threadKeyHeader))
+	}))
+	defer server.Close()
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	tee, err := newTee("proxy="+server.URL+"/", server.Client(), metrics)
+	assert.NoError(t, err)
+	app := &App{
+		slackQueue:      newMessageQueue(10, false),
+		messenger:       &UploadingSlackMessenger{},
+		metrics:         metrics,
+		tee:             tee,
+		channelOverride: "C0PROD",
+		splitMode:       splitThread,
+		splitLength:     1000,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.processQueue(ctx, 0, time.Millisecond, 10, time.Millisecond)
+	text := strings.Repeat(strings.Repeat("x", 99)+"\n", 15)
+	msg := newQueuedMessage(SlackPostMessageRequest{Channel: "#deploys", Text: text, ThreadTS: "1700000000.000001", ReplyBroadcast: true}, "ci")
+	msg.ThreadKey = "deploy-42"
+	assert.NoError(t, app.enqueue(msg))
+	app.wg.Wait()
+	tee.Close(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, len(replayed), "the parts of the split message aren't replayed")
+	assert.Equal(t, "#deploys", replayed[0].Channel, "before the production channel override")
+	assert.Equal(t, text, replayed[0].Text, "not split")
+	assert.Equal(t, "", replayed[0].ThreadTS)
+	assert.False(t, replayed[0].ReplyBroadcast)
+	assert.Equal(t, "deploy-42", threadKeys[0])
+	host := server.Listener.Addr().String()
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.TeeRecords.WithLabelValues("proxy:"+host, "skipped")))
+}
+
+func TestTee_ProxyReplaysDigestedRequests(t *testing.T) {
+	var mu sync.Mutex
+	var replayed []string
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var request SlackPostMessageRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		replayed = append(replayed, request.Text)
+	}))
+	defer server.Close()
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	tee, err := newTee("proxy="+server.URL+"/", server.Client(), metrics)
+	assert.NoError(t, err)
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		messenger:  &MockSlackMessenger{},
+		metrics:    metrics,
+		tee:        tee,
+		digests:    newDigester(1),
+	}
+	for i := range 5 {
+		assert.NoError(t, app.enqueue(newQueuedMessage(SlackPostMessageRequest{Channel: "#storm", Text: fmt.Sprint(i)}, "")))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.processQueue(ctx, 0, time.Millisecond, 10, time.Millisecond)
+	app.wg.Wait()
+	tee.Close(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"0", "1", "2", "3", "4"}, replayed, "each merged request is replayed")
+}
@@ -0,0 +1,188 @@
+// threads.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+)
+
+// Messages sharing a correlation key (alert fingerprint, deploy id,...) are grouped in a thread: the
+// first one posted to a channel becomes the thread root and the later ones are posted as replies.
+
+// Header carrying the correlation key, it can also be set with the thread_key body field.
+const threadKeyHeader = "X-Thread-Key"
+
+type threadEntry struct {
+	TS       string    `json:"ts"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// threadStore maps channel + key to the ts of the thread root. Entries expire when unused for the ttl.
+// It is safe for concurrent use.
+type threadStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	path    string // where the store is persisted, if set
+	threads map[string]threadEntry
+	dirty   bool
+	// Expired entries are pruned when setting new ones, at most every ttl/2, see prune.
+	nextPrune time.Time
+	now       func() time.Time // for tests
+}
+
+func newThreadStore(ttl time.Duration, path string) *threadStore {
+	return &threadStore{
+		ttl:     ttl,
+		path:    path,
+		threads: make(map[string]threadEntry),
+		now:     time.Now,
+	}
+}
+
+func threadStoreKey(channel, key string) string {
+	return channel + "\x00" + key
+}
+
+// Get returns the thread root ts for the key, empty if there isn't a (live) one. Using a thread
+// extends its life.
+func (s *threadStore) Get(channel, key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := threadStoreKey(channel, key)
+	entry, found := s.threads[k]
+	if !found {
+		return ""
+	}
+	now := s.now()
+	if now.Sub(entry.LastUsed) >= s.ttl {
+		delete(s.threads, k)
+		s.dirty = true
+		return ""
+	}
+	entry.LastUsed = now
+	s.threads[k] = entry
+	s.dirty = true
+	return entry.TS
+}
+
+// Set records the thread root ts for the key.
+func (s *threadStore) Set(channel, key, ts string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.After(s.nextPrune) {
+		s.prune(now)
+		s.nextPrune = now.Add(s.ttl / 2)
+	}
+	s.threads[threadStoreKey(channel, key)] = threadEntry{TS: ts, LastUsed: now}
+	s.dirty = true
+}
+
+// prune drops the expired entries, whether the store is persisted or not. Must be called with the lock
+// held.
+func (s *threadStore) prune(now time.Time) {
+	for k, entry := range s.threads {
+		if now.Sub(entry.LastUsed) >= s.ttl {
+			delete(s.threads, k)
+			s.dirty = true
+		}
+	}
+}
+
+// Load reads the persisted store, if any. A missing file isn't an error (first start).
+func (s *threadStore) Load() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Unmarshal(data, &s.threads)
+}
+
+// Save persists the live entries, if anything changed since the last time.
+func (s *threadStore) Save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	s.prune(s.now())
+	data, err := json.Marshal(s.threads)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Write and rename so a crash never leaves a truncated file behind.
+	tmp := s.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// PersistEvery saves the store periodically until the context is canceled.
+func (s *threadStore) PersistEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				log.S(log.Error, "Failed to save the threads", log.Any("err", err), log.String("path", s.path))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// threadMessage turns the message into a reply when its thread key already has a thread.
+func (app *App) threadMessage(msg *queuedMessage) {
+	if app.threads == nil || msg.ThreadKey == "" || msg.Request.ThreadTS != "" {
+		return
+	}
+	ts := app.threads.Get(msg.Request.Channel, msg.ThreadKey)
+	if ts == "" {
+		return
+	}
+	log.S(log.Debug, "Posting as a thread reply", log.String("channel", msg.Request.Channel),
+		log.String("thread_key", msg.ThreadKey), log.String("thread_ts", ts))
+	msg.Request.ThreadTS = ts
+	if app.threadBroadcast {
+		msg.Request.ReplyBroadcast = true
+	}
+}
+
+// recordThread remembers the thread root after a successful post of the first message for a key.
+func (app *App) recordThread(msg *queuedMessage, response SlackResponse) {
+	if app.threads == nil || msg.ThreadKey == "" {
+		return
+	}
+	root := msg.Request.ThreadTS // when the caller already threaded the message itself
+	if root == "" {
+		root = response.TS
+	}
+	if root == "" || app.threads.Get(msg.Request.Channel, msg.ThreadKey) != "" {
+		return
+	}
+	app.threads.Set(msg.Request.Channel, msg.ThreadKey, root)
+}
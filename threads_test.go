@@ -0,0 +1,100 @@
+// threads_test.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestThreadStore(t *testing.T) {
+	now := time.Now()
+	s := newThreadStore(time.Hour, "")
+	s.now = func() time.Time { return now }
+	assert.Equal(t, "", s.Get("#c", "k"))
+	s.Set("#c", "k", "1.1")
+	assert.Equal(t, "1.1", s.Get("#c", "k"))
+	assert.Equal(t, "", s.Get("#other", "k"), "keys are per channel")
+	now = now.Add(50 * time.Minute)
+	assert.Equal(t, "1.1", s.Get("#c", "k"), "using the thread extends its life")
+	now = now.Add(50 * time.Minute)
+	assert.Equal(t, "1.1", s.Get("#c", "k"))
+	now = now.Add(time.Hour)
+	assert.Equal(t, "", s.Get("#c", "k"), "expired")
+}
+
+func TestThreadStore_PruneWithoutPath(t *testing.T) {
+	now := time.Now()
+	s := newThreadStore(time.Hour, "")
+	s.now = func() time.Time { return now }
+	s.Set("#c", "old", "1.1")
+	now = now.Add(2 * time.Hour)
+	s.Set("#c", "new", "2.2")
+	assert.Equal(t, 1, len(s.threads), "expired entries are pruned even when not persisted")
+	assert.Equal(t, "2.2", s.Get("#c", "new"))
+}
+
+func TestThreadStore_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "threads.json")
+	s := newThreadStore(time.Hour, path)
+	assert.NoError(t, s.Load(), "missing file is fine")
+	s.Set("#c", "k", "1.1")
+	s.threads[threadStoreKey("#c", "old")] = threadEntry{TS: "0.1", LastUsed: time.Now().Add(-2 * time.Hour)}
+	assert.NoError(t, s.Save())
+
+	restored := newThreadStore(time.Hour, path)
+	assert.NoError(t, restored.Load())
+	assert.Equal(t, "1.1", restored.Get("#c", "k"))
+	assert.Equal(t, 1, len(restored.threads), "expired entries aren't persisted")
+}
+
+func TestProcessQueue_ThreadKey(t *testing.T) {
+	for _, broadcast := range []bool{false, true} {
+		messenger := &RecordingSlackMessenger{}
+		app := &App{
+			slackQueue:      newMessageQueue(10, false),
+			messenger:       messenger,
+			metrics:         NewMetrics(prometheus.NewRegistry()),
+			threads:         newThreadStore(time.Hour, ""),
+			threadBroadcast: broadcast,
+		}
+		bodies := []struct{ header, body string }{
+			{"alert-1", `{"channel": "#alerts", "text": "firing"}`},
+			{"", `{"channel": "#alerts", "text": "still firing", "thread_key": "alert-1"}`},
+			{"alert-2", `{"channel": "#alerts", "text": "other alert"}`},
+			{"alert-1", `{"channel": "#other", "text": "firing elsewhere"}`},
+			{"", `{"channel": "#alerts", "text": "no key"}`},
+			{"alert-1", `{"channel": "#alerts", "text": "resolved"}`},
+		}
+		for _, b := range bodies {
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(b.body))
+			if b.header != "" {
+				req.Header.Set(threadKeyHeader, b.header)
+			}
+			rr := httptest.NewRecorder()
+			app.handleRequest(rr, req)
+			assert.Equal(t, http.StatusOK, rr.Code)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go app.processQueue(ctx, 0, time.Millisecond, 10, time.Millisecond)
+		app.wg.Wait()
+		cancel()
+
+		requests := messenger.Requests()
+		assert.Equal(t, len(bodies), len(requests))
+		var threads []string
+		for _, r := range requests {
+			threads = append(threads, r.ThreadTS)
+			assert.Equal(t, broadcast && r.ThreadTS != "", r.ReplyBroadcast)
+		}
+		assert.Equal(t, []string{"", "1700000000.000001", "", "", "", "1700000000.000001"}, threads)
+	}
+}
@@ -0,0 +1,156 @@
+// tracing.go
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"fortio.org/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// OpenTelemetry tracing: the http ingresses (handleRequest, handleCloudEvent,...), the time spent in
+// the queue and waiting for the rate limiter, each attempt to send the message and the backoffs between
+// them are spans. The W3C traceparent of the inbound request is kept with the queued message and
+// propagated to the outbound http calls, so the caller's trace shows when the message actually went
+// out. The spans are exported (OTLP over grpc) when the standard OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT environment variable is set; the traceparent is propagated even
+// when they aren't.
+
+const tracerName = "fortio.org/slack-proxy"
+
+// Only the W3C trace context, no baggage.
+var propagator = propagation.TraceContext{}
+
+// newTracerProvider returns the provider exporting the spans to the OTLP endpoint configured by the
+// environment (OTEL_EXPORTER_OTLP_*, OTEL_SERVICE_NAME, OTEL_TRACES_SAMPLER,...), nil when there is none
+// or OTEL_TRACES_EXPORTER is none.
+func newTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	if (os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "") ||
+		os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return nil, nil //nolint:nilnil // tracing is disabled
+	}
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(resource.Default())), nil
+}
+
+// tracer returns the tracer, a no-op one (still propagating the inbound trace) when tracing is disabled.
+func (app *App) tracer() trace.Tracer {
+	if app.tracing == nil {
+		return noop.NewTracerProvider().Tracer(tracerName)
+	}
+	return app.tracing.Tracer(tracerName)
+}
+
+// shutdownTracing flushes the spans not exported yet.
+func (app *App) shutdownTracing() {
+	if app.tracing == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := app.tracing.Shutdown(ctx); err != nil {
+		log.S(log.Error, "Failed to flush the traces", log.Any("err", err))
+	}
+}
+
+// injectTrace adds the traceparent of the request's context to its headers.
+func injectTrace(req *http.Request) {
+	propagator.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+}
+
+// statusWriter records the response status for the span.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// traceRequest starts the server span of the request, continuing the caller's trace if any. The returned
+// function ends it, with the response status.
+func (app *App) traceRequest(w http.ResponseWriter, r *http.Request, name string) (http.ResponseWriter, trace.Span, func()) {
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	_, span := app.tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.request.method", r.Method), attribute.String("url.path", r.URL.Path)))
+	sw := &statusWriter{ResponseWriter: w}
+	return sw, span, func() {
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+		if sw.status >= http.StatusBadRequest {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+		span.End()
+	}
+}
+
+// messageContext returns a context, detached from the cancellation of processQueue (so the queue is
+// still delivered on shutdown), carrying the trace of the request the message came from.
+func messageContext(msg *queuedMessage) context.Context {
+	return trace.ContextWithRemoteSpanContext(context.Background(), msg.spanContext)
+}
+
+// traceQueue records, once the message is out of the queue and the rate limiter, the time spent in each.
+func (app *App) traceQueue(msg *queuedMessage, popped time.Time) {
+	ctx := messageContext(msg)
+	tracer := app.tracer()
+	if !msg.queued.IsZero() {
+		_, span := tracer.Start(ctx, "queue", trace.WithTimestamp(msg.queued),
+			trace.WithAttributes(attribute.String("slack_proxy.priority", msg.Priority.String())))
+		span.End(trace.WithTimestamp(popped))
+	}
+	_, span := tracer.Start(ctx, "rate_limiter", trace.WithTimestamp(popped))
+	span.End()
+}
+
+// traceAttempt starts the client span of an attempt to send the message, the returned context propagates
+// it to the outbound http call.
+func (app *App) traceAttempt(msg *queuedMessage, label string, attempt int) (context.Context, trace.Span) {
+	return app.tracer().Start(messageContext(msg), messageMethod(msg), trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("slack_proxy.message_id", msg.ID),
+			attribute.String("slack_proxy.channel", label),
+			attribute.Int("slack_proxy.attempt", attempt),
+		))
+}
+
+// endAttempt ends the attempt's span with its result.
+func endAttempt(span trace.Span, response SlackResponse, err error) {
+	if err != nil {
+		span.SetAttributes(attribute.String("slack_proxy.error", err.Error()))
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(attribute.String("slack_proxy.ts", response.TS))
+	}
+	span.End()
+}
+
+// backoff sleeps before the next attempt, as a span.
+func (app *App) backoff(msg *queuedMessage, d time.Duration) {
+	_, span := app.tracer().Start(messageContext(msg), "backoff",
+		trace.WithAttributes(attribute.String("slack_proxy.duration", d.String())))
+	time.Sleep(d)
+	span.End()
+}
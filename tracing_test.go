@@ -0,0 +1,142 @@
+// tracing_test.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	callerTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	callerSpanID  = "00f067aa0ba902b7"
+)
+
+func TestTracing(t *testing.T) {
+	var mu sync.Mutex
+	var traceparents []string
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+		if len(traceparents) == 1 {
+			_, _ = w.Write([]byte(`{"ok":false,"error":"ratelimited"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true,"channel":"C123","ts":"1700000000.000001"}`))
+	}))
+	defer slack.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	app := NewApp(10, slack.Client(), NewMetrics(prometheus.NewRegistry()), "", slack.URL, "xoxb-test")
+	app.tracing = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.processQueue(ctx, 2, time.Millisecond, 10, time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"channel":"#alerts","text":"hi"}`))
+	req.Header.Set("traceparent", "00-"+callerTraceID+"-"+callerSpanID+"-01")
+	w := httptest.NewRecorder()
+	app.handleRequest(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	app.wg.Wait()
+
+	spans := map[string][]tracetest.SpanStub{}
+	for _, s := range exporter.GetSpans() {
+		assert.Equal(t, callerTraceID, s.SpanContext.TraceID().String(), "all in the caller's trace")
+		spans[s.Name] = append(spans[s.Name], s)
+	}
+	handle := spans["handleRequest"]
+	assert.Equal(t, 1, len(handle))
+	assert.Equal(t, callerSpanID, handle[0].Parent.SpanID().String())
+	assert.Equal(t, trace.SpanKindServer, handle[0].SpanKind)
+	for _, name := range []string{"queue", "rate_limiter", "backoff"} {
+		assert.Equal(t, 1, len(spans[name]), name)
+		assert.Equal(t, handle[0].SpanContext.SpanID(), spans[name][0].Parent.SpanID(), name)
+	}
+	attempts := spans["chat.postMessage"]
+	assert.Equal(t, 2, len(attempts))
+	assert.Equal(t, codes.Error, attempts[0].Status.Code)
+	assert.Equal(t, codes.Unset, attempts[1].Status.Code)
+	assert.Equal(t, trace.SpanKindClient, attempts[1].SpanKind)
+
+	// The outbound calls carry the attempt's span.
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, len(traceparents))
+	for i, tp := range traceparents {
+		carrier := propagation.HeaderCarrier(http.Header{"Traceparent": []string{tp}})
+		sc := trace.SpanContextFromContext(propagator.Extract(context.Background(), carrier))
+		assert.Equal(t, attempts[i].SpanContext.SpanID(), sc.SpanID())
+		assert.Equal(t, callerTraceID, sc.TraceID().String())
+	}
+}
+
+func TestTracing_Disabled(t *testing.T) {
+	var traceparent string
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer slack.Close()
+	app := NewApp(10, slack.Client(), NewMetrics(prometheus.NewRegistry()), "", slack.URL, "xoxb-test")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.processQueue(ctx, 0, time.Millisecond, 10, time.Millisecond)
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"channel":"#alerts","text":"hi"}`))
+	req.Header.Set("traceparent", "00-"+callerTraceID+"-"+callerSpanID+"-01")
+	app.handleRequest(httptest.NewRecorder(), req)
+	app.wg.Wait()
+	assert.Equal(t, "00-"+callerTraceID+"-"+callerSpanID+"-01", traceparent, "still propagated")
+}
+
+func TestTracing_CloudEvent(t *testing.T) {
+	var traceparent string
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer slack.Close()
+	exporter := tracetest.NewInMemoryExporter()
+	app := NewApp(10, slack.Client(), NewMetrics(prometheus.NewRegistry()), "", slack.URL, "xoxb-test")
+	app.tracing = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	app.cloudEvents = newCloudEventsTestApp(t).cloudEvents
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.processQueue(ctx, 0, time.Millisecond, 10, time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodPost, "/cloudevents",
+		bytes.NewBufferString(`{"specversion":"1.0","id":"1","source":"/ci","type":"x","data":"boom"}`))
+	req.Header.Set("Content-Type", cloudEventsContentType)
+	req.Header.Set("traceparent", "00-"+callerTraceID+"-"+callerSpanID+"-01")
+	w := httptest.NewRecorder()
+	app.handleCloudEvent(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	app.wg.Wait()
+
+	spans := map[string][]tracetest.SpanStub{}
+	for _, s := range exporter.GetSpans() {
+		assert.Equal(t, callerTraceID, s.SpanContext.TraceID().String(), "all in the caller's trace")
+		spans[s.Name] = append(spans[s.Name], s)
+	}
+	handle := spans["handleCloudEvent"]
+	assert.Equal(t, 1, len(handle))
+	assert.Equal(t, callerSpanID, handle[0].Parent.SpanID().String())
+	attempts := spans["chat.postMessage"]
+	assert.Equal(t, 1, len(attempts))
+	assert.Equal(t, handle[0].SpanContext.SpanID(), attempts[0].Parent.SpanID())
+	assert.Equal(t, "00-"+callerTraceID+"-"+attempts[0].SpanContext.SpanID().String()+"-01", traceparent)
+}
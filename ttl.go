@@ -0,0 +1,110 @@
+// ttl.go
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"fortio.org/log"
+)
+
+// With a long backlog or a Slack outage, a message can sit in the queue long enough to be misleading
+// ("CPU high" delivered 30 minutes late). Messages can have a ttl after which they are dropped, or
+// posted with a "delayed by" annotation, instead of being delivered as if they were fresh.
+
+// Header setting the ttl, it can also be set with the ttl body field.
+const ttlHeader = "X-Message-TTL"
+
+const (
+	expiredDrop     = "drop"
+	expiredAnnotate = "annotate"
+)
+
+// parseTTL accepts Go durations ("90s", "5m") or a number of seconds, empty meaning no ttl.
+func parseTTL(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			return 0, fmt.Errorf("invalid ttl %q, expected a duration (e.g. 5m) or a number of seconds", value)
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("invalid ttl %q, must be positive", value)
+	}
+	return ttl, nil
+}
+
+// requestTTL returns the ttl set by the header or, if not, the body field.
+func requestTTL(r *http.Request, bodyTTL string) (time.Duration, error) {
+	if header := r.Header.Get(ttlHeader); header != "" {
+		return parseTTL(header)
+	}
+	return parseTTL(bodyTTL)
+}
+
+// setExpiry sets when the message expires, using the global default when the ttl is 0.
+func (app *App) setExpiry(msg *queuedMessage, ttl time.Duration) {
+	if ttl == 0 {
+		ttl = app.messageTTL
+	}
+	if ttl > 0 {
+		msg.Expires = msg.Received.Add(ttl)
+	}
+}
+
+// expired returns true if the message expired and must not be posted. Depending on expiredAction, the
+// expired messages are either dropped or annotated with how late they are.
+func (app *App) expired(msg *queuedMessage, label string) bool {
+	if msg.Expires.IsZero() || time.Now().Before(msg.Expires) {
+		return false
+	}
+	received := msg.Received
+	if msg.digest != nil {
+		// How late the most recent of the merged messages is.
+		received = msg.digest.newest
+	}
+	delay := time.Since(received).Round(time.Second)
+	if app.expiredAction == expiredAnnotate {
+		log.S(log.Info, "Message expired, posting it annotated", log.String("channel", label),
+			log.String("message_id", msg.ID), log.Any("delay", delay))
+		app.metrics.RequestsExpired.WithLabelValues(label, expiredAnnotate).Inc()
+		annotateDelay(&msg.Request, delay)
+		return false
+	}
+	log.S(log.Warning, "Message expired, dropping it", log.String("channel", label),
+		log.String("message_id", msg.ID), log.Any("delay", delay))
+	app.metrics.RequestsExpired.WithLabelValues(label, expiredDrop).Inc()
+	return true
+}
+
+// annotateDelay prepends the delay to the text and, as the text is only the notification fallback
+// then, as a context block to the blocks (unless they already are at Slack's limit).
+func annotateDelay(request *SlackPostMessageRequest, delay time.Duration) {
+	note := fmt.Sprintf(":hourglass: _Delayed by %s_", delay)
+	if request.Text == "" {
+		request.Text = fallbackText(request)
+	}
+	if request.Text == "" {
+		request.Text = note
+	} else {
+		request.Text = note + "\n" + request.Text
+	}
+	var blocks []json.RawMessage
+	if len(request.Blocks) == 0 || json.Unmarshal(request.Blocks, &blocks) != nil || len(blocks) >= maxBlocks {
+		return
+	}
+	context, _ := json.Marshal(map[string]any{
+		"type":     "context",
+		"elements": []map[string]string{{"type": "mrkdwn", "text": note}},
+	})
+	request.Blocks, _ = json.Marshal(append([]json.RawMessage{context}, blocks...))
+}
@@ -0,0 +1,120 @@
+// ttl_test.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"fortio.org/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseTTL(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"90s", 90 * time.Second, false},
+		{"5m", 5 * time.Minute, false},
+		{"30", 30 * time.Second, false},
+		{"-1m", 0, true},
+		{"0", 0, true},
+		{"soon", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			ttl, err := parseTTL(tt.value)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, ttl)
+		})
+	}
+}
+
+func TestHandleRequest_TTL(t *testing.T) {
+	app := &App{
+		slackQueue: newMessageQueue(10, false),
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		messageTTL: time.Hour,
+	}
+	for _, b := range []struct{ header, body string }{
+		{"", `{"channel":"#c","text":"default"}`},
+		{"", `{"channel":"#c","text":"body","ttl":"2m"}`},
+		{"30", `{"channel":"#c","text":"header","ttl":"2m"}`},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(b.body))
+		if b.header != "" {
+			req.Header.Set(ttlHeader, b.header)
+		}
+		rr := httptest.NewRecorder()
+		app.handleRequest(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+	for _, want := range []time.Duration{time.Hour, 2 * time.Minute, 30 * time.Second} {
+		msg := app.slackQueue.next()
+		assert.Equal(t, want, msg.Expires.Sub(msg.Received), msg.Request.Text)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"channel":"#c","text":"x","ttl":"later"}`))
+	rr := httptest.NewRecorder()
+	app.handleRequest(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestProcessQueue_Expired(t *testing.T) {
+	for _, action := range []string{expiredDrop, expiredAnnotate} {
+		messenger := &RecordingSlackMessenger{}
+		app := &App{
+			slackQueue:    newMessageQueue(10, false),
+			messenger:     messenger,
+			metrics:       NewMetrics(prometheus.NewRegistry()),
+			expiredAction: action,
+		}
+		stale := newQueuedMessage(SlackPostMessageRequest{
+			Channel: "#alerts",
+			Text:    "CPU high",
+			Blocks:  json.RawMessage(`[{"type":"section","text":{"type":"mrkdwn","text":"CPU high"}}]`),
+		}, "")
+		stale.Received = time.Now().Add(-31 * time.Minute)
+		stale.Expires = stale.Received.Add(5 * time.Minute)
+		fresh := newQueuedMessage(SlackPostMessageRequest{Channel: "#alerts", Text: "fresh"}, "")
+		fresh.Expires = fresh.Received.Add(time.Hour)
+		assert.NoError(t, app.enqueue(stale))
+		assert.NoError(t, app.enqueue(fresh))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go app.processQueue(ctx, 0, time.Millisecond, 10, time.Millisecond)
+		app.wg.Wait()
+		cancel()
+
+		requests := messenger.Requests()
+		assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.RequestsExpired.WithLabelValues("#alerts", action)))
+		if action == expiredDrop {
+			assert.Equal(t, 1, len(requests))
+			assert.Equal(t, "fresh", requests[0].Text)
+			continue
+		}
+		assert.Equal(t, 2, len(requests))
+		assert.Equal(t, ":hourglass: _Delayed by 31m0s_\nCPU high", requests[0].Text)
+		assert.Equal(t, `[{"elements":[{"text":":hourglass: _Delayed by 31m0s_","type":"mrkdwn"}],"type":"context"},`+
+			`{"type":"section","text":{"type":"mrkdwn","text":"CPU high"}}]`, string(requests[0].Blocks))
+		assert.Equal(t, "fresh", requests[1].Text)
+	}
+}
+
+func TestAnnotateDelay_MaxBlocks(t *testing.T) {
+	blocks := json.RawMessage("[" + strings.Repeat(`{"type":"divider"},`, maxBlocks-1) + `{"type":"divider"}]`)
+	request := SlackPostMessageRequest{Channel: "#c", Text: "CPU high", Blocks: blocks}
+	annotateDelay(&request, time.Minute)
+	assert.Equal(t, ":hourglass: _Delayed by 1m0s_\nCPU high", request.Text, "only in the text")
+	assert.Equal(t, string(blocks), string(request.Blocks), "already at the limit")
+}
@@ -0,0 +1,365 @@
+// webhooks.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"fortio.org/log"
+)
+
+// The Mattermost, Discord and Teams messengers post to incoming webhooks. The Slack requests are
+// converted: the mrkdwn to markdown and the blocks (headers, sections, fields, context, dividers and
+// images) and attachments to each tool's closest equivalent. Interactive elements are dropped.
+
+// Discord rejects longer contents.
+const discordMaxContent = 2000
+
+// richPart is a block, or attachment piece, in a tool neutral form.
+type richPart struct {
+	kind   string // header, text, fields, context, divider or image
+	text   string // markdown, the alt text for images
+	url    string // of images
+	fields []string
+}
+
+var (
+	mrkdwnLabeledLink = regexp.MustCompile(`<((?:https?|mailto):[^|>]+)\|([^>]+)>`)
+	mrkdwnLink        = regexp.MustCompile(`<((?:https?|mailto):[^|>]+)>`)
+	mrkdwnChannel     = regexp.MustCompile(`<#[A-Z0-9]+\|([^>]+)>`)
+	mrkdwnSpecial     = regexp.MustCompile(`<!(here|channel|everyone)(?:\|[^>]*)?>`)
+	mrkdwnBold        = regexp.MustCompile(`(^|[\s(>_~])\*([^*\s](?:[^*\n]*[^*\s])?)\*`)
+	mrkdwnStrike      = regexp.MustCompile(`(^|[\s(>_*])~([^~\s](?:[^~\n]*[^~\s])?)~`)
+	mrkdwnEntities    = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+)
+
+// slackToMarkdown converts Slack's mrkdwn to the common markdown.
+func slackToMarkdown(text string) string {
+	text = mrkdwnLabeledLink.ReplaceAllString(text, "[$2]($1)")
+	text = mrkdwnLink.ReplaceAllString(text, "$1")
+	text = mrkdwnChannel.ReplaceAllString(text, "#$1")
+	text = mrkdwnSpecial.ReplaceAllString(text, "@$1")
+	text = mrkdwnBold.ReplaceAllString(text, "$1**$2**")
+	text = mrkdwnStrike.ReplaceAllString(text, "$1~~$2~~")
+	return mrkdwnEntities.Replace(text)
+}
+
+// textObject is a Block Kit text, only mrkdwn ones are converted.
+type textObject struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func (t *textObject) markdown() string {
+	if t == nil {
+		return ""
+	}
+	if t.Type == "plain_text" {
+		return t.Text
+	}
+	return slackToMarkdown(t.Text)
+}
+
+// blockParts converts the blocks, the ones without an equivalent are skipped.
+func blockParts(parts []richPart, blocks json.RawMessage) []richPart {
+	var list []struct {
+		Type     string          `json:"type"`
+		Text     json.RawMessage `json:"text"`
+		Fields   []textObject    `json:"fields"`
+		Elements []struct {
+			Type string          `json:"type"`
+			Text json.RawMessage `json:"text"` // an object for the interactive elements
+		} `json:"elements"`
+		ImageURL string `json:"image_url"`
+		AltText  string `json:"alt_text"`
+	}
+	if len(blocks) == 0 || json.Unmarshal(blocks, &list) != nil {
+		return parts
+	}
+	for _, block := range list {
+		switch block.Type {
+		case "header", "section":
+			var text *textObject
+			_ = json.Unmarshal(block.Text, &text)
+			if text != nil && text.Text != "" {
+				kind := "text"
+				if block.Type == "header" {
+					kind = "header"
+				}
+				parts = append(parts, richPart{kind: kind, text: text.markdown()})
+			}
+			if len(block.Fields) > 0 {
+				fields := make([]string, 0, len(block.Fields))
+				for _, field := range block.Fields {
+					fields = append(fields, field.markdown())
+				}
+				parts = append(parts, richPart{kind: "fields", fields: fields})
+			}
+		case "markdown":
+			var text string
+			if json.Unmarshal(block.Text, &text) == nil && text != "" {
+				parts = append(parts, richPart{kind: "text", text: text})
+			}
+		case "context":
+			var texts []string
+			for _, element := range block.Elements {
+				text := textObject{Type: element.Type}
+				if (element.Type == "mrkdwn" || element.Type == "plain_text") && json.Unmarshal(element.Text, &text.Text) == nil {
+					texts = append(texts, text.markdown())
+				}
+			}
+			if len(texts) > 0 {
+				parts = append(parts, richPart{kind: "context", text: strings.Join(texts, " ")})
+			}
+		case "divider":
+			parts = append(parts, richPart{kind: "divider"})
+		case "image":
+			parts = append(parts, richPart{kind: "image", text: block.AltText, url: block.ImageURL})
+		}
+	}
+	return parts
+}
+
+// attachmentParts converts the (legacy) attachments.
+func attachmentParts(parts []richPart, attachments json.RawMessage) []richPart {
+	var list []struct {
+		Fallback string `json:"fallback"`
+		Pretext  string `json:"pretext"`
+		Title    string `json:"title"`
+		Text     string `json:"text"`
+		Fields   []struct {
+			Title string `json:"title"`
+			Value string `json:"value"`
+		} `json:"fields"`
+		ImageURL string          `json:"image_url"`
+		Footer   string          `json:"footer"`
+		Blocks   json.RawMessage `json:"blocks"`
+	}
+	if len(attachments) == 0 || json.Unmarshal(attachments, &list) != nil {
+		return parts
+	}
+	for _, attachment := range list {
+		before := len(parts)
+		if attachment.Pretext != "" {
+			parts = append(parts, richPart{kind: "text", text: slackToMarkdown(attachment.Pretext)})
+		}
+		if attachment.Title != "" {
+			parts = append(parts, richPart{kind: "header", text: attachment.Title})
+		}
+		if attachment.Text != "" {
+			parts = append(parts, richPart{kind: "text", text: slackToMarkdown(attachment.Text)})
+		}
+		if len(attachment.Fields) > 0 {
+			fields := make([]string, 0, len(attachment.Fields))
+			for _, field := range attachment.Fields {
+				fields = append(fields, fmt.Sprintf("**%s**: %s", field.Title, slackToMarkdown(field.Value)))
+			}
+			parts = append(parts, richPart{kind: "fields", fields: fields})
+		}
+		parts = blockParts(parts, attachment.Blocks)
+		if attachment.ImageURL != "" {
+			parts = append(parts, richPart{kind: "image", url: attachment.ImageURL})
+		}
+		if attachment.Footer != "" {
+			parts = append(parts, richPart{kind: "context", text: slackToMarkdown(attachment.Footer)})
+		}
+		if len(parts) == before && attachment.Fallback != "" {
+			parts = append(parts, richPart{kind: "text", text: attachment.Fallback})
+		}
+	}
+	return parts
+}
+
+// messageParts converts the message: its blocks or, as for Slack, its text when it has none, followed by
+// the attachments.
+func messageParts(request *SlackPostMessageRequest, withAttachments bool) []richPart {
+	var parts []richPart
+	if len(request.Blocks) > 0 {
+		parts = blockParts(parts, request.Blocks)
+	} else if request.Text != "" {
+		parts = append(parts, richPart{kind: "text", text: slackToMarkdown(request.Text)})
+	}
+	if withAttachments {
+		parts = attachmentParts(parts, request.Attachments)
+	}
+	return parts
+}
+
+// markdown renders the parts as a markdown text, images included unless withImages is false.
+func markdown(parts []richPart, withImages bool) string {
+	var lines []string
+	for _, part := range parts {
+		switch part.kind {
+		case "header":
+			lines = append(lines, "### "+part.text)
+		case "text":
+			lines = append(lines, part.text)
+		case "fields":
+			lines = append(lines, "- "+strings.Join(part.fields, "\n- "))
+		case "context":
+			lines = append(lines, "_"+part.text+"_")
+		case "divider":
+			lines = append(lines, "---")
+		case "image":
+			if withImages {
+				lines = append(lines, fmt.Sprintf("![%s](%s)", part.text, part.url))
+			}
+		}
+	}
+	return strings.Join(lines, "\n\n")
+}
+
+// postWebhook posts the json payload, mapping the http errors to the Slack ones CheckError knows.
+func postWebhook(ctx context.Context, client *http.Client, url string, payload any) (SlackResponse, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return SlackResponse{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return SlackResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	injectTrace(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return SlackResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return SlackResponse{Ok: true}, nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	var code string
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		code = "ratelimited"
+	case resp.StatusCode >= 500:
+		code = "internal_error"
+	case resp.StatusCode == http.StatusNotFound:
+		code = "channel_not_found"
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		code = "invalid_auth"
+	default:
+		code = "invalid_arguments"
+	}
+	log.S(log.Debug, "Webhook error", log.Int("status", resp.StatusCode), log.String("body", string(detail)))
+	return SlackResponse{Ok: false, Error: code}, errors.New(code)
+}
+
+// MattermostClient posts to Mattermost incoming webhooks, which accept Slack compatible payloads except
+// for the blocks.
+type MattermostClient struct {
+	client *http.Client
+}
+
+func (m *MattermostClient) PostMessage(ctx context.Context, request SlackPostMessageRequest, url string, _ string) (SlackResponse, error) {
+	payload := map[string]any{
+		"text": markdown(messageParts(&request, false), true),
+	}
+	if request.Channel != "" {
+		payload["channel"] = strings.TrimPrefix(request.Channel, "#")
+	}
+	if request.Username != "" {
+		payload["username"] = request.Username
+	}
+	if request.IconURL != "" {
+		payload["icon_url"] = request.IconURL
+	}
+	if request.IconEmoji != "" {
+		payload["icon_emoji"] = strings.Trim(request.IconEmoji, ":")
+	}
+	if len(request.Attachments) > 0 {
+		payload["attachments"] = request.Attachments
+	}
+	return postWebhook(ctx, m.client, url, payload)
+}
+
+// DiscordClient posts to Discord webhooks, the images become embeds.
+type DiscordClient struct {
+	client *http.Client
+}
+
+func (d *DiscordClient) PostMessage(ctx context.Context, request SlackPostMessageRequest, url string, _ string) (SlackResponse, error) {
+	parts := messageParts(&request, true)
+	content := markdown(parts, false)
+	if runes := []rune(content); len(runes) > discordMaxContent {
+		content = string(runes[:discordMaxContent-1]) + "…"
+	}
+	payload := map[string]any{
+		"content": content,
+		// Slack's mentions don't translate, and nobody should get pinged by accident.
+		"allowed_mentions": map[string]any{"parse": []string{}},
+	}
+	var embeds []map[string]any
+	for _, part := range parts {
+		if part.kind == "image" && len(embeds) < 10 {
+			embeds = append(embeds, map[string]any{"image": map[string]string{"url": part.url}, "description": part.text})
+		}
+	}
+	if len(embeds) > 0 {
+		payload["embeds"] = embeds
+	}
+	if request.Username != "" {
+		payload["username"] = request.Username
+	}
+	if request.IconURL != "" {
+		payload["avatar_url"] = request.IconURL
+	}
+	return postWebhook(ctx, d.client, url, payload)
+}
+
+// TeamsClient posts Adaptive Cards to Microsoft Teams incoming webhooks (workflows).
+type TeamsClient struct {
+	client *http.Client
+}
+
+func (t *TeamsClient) PostMessage(ctx context.Context, request SlackPostMessageRequest, url string, _ string) (SlackResponse, error) {
+	var body []map[string]any
+	separator := false
+	add := func(element map[string]any) {
+		if separator {
+			element["separator"] = true
+			separator = false
+		}
+		body = append(body, element)
+	}
+	for _, part := range messageParts(&request, true) {
+		switch part.kind {
+		case "header":
+			add(map[string]any{"type": "TextBlock", "text": part.text, "size": "Large", "weight": "Bolder", "wrap": true})
+		case "text":
+			add(map[string]any{"type": "TextBlock", "text": part.text, "wrap": true})
+		case "fields":
+			add(map[string]any{"type": "TextBlock", "text": strings.Join(part.fields, "\n\n"), "wrap": true})
+		case "context":
+			add(map[string]any{"type": "TextBlock", "text": part.text, "size": "Small", "isSubtle": true, "wrap": true})
+		case "divider":
+			separator = true
+		case "image":
+			add(map[string]any{"type": "Image", "url": part.url, "altText": part.text})
+		}
+	}
+	payload := map[string]any{
+		"type": "message",
+		"attachments": []map[string]any{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": map[string]any{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.4",
+				"body":    body,
+			},
+		}},
+	}
+	return postWebhook(ctx, t.client, url, payload)
+}
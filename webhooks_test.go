@@ -0,0 +1,128 @@
+// webhooks_test.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"fortio.org/assert"
+)
+
+func TestSlackToMarkdown(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"plain", "plain"},
+		{"*bold* and _italic_ and ~gone~", "**bold** and _italic_ and ~~gone~~"},
+		{"a * b * c", "a * b * c"},
+		{"see <https://example.com/x?a=1&amp;b=2|the dashboard>", "see [the dashboard](https://example.com/x?a=1&b=2)"},
+		{"<https://example.com>", "https://example.com"},
+		{"<!here> in <#C123|ops>", "@here in #ops"},
+		{"1 &lt; 2 &amp;&amp; 3 &gt; 2", "1 < 2 && 3 > 2"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, slackToMarkdown(tt.in))
+	}
+}
+
+var richRequest = SlackPostMessageRequest{
+	Channel:  "#alerts",
+	Text:     "fallback",
+	Username: "ci",
+	IconURL:  "https://example.com/ci.png",
+	Blocks: json.RawMessage(`[
+		{"type":"header","text":{"type":"plain_text","text":"Deploy failed"}},
+		{"type":"section","text":{"type":"mrkdwn","text":"*api* v2"},"fields":[{"type":"mrkdwn","text":"env: prod"},{"type":"mrkdwn","text":"by: ci"}]},
+		{"type":"divider"},
+		{"type":"image","image_url":"https://example.com/graph.png","alt_text":"graph"},
+		{"type":"actions","elements":[{"type":"button","text":{"type":"plain_text","text":"Retry"}}]},
+		{"type":"context","elements":[{"type":"mrkdwn","text":"<https://ci/1|build 1>"}]}
+	]`),
+	Attachments: json.RawMessage(`[{"title":"Logs","text":"exit 1","fields":[{"title":"step","value":"test"}]}]`),
+}
+
+// captureWebhook returns a server recording the posted payload, answering with the status.
+func captureWebhook(t *testing.T, status int, payload *map[string]any) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(payload))
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMattermostClient(t *testing.T) {
+	var payload map[string]any
+	server := captureWebhook(t, http.StatusOK, &payload)
+	client := &MattermostClient{client: server.Client()}
+	response, err := client.PostMessage(context.Background(), richRequest, server.URL, "")
+	assert.NoError(t, err)
+	assert.True(t, response.Ok)
+	assert.Equal(t, "alerts", payload["channel"])
+	assert.Equal(t, "ci", payload["username"])
+	assert.Equal(t, "### Deploy failed\n\n**api** v2\n\n- env: prod\n- by: ci\n\n---\n\n![graph](https://example.com/graph.png)\n\n"+
+		"_[build 1](https://ci/1)_", payload["text"])
+	assert.Equal(t, "Logs", payload["attachments"].([]any)[0].(map[string]any)["title"], "attachments are passed as is")
+}
+
+func TestDiscordClient(t *testing.T) {
+	var payload map[string]any
+	server := captureWebhook(t, http.StatusNoContent, &payload)
+	client := &DiscordClient{client: server.Client()}
+	_, err := client.PostMessage(context.Background(), richRequest, server.URL, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "### Deploy failed\n\n**api** v2\n\n- env: prod\n- by: ci\n\n---\n\n_[build 1](https://ci/1)_\n\n"+
+		"### Logs\n\nexit 1\n\n- **step**: test", payload["content"])
+	assert.Equal(t, "https://example.com/ci.png", payload["avatar_url"])
+	embeds := payload["embeds"].([]any)
+	assert.Equal(t, 1, len(embeds))
+	assert.Equal(t, "https://example.com/graph.png", embeds[0].(map[string]any)["image"].(map[string]any)["url"])
+
+	plain := SlackPostMessageRequest{Channel: "#alerts", Text: "hello *world*"}
+	payload = nil
+	_, err = client.PostMessage(context.Background(), plain, server.URL, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello **world**", payload["content"])
+	_, found := payload["embeds"]
+	assert.False(t, found)
+}
+
+func TestTeamsClient(t *testing.T) {
+	var payload map[string]any
+	server := captureWebhook(t, http.StatusAccepted, &payload)
+	client := &TeamsClient{client: server.Client()}
+	_, err := client.PostMessage(context.Background(), richRequest, server.URL, "")
+	assert.NoError(t, err)
+	card := payload["attachments"].([]any)[0].(map[string]any)
+	assert.Equal(t, "application/vnd.microsoft.card.adaptive", card["contentType"])
+	body := card["content"].(map[string]any)["body"].([]any)
+	assert.Equal(t, 8, len(body))
+	header := body[0].(map[string]any)
+	assert.Equal(t, "Deploy failed", header["text"])
+	assert.Equal(t, "Large", header["size"])
+	assert.Equal(t, "env: prod\n\nby: ci", body[2].(map[string]any)["text"])
+	image := body[3].(map[string]any)
+	assert.Equal(t, "Image", image["type"])
+	assert.Equal(t, true, image["separator"], "after the divider")
+	assert.Equal(t, "Logs", body[5].(map[string]any)["text"])
+}
+
+func TestPostWebhook_Errors(t *testing.T) {
+	for status, want := range map[int]string{
+		http.StatusTooManyRequests:       "ratelimited",
+		http.StatusBadGateway:            "internal_error",
+		http.StatusNotFound:              "channel_not_found",
+		http.StatusForbidden:             "invalid_auth",
+		http.StatusRequestEntityTooLarge: "invalid_arguments",
+	} {
+		var payload map[string]any
+		server := captureWebhook(t, status, &payload)
+		response, err := postWebhook(context.Background(), server.Client(), server.URL, map[string]string{"text": "x"})
+		assert.Error(t, err)
+		assert.Equal(t, want, err.Error())
+		assert.Equal(t, want, response.Error)
+	}
+}